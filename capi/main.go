@@ -0,0 +1,115 @@
+// Command capi exposes the codec through a C API, so that C, Python, Rust
+// and other programs can link against it. Build it with
+//
+//	go build -buildmode=c-shared -o libsinogram.so ./capi
+//
+// which also writes libsinogram.h declaring:
+//
+//	char *SinogramEncode(void *data, size_t length, char *dict, char **errOut);
+//	void *SinogramDecode(char *text, char *dict, size_t *length, char **errOut);
+//	void SinogramFree(void *p);
+//
+// dict is the path of a dictionary file; decode may pass "" for text that
+// embeds its dictionary. Encoding uses base64 mode. Results are allocated
+// with malloc and must be released with SinogramFree. On failure both
+// return NULL and, if errOut is not NULL, set *errOut to a message that
+// must be released likewise. The functions may be called from several
+// threads.
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/Kaiser-Zheng/sinogram/codec"
+)
+
+// codecs holds a frozen codec per dictionary path, loaded on first use
+var (
+	codecsMu sync.Mutex
+	codecs   = make(map[string]*codec.Codec)
+)
+
+func main() {}
+
+// SinogramEncode encodes length bytes at data with the dictionary at dict
+//
+//export SinogramEncode
+func SinogramEncode(data unsafe.Pointer, length C.size_t, dict *C.char, errOut **C.char) *C.char {
+	c, err := codecFor(C.GoString(dict))
+	if err != nil {
+		return fail(errOut, err)
+	}
+	if c.MappedPairs() == 0 {
+		return fail(errOut, codec.ErrNoDictionary)
+	}
+
+	encoded, err := c.EncodeBytes(unsafe.Slice((*byte)(data), length))
+	if err != nil {
+		return fail(errOut, err)
+	}
+	return C.CString(encoded)
+}
+
+// SinogramDecode decodes the NUL-terminated text with the dictionary at
+// dict, storing the length of the result in *length
+//
+//export SinogramDecode
+func SinogramDecode(text *C.char, dict *C.char, length *C.size_t, errOut **C.char) unsafe.Pointer {
+	c, err := codecFor(C.GoString(dict))
+	if err != nil {
+		fail(errOut, err)
+		return nil
+	}
+
+	decoded, err := c.DecodeBytes(C.GoString(text))
+	if err != nil {
+		fail(errOut, err)
+		return nil
+	}
+	*length = C.size_t(len(decoded))
+	return C.CBytes(decoded)
+}
+
+// SinogramFree releases a result or error message
+//
+//export SinogramFree
+func SinogramFree(p unsafe.Pointer) {
+	C.free(p)
+}
+
+// codecFor returns the frozen codec for the dictionary at path, loading it
+// the first time. Messages are not logged, as the host program owns the
+// terminal.
+func codecFor(path string) (*codec.Codec, error) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if c, ok := codecs[path]; ok {
+		return c, nil
+	}
+
+	c := codec.NewCodec(codec.WithLogger(nil))
+	if path != "" {
+		if err := c.LoadDictionary(path); err != nil {
+			return nil, err
+		}
+		if err := c.Freeze(); err != nil {
+			return nil, err
+		}
+	}
+	codecs[path] = c
+	return c, nil
+}
+
+// fail stores err in *errOut, if it is not NULL, and returns NULL
+func fail(errOut **C.char, err error) *C.char {
+	if errOut != nil {
+		*errOut = C.CString(err.Error())
+	}
+	return nil
+}
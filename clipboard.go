@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"unicode/utf8"
+)
+
+// clipboardCommands returns the commands that print the system clipboard
+// and replace it with their standard input, using the tools of the
+// platform: pbpaste and pbcopy on macOS, wl-clipboard, xclip or xsel on
+// Linux and PowerShell on Windows
+func clipboardCommands() (paste, copy []string, err error) {
+	switch runtime.GOOS {
+	case "darwin":
+		return []string{"pbpaste"}, []string{"pbcopy"}, nil
+	case "windows":
+		// PowerShell converts to and from UTF-16 itself once told the
+		// console's encoding; Get-Clipboard -Raw keeps the line breaks
+		utf8 := "[Console]::InputEncoding = [Console]::OutputEncoding = [Text.UTF8Encoding]::new($false); "
+		return []string{"powershell", "-NoProfile", "-Command", utf8 + "[Console]::Out.Write((Get-Clipboard -Raw))"},
+			[]string{"powershell", "-NoProfile", "-Command", utf8 + "Set-Clipboard -Value ([Console]::In.ReadToEnd())"}, nil
+	}
+
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		if _, err := exec.LookPath("wl-copy"); err == nil {
+			return []string{"wl-paste", "--no-newline"}, []string{"wl-copy"}, nil
+		}
+	}
+	if _, err := exec.LookPath("xclip"); err == nil {
+		return []string{"xclip", "-selection", "clipboard", "-out"}, []string{"xclip", "-selection", "clipboard", "-in"}, nil
+	}
+	if _, err := exec.LookPath("xsel"); err == nil {
+		return []string{"xsel", "--clipboard", "--output"}, []string{"xsel", "--clipboard", "--input"}, nil
+	}
+	return nil, nil, errors.New("no clipboard tool found; install wl-clipboard, xclip or xsel")
+}
+
+// readClipboard returns the text on the system clipboard
+func readClipboard() ([]byte, error) {
+	paste, _, err := clipboardCommands()
+	if err != nil {
+		return nil, err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(paste[0], paste[1:]...)
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the clipboard: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return data, nil
+}
+
+// writeClipboard replaces the text on the system clipboard with data
+func writeClipboard(data []byte) error {
+	_, copy, err := clipboardCommands()
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(copy[0], copy[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to write the clipboard: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// clipboardWriter collects what is written to its file, so that it can
+// stand in for standard output, and copies it to the clipboard on Close.
+// Nothing is copied if the program exits first, as it does on failure.
+type clipboardWriter struct {
+	*os.File
+	data chan []byte
+}
+
+// newClipboardWriter returns a clipboardWriter, failing early when the
+// platform has no clipboard tool
+func newClipboardWriter() (*clipboardWriter, error) {
+	if _, _, err := clipboardCommands(); err != nil {
+		return nil, err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cw := &clipboardWriter{File: w, data: make(chan []byte, 1)}
+	go func() {
+		data, _ := io.ReadAll(r)
+		r.Close()
+		cw.data <- data
+	}()
+	return cw, nil
+}
+
+// Close copies everything written to the clipboard
+func (cw *clipboardWriter) Close() error {
+	cw.File.Close()
+	data := <-cw.data
+	if !utf8.Valid(data) {
+		logger.Warn("the output is not UTF-8 text, which the clipboard may not keep intact")
+	}
+	return writeClipboard(data)
+}
@@ -0,0 +1,140 @@
+package codec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Alphabet is a set of characters mappings are built from: LoadDictionary
+// takes the characters of a dictionary that belong to the codec's alphabet
+// and ignores the rest. Only characters that can never be confused with
+// encoded data or markup are ever used, whatever Contains reports; see the
+// custom alphabet.
+type Alphabet struct {
+	Name  string // Registry name, as given to WithAlphabet and -alphabet
+	Label string // How messages name its characters, e.g. "Chinese"
+
+	// Contains reports whether r belongs to the alphabet
+	Contains func(r rune) bool
+}
+
+// DefaultAlphabet is the alphabet codecs use unless told otherwise
+const DefaultAlphabet = "cjk"
+
+var (
+	alphabetsMu sync.RWMutex
+	alphabets   = make(map[string]*Alphabet)
+)
+
+func init() {
+	RegisterAlphabet(Alphabet{Name: "cjk", Label: "Chinese", Contains: IsChineseChar})
+	RegisterAlphabet(Alphabet{Name: "kana", Label: "kana", Contains: func(r rune) bool {
+		return unicode.In(r, unicode.Hiragana, unicode.Katakana)
+	}})
+	RegisterAlphabet(Alphabet{Name: "hangul", Label: "Hangul", Contains: func(r rune) bool {
+		return r >= 0xAC00 && r <= 0xD7A3 // Precomposed syllables; jamo would combine
+	}})
+	RegisterAlphabet(Alphabet{Name: "emoji", Label: "emoji", Contains: func(r rune) bool {
+		// Pictographs only: modifiers, joiners and selectors build sequences
+		return ((r >= 0x1F300 && r <= 0x1F6FF) || // Symbols and Pictographs through Transport and Map
+			(r >= 0x1F900 && r <= 0x1F9FF) || // Supplemental Symbols and Pictographs
+			(r >= 0x1FA70 && r <= 0x1FAFF)) && // Symbols and Pictographs Extended-A
+			unicode.Is(unicode.So, r)
+	}})
+	RegisterAlphabet(Alphabet{Name: "custom", Label: "non-ASCII", Contains: func(rune) bool {
+		return true
+	}})
+}
+
+// RegisterAlphabet makes a available to WithAlphabet under a.Name. Like
+// sql.Register, it panics if the name is empty or already registered, or
+// if Contains is nil.
+func RegisterAlphabet(a Alphabet) {
+	if a.Name == "" || a.Contains == nil {
+		panic("codec: RegisterAlphabet needs a name and a Contains function")
+	}
+
+	alphabetsMu.Lock()
+	defer alphabetsMu.Unlock()
+	if _, dup := alphabets[a.Name]; dup {
+		panic("codec: RegisterAlphabet called twice for alphabet " + a.Name)
+	}
+	if a.Label == "" {
+		a.Label = a.Name
+	}
+	alphabets[a.Name] = &a
+}
+
+// LookupAlphabet returns the alphabet registered under name
+func LookupAlphabet(name string) (*Alphabet, bool) {
+	alphabetsMu.RLock()
+	defer alphabetsMu.RUnlock()
+	a, ok := alphabets[name]
+	return a, ok
+}
+
+// Alphabets lists the names of the registered alphabets, sorted
+func Alphabets() []string {
+	alphabetsMu.RLock()
+	defer alphabetsMu.RUnlock()
+	names := make([]string, 0, len(alphabets))
+	for name := range alphabets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Has reports whether r is a character of a that mappings can use
+func (a *Alphabet) Has(r rune) bool {
+	return usableChar(r) && a.Contains(r)
+}
+
+// Extract collects the unique characters of a in text, in order of first
+// appearance
+func (a *Alphabet) Extract(text string) []rune {
+	seen := make(map[rune]bool)
+	var chars []rune
+
+	for _, r := range text {
+		if !seen[r] && a.Has(r) {
+			chars = append(chars, r)
+			seen[r] = true
+		}
+	}
+
+	return chars
+}
+
+// usableChar reports whether r can stand for a pair at all: a non-ASCII
+// letter, number, punctuation mark or symbol that is neither an escape
+// marker nor the default placeholder. ASCII would be taken for base64,
+// spaces for separators, and marks and format characters combine with
+// their neighbours.
+func usableChar(r rune) bool {
+	return r >= utf8.RuneSelf && r != DefaultPlaceholder &&
+		string(r) != escapeOpen && string(r) != escapeClose &&
+		unicode.In(r, unicode.L, unicode.N, unicode.P, unicode.S)
+}
+
+// alphabetName returns the name of the codec's alphabet
+func (c *Codec) alphabetName() string {
+	if c.Alphabet == "" {
+		return DefaultAlphabet
+	}
+	return c.Alphabet
+}
+
+// alphabet resolves the codec's Alphabet setting
+func (c *Codec) alphabet() (*Alphabet, error) {
+	name := c.alphabetName()
+	a, ok := LookupAlphabet(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown alphabet %q (use %s)", name, strings.Join(Alphabets(), ", "))
+	}
+	return a, nil
+}
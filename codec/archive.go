@@ -0,0 +1,283 @@
+package codec
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveFS is a read-only fs.FS over an encoded tar archive, as written by
+// "sinogram pack", so encoded bundles can be served with http.FileServer
+// or walked with fs.WalkDir without extracting them. Nothing is decoded
+// until it is needed: NewArchiveFS decodes the archive once to index its
+// entries, and each file decodes the archive again, up to and through its
+// own content, when it is first read. Reads and seeks are sequential, so
+// serving a file costs decoding the archive up to its end; a gzip
+// archive is decompressed on the way.
+type ArchiveFS struct {
+	c    *Codec
+	r    io.ReaderAt
+	size int64
+
+	entries map[string]*archiveEntry // By slash-separated path; "." is the root
+}
+
+// archiveEntry is a file or directory of an archive
+type archiveEntry struct {
+	name     string      // Path within the archive
+	hdr      *tar.Header // nil for directories the archive only implies
+	index    int         // Position among the archive's entries
+	children []string    // Base names of a directory's entries, sorted
+}
+
+// NewArchiveFS indexes the encoded archive of size bytes read from r,
+// decoding it in base64 mode with c. r is read again whenever a file is
+// opened, so it must stay valid while the FS is used; an *os.File or a
+// *bytes.Reader will do. Files may be read from several goroutines at
+// once if c is frozen.
+func NewArchiveFS(c *Codec, r io.ReaderAt, size int64) (*ArchiveFS, error) {
+	afs := &ArchiveFS{c: c, r: r, size: size, entries: map[string]*archiveEntry{".": {name: "."}}}
+
+	tr, dec, err := afs.open()
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if !fs.ValidPath(name) || name == "." {
+			return nil, fmt.Errorf("invalid archive entry %q", hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg:
+			afs.add(name, hdr, i)
+		}
+	}
+
+	// Decode to the end so a checksum after the archive is still verified
+	if _, err := io.Copy(io.Discard, dec); err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	for _, e := range afs.entries {
+		sort.Strings(e.children)
+	}
+	return afs, nil
+}
+
+// add records an entry and any parent directories the archive leaves out
+func (afs *ArchiveFS) add(name string, hdr *tar.Header, index int) {
+	if e, ok := afs.entries[name]; ok {
+		// A later entry for the same path replaces the earlier one
+		e.hdr, e.index = hdr, index
+		return
+	}
+	afs.entries[name] = &archiveEntry{name: name, hdr: hdr, index: index}
+
+	dir := path.Dir(name)
+	if _, ok := afs.entries[dir]; !ok {
+		afs.add(dir, nil, -1)
+	}
+	parent := afs.entries[dir]
+	parent.children = append(parent.children, path.Base(name))
+}
+
+// open starts decoding the archive from the beginning, returning a tar
+// reader over it and the decoder to close when done
+func (afs *ArchiveFS) open() (*tar.Reader, *Decoder, error) {
+	dec := afs.c.NewDecoder(io.NewSectionReader(afs.r, 0, afs.size), true)
+
+	br := bufio.NewReader(dec)
+	var r io.Reader = br
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			dec.Close()
+			return nil, nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		r = zr
+	}
+	return tar.NewReader(r), dec, nil
+}
+
+// Open opens the named file or directory
+func (afs *ArchiveFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := afs.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if e.isDir() {
+		return &archiveDir{afs: afs, entry: e}, nil
+	}
+	return &archiveFile{afs: afs, entry: e}, nil
+}
+
+// isDir reports whether e is a directory
+func (e *archiveEntry) isDir() bool {
+	return e.hdr == nil || e.hdr.Typeflag == tar.TypeDir
+}
+
+// info describes e
+func (e *archiveEntry) info() fs.FileInfo {
+	if e.hdr == nil {
+		return impliedDirInfo(path.Base(e.name))
+	}
+	return e.hdr.FileInfo()
+}
+
+// impliedDirInfo describes a directory the archive has no entry for
+type impliedDirInfo string
+
+func (d impliedDirInfo) Name() string       { return string(d) }
+func (d impliedDirInfo) Size() int64        { return 0 }
+func (d impliedDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (d impliedDirInfo) ModTime() time.Time { return time.Time{} }
+func (d impliedDirInfo) IsDir() bool        { return true }
+func (d impliedDirInfo) Sys() any           { return nil }
+
+// archiveDir is an open directory of an ArchiveFS
+type archiveDir struct {
+	afs   *ArchiveFS
+	entry *archiveEntry
+	read  int // Children already returned by ReadDir
+}
+
+func (d *archiveDir) Stat() (fs.FileInfo, error) { return d.entry.info(), nil }
+func (d *archiveDir) Close() error               { return nil }
+
+func (d *archiveDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.entry.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries of the directory, or all remaining
+// ones when n <= 0, as fs.ReadDirFile specifies
+func (d *archiveDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entry.children[d.read:]
+	if n > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		rest = rest[:min(n, len(rest))]
+	}
+
+	list := make([]fs.DirEntry, len(rest))
+	for i, base := range rest {
+		child := d.afs.entries[path.Join(d.entry.name, base)]
+		list[i] = fs.FileInfoToDirEntry(child.info())
+	}
+	d.read += len(rest)
+	return list, nil
+}
+
+// archiveFile is an open regular file of an ArchiveFS. Its content is
+// decoded on the first Read; a Seek takes effect at the next Read, which
+// decodes again from the start of the archive when seeking backwards.
+type archiveFile struct {
+	afs   *ArchiveFS
+	entry *archiveEntry
+
+	tr  *tar.Reader // Positioned within the file's content, or nil
+	dec *Decoder
+	at  int64 // Offset tr has reached
+	pos int64 // Offset the next Read starts at
+}
+
+func (f *archiveFile) Stat() (fs.FileInfo, error) { return f.entry.info(), nil }
+
+// Read reads the file's content from the current offset
+func (f *archiveFile) Read(p []byte) (int, error) {
+	if f.pos >= f.entry.hdr.Size {
+		return 0, io.EOF
+	}
+	if f.tr == nil || f.pos < f.at {
+		if err := f.rewind(); err != nil {
+			return 0, err
+		}
+	}
+	if f.pos > f.at {
+		if _, err := io.CopyN(io.Discard, f.tr, f.pos-f.at); err != nil {
+			return 0, f.readError(err)
+		}
+		f.at = f.pos
+	}
+
+	n, err := f.tr.Read(p)
+	f.at += int64(n)
+	f.pos = f.at
+	if err != nil && err != io.EOF {
+		err = f.readError(err)
+	}
+	return n, err
+}
+
+// rewind decodes the archive from the start up to the file's content
+func (f *archiveFile) rewind() error {
+	f.Close()
+	tr, dec, err := f.afs.open()
+	if err != nil {
+		return &fs.PathError{Op: "read", Path: f.entry.name, Err: err}
+	}
+	f.tr, f.dec, f.at = tr, dec, 0
+
+	for i := 0; i <= f.entry.index; i++ {
+		if _, err := tr.Next(); err != nil {
+			return f.readError(err)
+		}
+	}
+	return nil
+}
+
+// readError describes a failure to decode the file's content
+func (f *archiveFile) readError(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &fs.PathError{Op: "read", Path: f.entry.name, Err: err}
+}
+
+// Seek sets the offset of the next Read, so that http.FileServer can
+// serve the file
+func (f *archiveFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.entry.hdr.Size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.entry.name, Err: fs.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Close stops decoding the file
+func (f *archiveFile) Close() error {
+	if f.dec != nil {
+		f.dec.Close()
+		f.tr, f.dec = nil, nil
+	}
+	return nil
+}
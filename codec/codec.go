@@ -0,0 +1,679 @@
+// Package codec converts data to and from text made of Chinese characters.
+// Base64 text, or raw bytes, is split into pairs of characters, and each
+// pair is replaced by the dictionary character mapped to it. The sinogram
+// command is a thin wrapper around this package.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+const (
+	StdinPath     = "@-" // Input path that reads from standard input
+	StdinDict     = "-"  // Dictionary path that reads from standard input
+	StdoutPath    = "-"  // Output path that writes to standard output
+	Base64Charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	MinDictChars  = 256      // Minimum characters for basic functionality
+	MaxPairs      = 4096     // 64 * 64 possible base64 pairs
+	maxLineLength = 16 << 20 // Longest line -line-mode accepts
+)
+
+// FormatVersion is the version of the header format Encode writes, and the
+// newest Decode reads. Text written in any earlier version stays decodable.
+//
+// Version 1 decoders skip header fields they do not know, so a field that
+// changes how the body decodes would be silently ignored by them. Version
+// 2 decoders refuse unknown fields instead, apart from informational ones
+// whose keys start with "x-".
+const FormatVersion = 2
+
+// ErrNoDictionary is returned by Decode when neither a loaded nor an
+// embedded dictionary is available
+var ErrNoDictionary = errors.New("no dictionary loaded")
+
+// ErrChecksumMismatch is returned when decoded data does not match the
+// SHA-256 recorded in the header, typically because of a wrong dictionary
+var ErrChecksumMismatch = errors.New("decoded data does not match the recorded checksum")
+
+// ErrUnmappedPair is returned by Encode under UnmappedError when a pair
+// has no dictionary character
+var ErrUnmappedPair = errors.New("pairs not in dictionary")
+
+// ErrBadLengthPrefix is returned when a framed body does not start with a
+// valid varint length
+var ErrBadLengthPrefix = errors.New("invalid length prefix")
+
+// ErrMalformedBase64 is returned by Decode when the base64 reconstructed
+// from the input is structurally wrong, e.g. because of stray characters
+// or a truncated file
+var ErrMalformedBase64 = errors.New("malformed base64")
+
+// ErrBadSpacing is returned by Decode when the separators of spaced input
+// are not where its header says they were inserted
+var ErrBadSpacing = errors.New("spacing does not match the header")
+
+// ErrNotPure is returned by Encode under Pure when the encoded body has a
+// character that is not in the dictionary
+var ErrNotPure = errors.New("output is not pure")
+
+// ErrDictionaryTooSmall is returned, wrapped in a DictionaryError, when a
+// dictionary has fewer than MinDictChars distinct characters of the
+// codec's alphabet
+var ErrDictionaryTooSmall = errors.New("insufficient dictionary characters")
+
+// ErrFrozen is returned when a dictionary is loaded into a frozen codec
+var ErrFrozen = errors.New("codec is frozen")
+
+// ErrUnsupportedFormat is returned for encoded text whose header is of a
+// newer format version, or has fields, that this package cannot decode
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+// ErrVerifyFailed is returned when Verify finds that the encoded output
+// does not decode back to the input
+var ErrVerifyFailed = errors.New("round-trip verification failed")
+
+// DictionaryError is returned by LoadDictionary when the dictionary cannot
+// be read or yields no usable mapping
+type DictionaryError struct {
+	Err error
+}
+
+func (e *DictionaryError) Error() string { return e.Err.Error() }
+
+func (e *DictionaryError) Unwrap() error { return e.Err }
+
+// InvalidCharacterError is returned by Decode when a character of the
+// encoded text cannot be decoded. Pos counts characters from 1 across the
+// whole input, including streamed input. Err, if set, is the kind of
+// failure, such as ErrMalformedBase64.
+type InvalidCharacterError struct {
+	Pos    int64
+	Char   rune
+	Reason string
+	Err    error
+}
+
+func (e *InvalidCharacterError) Error() string {
+	at := fmt.Sprintf("character %d (%q): %s", e.Pos, e.Char, e.Reason)
+	if e.Err == nil {
+		return "invalid " + at
+	}
+	return e.Err.Error() + " at " + at
+}
+
+func (e *InvalidCharacterError) Unwrap() error { return e.Err }
+
+// Encoding modes, as named in SINOGRAM_MODE and output metadata
+const (
+	ModeBase64 = "base64"
+	ModeRaw    = "raw"
+)
+
+// Markers around each encoded run in passthrough output. Neither is ASCII
+// nor a dictionary character, so they cannot be confused with either.
+const (
+	escapeOpen  = "«"
+	escapeClose = "»"
+)
+
+// Script variants -normalize-output can show mapped characters in
+const (
+	VariantSimplified  = "simplified"
+	VariantTraditional = "traditional"
+)
+
+// Dictionary modes: how LoadDictionary assigns a file's characters to pairs
+const (
+	DictSorted  = "sorted"  // By code point, so only the set of characters matters
+	DictOrdered = "ordered" // In file order, so the file spells out the mapping
+)
+
+// Unmapped-pair policies: what Encode does with a pair that has no
+// dictionary character
+const (
+	UnmappedPassthrough = "passthrough" // Keep the pair as-is; decoding is unaffected
+	UnmappedError       = "error"       // Fail the encode
+	UnmappedPlaceholder = "placeholder" // Write Placeholder, which Decode rejects
+)
+
+// DefaultPlaceholder marks dropped pairs unless configured otherwise
+const DefaultPlaceholder = '\uFFFD'
+
+// DefaultSpaceChar separates groups of characters under Space unless
+// configured otherwise: a thin space
+const DefaultSpaceChar = '\u2009'
+
+// Base64 variants for the text that is split into pairs
+const (
+	B64Std  = "std"  // One unbroken line
+	B64MIME = "mime" // CRLF line breaks every mimeLineLength characters
+)
+
+// mimeLineLength is the longest base64 line MIME allows (RFC 2045)
+const mimeLineLength = 76
+
+// Output formats for encoded text
+const (
+	FormatText = "text"
+	FormatHTML = "html"
+)
+
+// Codec handles encoding/decoding between base64 pairs and Chinese characters
+type Codec struct {
+	mapper Mapper
+	mapped int // Pairs mapper has a character for, counted by setMapper
+
+	// Format selects how Encode wraps its output (FormatText or FormatHTML)
+	Format string
+
+	// DictMode selects how LoadDictionary orders characters (DictSorted or DictOrdered)
+	DictMode string
+
+	// Alphabet names the registered Alphabet LoadDictionary takes mapping
+	// characters from; "" means DefaultAlphabet
+	Alphabet string
+
+	// Verbose logs per-phase timings and other details
+	Verbose bool
+
+	// EmbedDict writes the mapping into a header so decoding needs no dictionary
+	EmbedDict bool
+
+	// Trim strips copy-paste wrapping (quotes, code fences, labels) before decoding
+	Trim bool
+
+	// CacheDir is where LoadDictionary caches the mapping built from a
+	// dictionary, to reuse for identical content. Empty, the default,
+	// disables the cache.
+	CacheDir string
+
+	// StrictDict refuses a dictionary whose mapping is not one-to-one
+	// instead of only warning about it
+	StrictDict bool
+
+	// Profile names the dictionary profile in use; it is recorded in the
+	// output header and decoding refuses input from a different profile
+	Profile string
+
+	// MaxMemory makes Encode and Decode process inputs larger than this
+	// many bytes in chunks instead of reading them whole; 0 disables it
+	MaxMemory int64
+
+	// Checksum records the input's SHA-256 in the header, which Decode verifies
+	Checksum bool
+
+	// Verify makes Encode decode its output before committing it and fail
+	// unless the result matches the input, as when unmapped pairs or raw
+	// mode collisions make the encode lossy
+	Verify bool
+
+	// Preserve records the input file's permissions and modification time
+	// in the header, for Decode to give the decoded file
+	Preserve bool
+
+	// Backup makes Decode move an existing output file aside as ".bak" and
+	// remove it only once the new file is verified against the checksum
+	Backup bool
+
+	// PassthroughASCII makes base64-mode Encode keep the input's ASCII bytes
+	// as literal text and encode only the runs of other bytes, each wrapped
+	// in escape markers; the header tells Decode to expect this
+	PassthroughASCII bool
+
+	// Frame makes base64-mode Encode prefix the data with its varint-encoded
+	// length, so Decode restores exactly that many bytes whatever follows
+	Frame bool
+
+	// B64Variant selects the base64 form Encode maps in base64 mode (B64Std
+	// or B64MIME). Decoding accepts either, as the line breaks are skipped.
+	B64Variant string
+
+	// UnmappedPolicy selects how Encode handles pairs with no dictionary
+	// character (UnmappedPassthrough, UnmappedError or UnmappedPlaceholder)
+	UnmappedPolicy string
+
+	// Placeholder is written for unmapped pairs under UnmappedPlaceholder
+	// and recorded in the header. Decode refuses input containing it, since
+	// the pair it stands for is lost.
+	Placeholder rune
+
+	// AssumeUTF8 makes raw-mode Encode refuse input that is not valid UTF-8,
+	// and warn about input characters that are also dictionary characters,
+	// since decoding would turn them into pairs
+	AssumeUTF8 bool
+
+	// Limit makes Encode encode only the first Limit input bytes when the
+	// input is longer, as a preview; the header records the truncation and
+	// Decode warns about it. 0 encodes everything.
+	Limit int64
+
+	// Stats describes the most recent successful encode. A frozen codec
+	// leaves it unchanged, since concurrent encodes would race on it.
+	Stats EncodeStats
+
+	// pairCounts tallies pair usage by pair index while an encode runs
+	pairCounts []int
+
+	frozen bool // Set by Freeze
+
+	// Recover makes base64-mode Decode salvage damaged input instead of
+	// failing: regions that cannot be decoded are replaced with a marker
+	// and reported, and decoding continues after them. It needs the whole
+	// input, so it does not apply when streaming.
+	Recover bool
+
+	// Pure makes Encode fail unless every character of the encoded body is
+	// a dictionary character (the header line is not part of the body).
+	// In base64 mode it implies Align3, so the body has no '=' padding.
+	Pure bool
+
+	// Align3 makes base64-mode Encode pad the data with zero bytes to a
+	// multiple of 3, so the base64 has no '=' padding; the header records
+	// the length before padding, to which Decode cuts the output
+	Align3 bool
+
+	// Prefer lists characters LoadDictionary maps ahead of the rest when the
+	// dictionary has more than the 4096 the mapping uses, in order of
+	// preference. Decoding must use the same list.
+	Prefer []rune
+
+	// Variants maps dictionary characters to the variant forms, such as
+	// traditional for simplified, that LoadDictionary maps in their place.
+	// A variant that is itself a dictionary character, or that two
+	// characters share, is not used, so the mapping stays one-to-one.
+	// Decoding must use the same variants.
+	Variants map[rune]rune
+
+	// Space makes Encode insert SpaceChar after every Space characters of
+	// the body for readability; the header records both, and Decode
+	// removes exactly the separators at those positions. 0 disables it.
+	Space     int
+	SpaceChar rune
+
+	// Metrics, if set, is told about encodes, decodes and unmapped pairs
+	Metrics Metrics
+
+	// Progress, if set, is called as Encode and Decode read their input
+	// file, with the bytes read so far and the file's size, or -1 when the
+	// size is unknown, as for standard input. A streamed input is read as
+	// the job goes; an input read whole is then still to be converted.
+	Progress func(done, total int64)
+
+	// Salt makes base64-mode Encode put this many random bytes before the
+	// data, so identical inputs encode differently; the header records the
+	// count and Decode discards them
+	Salt int
+
+	// Plugin is a command, with its arguments, that transforms the data
+	// before Encode and after Decode, e.g. to compress or encrypt it (see
+	// WithPlugin). The header records its name, and such text cannot be
+	// decoded without a plugin.
+	Plugin []string
+
+	// HeaderVersion is the format version of the header lines Encode
+	// writes: 0 for FormatVersion, or 1 for decoders that predate format
+	// 2, which Plugin cannot be used with
+	HeaderVersion int
+
+	// Base64 selects the mode of the calls that take no mode argument,
+	// such as EncodeBytes: base64 when set, as NewCodec does, raw otherwise
+	Base64 bool
+
+	// StrictDecode makes base64-mode Decode refuse text the encoder could
+	// not have written, namely characters that are neither dictionary
+	// characters nor base64, and base64 pairs the dictionary has a
+	// character for. Line breaks are allowed. Without it, such text
+	// decodes as long as the base64 it yields is well formed.
+	StrictDecode bool
+
+	// charset holds the characters given to WithCharset, and mappingErr
+	// why no mapping could be built from them or why the Mapper given to
+	// WithMapper is unusable, which Encode and Decode then return
+	charset    string
+	customMap  bool
+	mappingErr error
+
+	// Logger receives progress messages at info level, such as the
+	// dictionary coverage, and warnings, such as unmapped pairs. NewCodec
+	// starts with one that writes plain lines to stderr; nil discards them.
+	Logger *slog.Logger
+}
+
+// Metrics receives counts from a Codec as it works, so that they can be
+// fed to a monitoring system without the codec depending on one. Methods
+// are called on the goroutine running the operation, so for a frozen codec
+// shared between goroutines they must be safe for concurrent use.
+type Metrics interface {
+	// AddEncoded counts the input bytes of a successful encode
+	AddEncoded(bytes int64)
+
+	// AddDecoded counts the output bytes of a successful decode
+	AddDecoded(bytes int64)
+
+	// AddUnmapped counts pairs an encode found no dictionary character for
+	AddUnmapped(pairs int)
+
+	// DecodeFailed reports a failed decode. Comparing err with errors.Is
+	// or errors.As against the codec's errors tells the kind of failure.
+	DecodeFailed(err error)
+}
+
+// countDecode reports the outcome of a decode to Metrics
+func (c *Codec) countDecode(written int64, err error) {
+	switch {
+	case c.Metrics == nil:
+	case err != nil:
+		c.Metrics.DecodeFailed(err)
+	default:
+		c.Metrics.AddDecoded(written)
+	}
+}
+
+func NewCodec(opts ...Option) *Codec {
+	c := &Codec{
+		Format:     FormatText,
+		DictMode:   DictSorted,
+		B64Variant: B64Std,
+
+		UnmappedPolicy: UnmappedPassthrough,
+		Placeholder:    DefaultPlaceholder,
+		SpaceChar:      DefaultSpaceChar,
+		Base64:         true,
+		Logger:         defaultLogger(),
+	}
+	c.setMapper(NewDictMapper(nil))
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	// Built last so that the options shaping the mapping apply in any order
+	switch {
+	case c.charset != "":
+		c.mappingErr = c.loadDictionary("the charset", []byte(c.charset), "")
+	case c.customMap:
+		c.mappingErr = c.checkMapping()
+	}
+	return c
+}
+
+// Freeze makes the codec's configuration final so that it can be shared:
+// afterwards encoding and decoding only read the codec, and any number of
+// goroutines may use it at once, e.g. the handlers of an HTTP server.
+// Loading a dictionary then fails with ErrFrozen and Stats is no longer
+// updated; the exported fields must not be changed either. Logger, Metrics
+// and a custom Mapper are called concurrently, so they must be safe for
+// that. Freeze fails if the codec has no usable mapping.
+func (c *Codec) Freeze() error {
+	if c.mappingErr != nil {
+		return c.mappingErr
+	}
+	if c.mapped == 0 {
+		return ErrNoDictionary
+	}
+	c.frozen = true
+	c.pairCounts = nil // Left by an encode that failed, and no longer counted
+	return nil
+}
+
+// Frozen reports whether Freeze has been called
+func (c *Codec) Frozen() bool {
+	return c.frozen
+}
+
+// Option configures a Codec created by NewCodec. Options are applied in
+// order after the defaults, so a later option overrides an earlier one.
+type Option func(*Codec)
+
+// WithFormat sets the output wrapping (FormatText or FormatHTML)
+func WithFormat(format string) Option {
+	return func(c *Codec) { c.Format = format }
+}
+
+// WithDictMode sets how the dictionary is ordered (DictSorted or DictOrdered)
+func WithDictMode(mode string) Option {
+	return func(c *Codec) { c.DictMode = mode }
+}
+
+// WithAlphabet sets the registered alphabet mapping characters come from
+func WithAlphabet(name string) Option {
+	return func(c *Codec) { c.Alphabet = name }
+}
+
+// WithVerbose logs per-phase timings and other details
+func WithVerbose(on bool) Option {
+	return func(c *Codec) { c.Verbose = on }
+}
+
+// WithEmbedDict writes the mapping into the output header
+func WithEmbedDict(on bool) Option {
+	return func(c *Codec) { c.EmbedDict = on }
+}
+
+// WithTrim strips copy-paste wrapping before decoding
+func WithTrim(on bool) Option {
+	return func(c *Codec) { c.Trim = on }
+}
+
+// WithRecover makes base64-mode Decode salvage damaged input instead of failing
+func WithRecover(on bool) Option {
+	return func(c *Codec) { c.Recover = on }
+}
+
+// WithAssumeUTF8 makes raw-mode Encode refuse input that is not valid UTF-8
+func WithAssumeUTF8(on bool) Option {
+	return func(c *Codec) { c.AssumeUTF8 = on }
+}
+
+// WithLimit makes Encode encode only the first n input bytes
+func WithLimit(n int64) Option {
+	return func(c *Codec) { c.Limit = n }
+}
+
+// WithStrictDict refuses a dictionary whose mapping is not one-to-one
+func WithStrictDict(on bool) Option {
+	return func(c *Codec) { c.StrictDict = on }
+}
+
+// WithCacheDir caches dictionary mappings in dir (see Codec.CacheDir)
+func WithCacheDir(dir string) Option {
+	return func(c *Codec) { c.CacheDir = dir }
+}
+
+// WithProfile records a dictionary profile name in the header
+func WithProfile(name string) Option {
+	return func(c *Codec) { c.Profile = name }
+}
+
+// WithMaxMemory processes inputs larger than n bytes in chunks
+func WithMaxMemory(n int64) Option {
+	return func(c *Codec) { c.MaxMemory = n }
+}
+
+// WithChecksum records the input's SHA-256 in the header
+func WithChecksum(on bool) Option {
+	return func(c *Codec) { c.Checksum = on }
+}
+
+// WithPreserve records the input file's permissions and modification time
+// for Decode to restore
+func WithPreserve(on bool) Option {
+	return func(c *Codec) { c.Preserve = on }
+}
+
+// WithVerify makes Encode check that its output decodes back to the input
+func WithVerify(on bool) Option {
+	return func(c *Codec) { c.Verify = on }
+}
+
+// WithBackup keeps an existing decode output as ".bak" until the new one is verified
+func WithBackup(on bool) Option {
+	return func(c *Codec) { c.Backup = on }
+}
+
+// WithPassthroughASCII keeps ASCII bytes as literal text in base64 mode
+func WithPassthroughASCII(on bool) Option {
+	return func(c *Codec) { c.PassthroughASCII = on }
+}
+
+// WithFrame prefixes base64-mode data with its length
+func WithFrame(on bool) Option {
+	return func(c *Codec) { c.Frame = on }
+}
+
+// WithSalt puts n random bytes before the base64-mode data
+func WithSalt(n int) Option {
+	return func(c *Codec) { c.Salt = n }
+}
+
+// WithPlugin runs command, with args, over the data before encoding and
+// after decoding. It is started once per encode or decode with "encode" or
+// "decode" appended to args, reads the data from stdin and writes the
+// transformed data to stdout; a non-zero exit status fails the call with
+// the last line of its stderr.
+func WithPlugin(command string, args ...string) Option {
+	return func(c *Codec) { c.Plugin = append([]string{command}, args...) }
+}
+
+// WithProgress reports the reading of input files to report
+func WithProgress(report func(done, total int64)) Option {
+	return func(c *Codec) { c.Progress = report }
+}
+
+// WithHeaderVersion sets the format version of the header lines written
+func WithHeaderVersion(v int) Option {
+	return func(c *Codec) { c.HeaderVersion = v }
+}
+
+// WithAlign3 pads base64-mode data to a multiple of 3 bytes
+func WithAlign3(on bool) Option {
+	return func(c *Codec) { c.Align3 = on }
+}
+
+// WithPure makes Encode fail unless the body is all dictionary characters;
+// in base64 mode it implies Align3
+func WithPure(on bool) Option {
+	return func(c *Codec) { c.Pure = on }
+}
+
+// WithB64Variant sets the base64 form used in base64 mode (B64Std or B64MIME)
+func WithB64Variant(variant string) Option {
+	return func(c *Codec) { c.B64Variant = variant }
+}
+
+// WithUnmappedPolicy sets how Encode handles pairs with no dictionary
+// character. A UnmappedPlaceholder policy writes placeholder for them;
+// the other policies ignore it.
+func WithUnmappedPolicy(policy string, placeholder rune) Option {
+	return func(c *Codec) {
+		c.UnmappedPolicy = policy
+		c.Placeholder = placeholder
+	}
+}
+
+// WithSpace inserts sep after every n encoded characters; 0 disables it
+func WithSpace(n int, sep rune) Option {
+	return func(c *Codec) {
+		c.Space = n
+		c.SpaceChar = sep
+	}
+}
+
+// WithPrefer maps the listed characters ahead of the rest of a large dictionary
+func WithPrefer(chars []rune) Option {
+	return func(c *Codec) { c.Prefer = chars }
+}
+
+// WithVariants maps the given variant forms in place of dictionary characters
+func WithVariants(variants map[rune]rune) Option {
+	return func(c *Codec) { c.Variants = variants }
+}
+
+// WithBase64 selects base64 (true) or raw (false) mode for the calls that
+// take no mode argument
+func WithBase64(on bool) Option {
+	return func(c *Codec) { c.Base64 = on }
+}
+
+// WithStrictDecode refuses encoded text the encoder could not have written
+func WithStrictDecode(on bool) Option {
+	return func(c *Codec) { c.StrictDecode = on }
+}
+
+// WithCharset builds the mapping from the Chinese characters of chars, as
+// LoadDictionary does from a file, so no dictionary file is needed. If
+// they yield no usable mapping, Encode and Decode return the reason.
+func WithCharset(chars string) Option {
+	return func(c *Codec) { c.charset = chars }
+}
+
+// WithMapper uses m to assign characters to pairs instead of a dictionary.
+// Embedded dictionaries (WithEmbedDict) list the characters in pair order,
+// so they only describe mappers that, like DictMapper, fill the pairs in
+// order without gaps. A mapping that is not one-to-one is reported as
+// LoadDictionary does, as an error from Encode and Decode under
+// WithStrictDict.
+func WithMapper(m Mapper) Option {
+	return func(c *Codec) {
+		c.setMapper(m)
+		c.customMap = true
+	}
+}
+
+// WithLogger sends progress messages and warnings to l; nil discards them
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Codec) { c.Logger = l }
+}
+
+// WithLog sends progress messages and warnings to w as plain lines, like
+// the default logger does to stderr
+func WithLog(w io.Writer) Option {
+	return WithLogger(slog.New(NewLineHandler(w, nil)))
+}
+
+// WithMetrics reports encode and decode counts to m
+func WithMetrics(m Metrics) Option {
+	return func(c *Codec) { c.Metrics = m }
+}
+
+// EncodeStats describes an encode
+type EncodeStats struct {
+	InputSize  int64
+	OutputSize int64 // Encoded text, before any output format wrapping
+
+	// PairUsage counts how often each pair was written as its dictionary
+	// character; unmapped and padding pairs are not counted
+	PairUsage map[string]int
+}
+
+// EncodeResult describes a finished encode, for callers to report or log
+type EncodeResult struct {
+	InputBytes  int64 // Bytes encoded; with a Limit, only those of the preview
+	OutputBytes int64 // Bytes written, including any output format wrapping
+
+	// UnmappedPairs counts the pairs that had no dictionary character and
+	// were written as-is or as the placeholder
+	UnmappedPairs int
+
+	// Coverage is the percentage of the input's pairs written as
+	// dictionary characters; padding is not counted. An input without
+	// pairs has full coverage.
+	Coverage float64
+}
+
+// newEncodeResult builds the result of an encode from its sizes and tally
+func newEncodeResult(inputBytes, outputBytes int64, tally pairTally) EncodeResult {
+	coverage := 100.0
+	if tally.pairs > 0 {
+		coverage = float64(tally.mapped) / float64(tally.pairs) * 100
+	}
+	return EncodeResult{InputBytes: inputBytes, OutputBytes: outputBytes, UnmappedPairs: tally.unmapped, Coverage: coverage}
+}
+
+// DecodeResult describes a finished decode
+type DecodeResult struct {
+	InputBytes  int64 // Bytes of encoded text read
+	OutputBytes int64 // Decoded bytes written
+}
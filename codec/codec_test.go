@@ -0,0 +1,144 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Dictionaries shipped at the repository root
+const (
+	fullDict    = "../dictionary_4096.md"
+	partialDict = "../dictionary_2035.md"
+)
+
+// newTestCodec returns a codec with opts and the dictionary at path loaded
+func newTestCodec(t testing.TB, path string, opts ...Option) *Codec {
+	t.Helper()
+	c := NewCodec(opts...)
+	if err := c.LoadDictionary(path); err != nil {
+		t.Fatalf("LoadDictionary(%s): %v", path, err)
+	}
+	return c
+}
+
+// A failed encode must not leave pair counting behind for Freeze's
+// concurrent users; run with -race
+func TestFreezeAfterFailedEncode(t *testing.T) {
+	c := newTestCodec(t, partialDict, WithUnmappedPolicy(UnmappedError, 0))
+	data := make([]byte, 3000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if _, err := c.EncodeString(string(data), true); !errors.Is(err, ErrUnmappedPair) {
+		t.Fatalf("EncodeString with a partial dictionary: got %v, want ErrUnmappedPair", err)
+	}
+	if err := c.Freeze(); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				c.EncodeString(string(data), true)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Every mode and option round-trips every input length residue, both
+// buffered and streamed under MaxMemory; a preview gives back the start
+// of the input
+func TestRoundTripMatrix(t *testing.T) {
+	options := []struct {
+		name     string
+		opts     []Option
+		buffered bool  // Refused when streaming
+		limit    int64 // Bytes a preview keeps, 0 for all
+	}{
+		{"plain", nil, false, 0},
+		{"frame", []Option{WithFrame(true)}, false, 0},
+		{"align3", []Option{WithAlign3(true)}, false, 0},
+		{"salt", []Option{WithSalt(8)}, false, 0},
+		{"checksum", []Option{WithChecksum(true)}, false, 0},
+		{"embed-dict", []Option{WithEmbedDict(true)}, false, 0},
+		{"b64-std", []Option{WithB64Variant(B64Std)}, false, 0},
+		{"b64-mime", []Option{WithB64Variant(B64MIME)}, false, 0},
+		{"frame+align3+checksum", []Option{WithFrame(true), WithAlign3(true), WithChecksum(true)}, false, 0},
+		{"passthrough-ascii", []Option{WithPassthroughASCII(true)}, true, 0},
+		{"passthrough+checksum+space", []Option{WithPassthroughASCII(true), WithChecksum(true), WithSpace(5, '\u2009')}, true, 0},
+		{"placeholder", []Option{WithUnmappedPolicy(UnmappedPlaceholder, DefaultPlaceholder)}, false, 0},
+		{"space", []Option{WithSpace(5, '\u2009')}, false, 0},
+		{"space+frame+salt", []Option{WithSpace(7, '\u2009'), WithFrame(true), WithSalt(4)}, false, 0},
+		{"limit", []Option{WithLimit(100)}, false, 100},
+		{"limit+checksum", []Option{WithLimit(5), WithChecksum(true)}, false, 5},
+	}
+	modes := []struct {
+		name   string
+		base64 bool
+	}{{"raw", false}, {"base64", true}}
+	memory := []struct {
+		name string
+		max  int64
+	}{{"buffered", 0}, {"streamed", 64}}
+	var lengths []int
+	for n := range 7 {
+		lengths = append(lengths, n, 4096+n)
+	}
+
+	dir := t.TempDir()
+	for _, mode := range modes {
+		for _, opt := range options {
+			if opt.name == "align3" && !mode.base64 {
+				continue // Refused outside base64 mode by the CLI
+			}
+			for _, mem := range memory {
+				if opt.buffered && mem.max > 0 && mode.base64 {
+					continue
+				}
+				opts := append([]Option{WithLogger(nil), WithMaxMemory(mem.max)}, opt.opts...)
+				c := newTestCodec(t, fullDict, opts...)
+				for _, n := range lengths {
+					name := fmt.Sprintf("%s/%s/%s/%d", mode.name, opt.name, mem.name, n)
+					data := make([]byte, n)
+					for i := range data {
+						data[i] = byte(i*131 + n)
+					}
+					input := filepath.Join(dir, "input")
+					encoded := filepath.Join(dir, "encoded")
+					decoded := filepath.Join(dir, "decoded")
+					if err := os.WriteFile(input, data, 0644); err != nil {
+						t.Fatal(err)
+					}
+					if _, err := c.Encode(input, encoded, mode.base64); err != nil {
+						t.Errorf("%s: Encode: %v", name, err)
+						continue
+					}
+					if _, err := c.Decode(encoded, decoded, mode.base64); err != nil {
+						t.Errorf("%s: Decode: %v", name, err)
+						continue
+					}
+					got, err := os.ReadFile(decoded)
+					if err != nil {
+						t.Fatal(err)
+					}
+					want := data
+					if opt.limit > 0 {
+						want = data[:min(int64(n), opt.limit)]
+					}
+					if !bytes.Equal(got, want) {
+						t.Errorf("%s: round trip gave %d bytes, want %d", name, len(got), len(want))
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// connChunkSize is the most data one line of a wrapped connection carries;
+// a multiple of 3 so that only the last line of a Write has padding
+const connChunkSize = 48 << 10
+
+// encodedConn is the net.Conn returned by WrapConn
+type encodedConn struct {
+	net.Conn
+	c   *Codec
+	err error // Why the codec cannot encode lines, returned by every Read and Write
+
+	writeMu sync.Mutex
+
+	readMu  sync.Mutex
+	r       *bufio.Reader
+	pending []byte // Decoded data not yet returned by Read
+}
+
+// WrapConn returns a connection that tunnels bytes over conn as text: each
+// Write is sent as lines of encoded text in base64 mode, and the lines
+// read from conn are decoded, so the peer must wrap its end with the same
+// dictionary. The text is plain enough to pass through text-only relays,
+// which may also turn line endings into CRLF. Settings that need a header
+// line or break lines, as in line mode, make every Read and Write fail.
+// Deadlines, Close and the addresses are those of conn.
+func WrapConn(conn net.Conn, c *Codec) net.Conn {
+	q := c.quiet()
+	q.frozen = true // Writes may run concurrently, and the copy is never reconfigured
+
+	ec := &encodedConn{Conn: conn, c: q, r: bufio.NewReader(conn)}
+	if err := q.checkLineMode(true); err != nil {
+		ec.err = fmt.Errorf("cannot tunnel a connection: %w", err)
+	}
+	return ec
+}
+
+// Write encodes p and sends it as one or more lines
+func (ec *encodedConn) Write(p []byte) (int, error) {
+	if ec.err != nil {
+		return 0, ec.err
+	}
+
+	var buf bytes.Buffer
+	for data := p; len(data) > 0; {
+		chunk := data[:min(len(data), connChunkSize)]
+		data = data[len(chunk):]
+
+		line, err := ec.c.encodeWithHeader(chunk, true)
+		if err != nil {
+			return 0, err
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+
+	// Whole lines in one write, so concurrent Writes do not interleave
+	ec.writeMu.Lock()
+	defer ec.writeMu.Unlock()
+	if _, err := ec.Conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read returns data decoded from the lines received so far, waiting for
+// the next line when none is left
+func (ec *encodedConn) Read(p []byte) (int, error) {
+	if ec.err != nil {
+		return 0, ec.err
+	}
+
+	ec.readMu.Lock()
+	defer ec.readMu.Unlock()
+	for len(ec.pending) == 0 {
+		line, err := ec.readLine()
+		if err != nil {
+			return 0, err
+		}
+		if ec.pending, _, err = ec.c.decodeWithHeader(string(line), true); err != nil {
+			return 0, fmt.Errorf("failed to decode received text: %w", err)
+		}
+	}
+
+	n := copy(p, ec.pending)
+	ec.pending = ec.pending[n:]
+	return n, nil
+}
+
+// readLine reads the next line without its line ending. The data of a
+// connection that closes mid-line is not returned.
+func (ec *encodedConn) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		part, err := ec.r.ReadSlice('\n')
+		line = append(line, part...)
+		if len(line) > maxLineLength {
+			return nil, fmt.Errorf("received a line longer than %d bytes", maxLineLength)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(line, "\r\n"), nil
+	}
+}
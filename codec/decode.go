@@ -0,0 +1,1096 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Decode converts Chinese character representation back to original data
+// and returns the sizes of the decode. Permissions and a modification time
+// recorded in the header are given to the output file.
+func (c *Codec) Decode(inputPath, outputPath string, useBase64 bool) (DecodeResult, error) {
+	if !c.Backup || outputPath == StdoutPath {
+		result, header, err := c.decodeFile(inputPath, outputPath, useBase64)
+		if err != nil {
+			return result, err
+		}
+		return result, c.restoreMetadata(outputPath, header)
+	}
+
+	backupPath, err := backupExisting(outputPath)
+	if err != nil {
+		return DecodeResult{}, err
+	}
+
+	result, header, err := c.decodeFile(inputPath, outputPath, useBase64)
+	if backupPath == "" {
+		if err != nil {
+			return result, err
+		}
+		return result, c.restoreMetadata(outputPath, header)
+	}
+	if err != nil {
+		return DecodeResult{}, c.restoreBackup(outputPath, backupPath, err)
+	}
+	if err := c.finishBackup(outputPath, backupPath, header); err != nil {
+		return DecodeResult{}, err
+	}
+	return result, c.restoreMetadata(outputPath, header)
+}
+
+// restoreMetadata gives the decoded file at path the permissions and
+// modification time recorded in header, if any. Standard output and
+// devices are left alone.
+func (c *Codec) restoreMetadata(path string, header *Header) error {
+	if header == nil || (header.Perm == 0 && header.ModTime.IsZero()) || path == StdoutPath {
+		return nil
+	}
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+
+	if header.Perm != 0 {
+		if err := os.Chmod(path, header.Perm); err != nil {
+			return fmt.Errorf("failed to restore permissions: %w", err)
+		}
+		c.logf("Permissions restored: %v", header.Perm)
+	}
+	if !header.ModTime.IsZero() {
+		// A zero access time is left unchanged
+		if err := os.Chtimes(path, time.Time{}, header.ModTime); err != nil {
+			return fmt.Errorf("failed to restore modification time: %w", err)
+		}
+		c.logf("Modification time restored: %s", header.ModTime.Local().Format(time.DateTime))
+	}
+	return nil
+}
+
+// decodeFile decodes an input file to an output file, returning the
+// input's header (nil when it has none)
+func (c *Codec) decodeFile(inputPath, outputPath string, useBase64 bool) (DecodeResult, *Header, error) {
+	if c.shouldStream(inputPath) {
+		return c.decodeFileStream(inputPath, outputPath, useBase64)
+	}
+
+	start := time.Now()
+	data, err := c.readInput(inputPath)
+	if err != nil {
+		return DecodeResult{}, nil, fmt.Errorf("failed to read input: %w", err)
+	}
+	c.logTiming("read input", start)
+
+	if c.Verbose {
+		c.logf("Estimated decoded size: %d bytes", c.EstimateDecodedSize(string(data), useBase64))
+	}
+
+	decoded, header, err := c.decodeWithHeader(string(data), useBase64)
+	c.countDecode(int64(len(decoded)), err)
+	if err != nil {
+		return DecodeResult{}, nil, fmt.Errorf("decode failed: %w", err)
+	}
+
+	start = time.Now()
+	if err := writeFileAtomic(outputPath, decoded); err != nil {
+		return DecodeResult{}, nil, err
+	}
+	c.logTiming("write output", start)
+
+	return DecodeResult{InputBytes: int64(len(data)), OutputBytes: int64(len(decoded))}, header, nil
+}
+
+// backupExisting moves an existing output file to "<path>.bak" and returns
+// the backup path, or "" when there was nothing to back up
+func backupExisting(outputPath string) (string, error) {
+	if _, err := os.Stat(outputPath); errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+
+	backupPath := outputPath + ".bak"
+	if _, err := os.Stat(backupPath); err == nil {
+		return "", fmt.Errorf("backup file %s already exists", backupPath)
+	}
+
+	if err := os.Rename(outputPath, backupPath); err != nil {
+		return "", fmt.Errorf("failed to back up output: %w", err)
+	}
+	return backupPath, nil
+}
+
+// restoreBackup puts the backup back in place after a failed decode and
+// returns the decode error
+func (c *Codec) restoreBackup(outputPath, backupPath string, decodeErr error) error {
+	if err := os.Rename(backupPath, outputPath); err != nil {
+		return fmt.Errorf("%w; also failed to restore backup %s: %v", decodeErr, backupPath, err)
+	}
+	c.logf("Original restored from backup: %s", outputPath)
+	return decodeErr
+}
+
+// finishBackup verifies the decoded file on disk against the header
+// checksum: it removes the backup on a match, restores it on a mismatch,
+// and keeps it when no checksum was recorded
+func (c *Codec) finishBackup(outputPath, backupPath string, header *Header) error {
+	if header == nil || header.SHA256 == nil {
+		c.logf("Backup kept: %s (no checksum recorded to verify against)", backupPath)
+		return nil
+	}
+
+	sum, err := fileSHA256(outputPath)
+	if err != nil {
+		return c.restoreBackup(outputPath, backupPath, err)
+	}
+	if !bytes.Equal(sum, header.SHA256) {
+		return c.restoreBackup(outputPath, backupPath, ErrChecksumMismatch)
+	}
+
+	if err := os.Remove(backupPath); err != nil {
+		return fmt.Errorf("failed to remove backup: %w", err)
+	}
+	c.logf("Checksum verified, backup removed: %s", backupPath)
+	return nil
+}
+
+// fileSHA256 hashes a file's contents
+func fileSHA256(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return h.Sum(nil), nil
+}
+
+// EstimateDecodedSize estimates how many bytes encoded text decodes to
+// without decoding it, e.g. for size previews. A header line is skipped and
+// its mode and embedded dictionary honored. The estimate is exact for
+// well-formed input and only approximate otherwise.
+func (c *Codec) EstimateDecodedSize(encoded string, useBase64 bool) int {
+	dc := c
+	salt := 0
+	header, body, err := parseHeader(encoded)
+	if err == nil && header != nil {
+		encoded = body
+		useBase64 = header.Mode != ModeRaw
+		if len(header.Dict) > 0 {
+			dc = c.Remapped(header.Dict)
+		}
+		if header.Space > 0 {
+			encoded = strings.ReplaceAll(encoded, string(header.SpaceChar), "")
+		}
+		if header.Passthrough {
+			return dc.estimatePassthrough(encoded)
+		}
+		salt = header.Salt
+		if header.Frame {
+			if length, ok := dc.framedLength(encoded, salt); ok {
+				return length
+			}
+		}
+		if header.Align3 {
+			return max(int(header.Length)-salt, 0)
+		}
+	}
+
+	if useBase64 {
+		// Whitespace around base64 content is never part of the data
+		encoded = strings.TrimSpace(encoded)
+	}
+
+	size := 0
+	for i := 0; i < len(encoded); {
+		r, width := utf8.DecodeRuneInString(encoded[i:])
+		switch {
+		case dc.isMapped(r):
+			size += 2
+		case useBase64 && isBase64LineBreak(r):
+			// Skipped by the base64 decoder
+		default:
+			size += width
+		}
+		i += width
+	}
+
+	if !useBase64 {
+		return size
+	}
+
+	padding := len(encoded) - len(strings.TrimRight(encoded, "="))
+	return max(size/4*3-min(padding, 2)-salt, 0)
+}
+
+// framedLength reads the length recorded at the start of a framed body,
+// after salt bytes of salt
+func (c *Codec) framedLength(body string, salt int) (int, bool) {
+	// 16 characters hold at least 12 bytes, enough for any varint, and
+	// every 2 more at least the 3 bytes of a salt byte
+	end := 0
+	for n := 0; n < 16+2*salt && end < len(body); n++ {
+		_, size := utf8.DecodeRuneInString(body[end:])
+		end += size
+	}
+
+	base64Text := c.unmapPairs(body[:end])
+	data, err := base64.StdEncoding.DecodeString(string(base64Text[:len(base64Text)/4*4]))
+	if err != nil {
+		return 0, false
+	}
+
+	if len(data) < salt {
+		return 0, false
+	}
+	length, n := binary.Uvarint(data[salt:])
+	return int(length), n > 0
+}
+
+// estimatePassthrough estimates the decoded size of a passthrough body:
+// literal text counts as is and each escaped run as the base64 it holds
+func (c *Codec) estimatePassthrough(encoded string) int {
+	size := 0
+	for {
+		literal, rest, found := strings.Cut(encoded, escapeOpen)
+		size += len(literal)
+		if !found {
+			return size
+		}
+
+		run, rest, _ := strings.Cut(rest, escapeClose)
+		size += c.EstimateDecodedSize(run, true)
+		encoded = rest
+	}
+}
+
+// DecodeString converts in-memory Chinese character representation back
+// to the original content
+func (c *Codec) DecodeString(encoded string, useBase64 bool) (string, error) {
+	decoded, _, err := c.decodeWithHeader(encoded, useBase64)
+	c.countDecode(int64(len(decoded)), err)
+	return string(decoded), err
+}
+
+// DecodeBytes reverses EncodeBytes. Like it, it never touches the
+// filesystem and never logs.
+func (c *Codec) DecodeBytes(encoded string) ([]byte, error) {
+	decoded, _, err := c.quiet().decodeWithHeader(encoded, c.Base64)
+	c.countDecode(int64(len(decoded)), err)
+	return decoded, err
+}
+
+// Transcode re-expresses text encoded with src's dictionary in dst's,
+// translating pair by pair so the original content is never decoded.
+// Headers are carried over, with the profile, embedded dictionary and
+// placeholder replaced by dst's. Pairs dst has no character for follow
+// dst's UnmappedPolicy.
+func Transcode(src, dst *Codec, encoded string, useBase64 bool) (string, error) {
+	if dst.mapped == 0 {
+		return "", ErrNoDictionary
+	}
+	if err := dst.checkHeaderVersion(); err != nil {
+		return "", err
+	}
+	if err := dst.checkPlaceholderChar(); err != nil {
+		return "", err
+	}
+
+	segments, err := SplitSegments(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	var result strings.Builder
+	var tally pairTally
+
+	for i, seg := range segments {
+		sc, b64, err := src.forHeader(seg.Header, useBase64)
+		if err != nil {
+			return "", segmentError(i+1, err)
+		}
+		if err := sc.checkPlaceholder(seg.Body, 0); err != nil {
+			return "", segmentError(i+1, err)
+		}
+		if seg.Header != nil && seg.Header.Plugin != "" && dst.HeaderVersion == 1 {
+			return "", segmentError(i+1, fmt.Errorf("plugin output needs header version 2"))
+		}
+
+		if header := dst.transcodeHeader(seg.Header, b64); header != nil {
+			result.WriteString(header.String())
+		}
+
+		text := seg.Body
+		if seg.Header != nil && seg.Header.Space > 0 {
+			if text, err = removeSpaces(text, seg.Header.Space, seg.Header.SpaceChar, b64 && !sc.passthrough(b64)); err != nil {
+				return "", segmentError(i+1, err)
+			}
+		}
+
+		var body strings.Builder
+		if !sc.passthrough(b64) {
+			tally.add(dst.mapPairs(&body, string(sc.unmapPairs(text))))
+		} else {
+			// Only the escaped runs of a passthrough body are pairs
+			for {
+				literal, rest, found := strings.Cut(text, escapeOpen)
+				body.WriteString(literal)
+				if !found {
+					break
+				}
+
+				run, rest, found := strings.Cut(rest, escapeClose)
+				if !found {
+					return "", segmentError(i+1, fmt.Errorf("unterminated escaped run"))
+				}
+				body.WriteString(escapeOpen)
+				tally.add(dst.mapPairs(&body, string(sc.unmapPairs(run))))
+				body.WriteString(escapeClose)
+				text = rest
+			}
+		}
+
+		spaced := body.String()
+		if dst.Space > 0 {
+			col := 0
+			spaced = insertSpaces(spaced, dst.Space, dst.SpaceChar, &col)
+		}
+		result.WriteString(spaced)
+	}
+
+	if err := dst.finishEncode(tally, false); err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+// transcodeHeader returns the header Transcode writes for a segment read
+// with header, or nil when none is needed
+func (c *Codec) transcodeHeader(header *Header, useBase64 bool) *Header {
+	var h Header
+	if header != nil {
+		h = *header
+	}
+
+	h.Version = c.HeaderVersion
+	h.Mode = ModeRaw
+	if useBase64 {
+		h.Mode = ModeBase64
+	}
+	h.Profile = c.Profile
+	h.Dict = nil
+	if c.EmbedDict {
+		h.Dict = c.mappingRunes()
+	}
+	h.Placeholder = 0
+	if c.UnmappedPolicy == UnmappedPlaceholder {
+		h.Placeholder = c.Placeholder
+	}
+	h.Space, h.SpaceChar = c.Space, 0
+	if c.Space > 0 {
+		h.SpaceChar = c.SpaceChar
+	}
+
+	if header == nil && h.Profile == "" && h.Dict == nil && h.Placeholder == 0 && h.Space == 0 {
+		return nil
+	}
+	return &h
+}
+
+// decodeWithHeader decodes text, honoring a leading header line if present:
+// its mode overrides useBase64, an embedded dictionary replaces the loaded
+// one and a recorded checksum is verified.
+//
+// Text that starts with a header may hold several appended segments, each
+// with its own header; they are decoded in turn and concatenated. The
+// returned header describes the whole output: the segment's own header for
+// a single segment, otherwise one whose checksum covers the concatenation
+// when every segment was verified.
+func (c *Codec) decodeWithHeader(text string, useBase64 bool) ([]byte, *Header, error) {
+	if c.Trim {
+		text = trimWrapping(text)
+	}
+
+	segments, err := SplitSegments(text)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var decoded []byte
+	headers := make([]*Header, len(segments))
+
+	for i, seg := range segments {
+		part, err := c.decodeSegment(seg.Header, seg.Body, useBase64)
+		if err != nil {
+			return nil, nil, segmentError(i+1, err)
+		}
+
+		decoded = append(decoded, part...)
+		headers[i] = seg.Header
+	}
+
+	if len(headers) == 1 {
+		return decoded, headers[0], nil
+	}
+
+	c.logf("Decoded %d segments", len(headers))
+	sum := sha256.Sum256(decoded)
+	return decoded, combinedHeader(headers, sum[:]), nil
+}
+
+// Segment is one header-delimited part of encoded text
+type Segment struct {
+	Header *Header // nil for legacy text without a header
+	Body   string
+}
+
+// SplitSegments splits text into its segments. Text without a leading
+// header is a single segment.
+func SplitSegments(text string) ([]Segment, error) {
+	var segments []Segment
+
+	for {
+		header, body, err := parseHeader(text)
+		if err != nil {
+			return nil, segmentError(len(segments)+1, err)
+		}
+
+		// A header-framed body ends where the next segment's header begins
+		text = ""
+		if header != nil {
+			if next := indexHeader(body); next >= 0 {
+				body, text = body[:next], body[next:]
+			}
+		}
+
+		segments = append(segments, Segment{Header: header, Body: body})
+		if text == "" {
+			return segments, nil
+		}
+	}
+}
+
+// trimBodyEnd drops the line break ("\n" or "\r\n") that ends a body with
+// literal line breaks (see Codec.literalBreaks), if there is one
+func trimBodyEnd(body string) string {
+	if trimmed, ok := strings.CutSuffix(body, "\n"); ok {
+		return strings.TrimSuffix(trimmed, "\r")
+	}
+	return body
+}
+
+// decodeSegment decodes one segment's body according to its header
+func (c *Codec) decodeSegment(header *Header, body string, useBase64 bool) ([]byte, error) {
+	dc, useBase64, err := c.forHeader(header, useBase64)
+	if err != nil {
+		return nil, err
+	}
+	if dc.literalBreaks(useBase64) {
+		body = trimBodyEnd(body)
+	}
+
+	if header != nil && header.Space > 0 {
+		if dc.Recover {
+			// Damage may have shifted the separators, so drop them all
+			body = strings.ReplaceAll(body, string(header.SpaceChar), "")
+		} else if body, err = removeSpaces(body, header.Space, header.SpaceChar,
+			useBase64 && !dc.passthrough(useBase64)); err != nil {
+			return nil, err
+		}
+	}
+
+	var decoded []byte
+	if dc.Recover && useBase64 && !dc.passthrough(useBase64) {
+		var lost bool
+		if decoded, lost = dc.decodeRecover(body); lost {
+			// Lengths and checksum cannot match damaged data, so only the
+			// salt and length prefix are removed
+			c.warnf("output is incomplete; length and checksum were not verified")
+			if header != nil && header.Salt > 0 {
+				decoded = decoded[min(header.Salt, len(decoded)):]
+			}
+			if header != nil && header.Frame {
+				if _, n := binary.Uvarint(decoded); n > 0 {
+					decoded = decoded[n:]
+				}
+			}
+			return decoded, nil
+		}
+	} else if decoded, err = dc.decodeData(body, useBase64); err != nil {
+		return nil, err
+	}
+
+	if header != nil && header.Align3 {
+		if int64(len(decoded)) < header.Length {
+			return nil, truncatedError(uint64(header.Length), uint64(len(decoded)))
+		}
+		decoded = decoded[:header.Length]
+	}
+
+	if header != nil && header.Salt > 0 {
+		if len(decoded) < header.Salt {
+			return nil, truncatedError(uint64(header.Salt), uint64(len(decoded)))
+		}
+		decoded = decoded[header.Salt:]
+	}
+
+	if header != nil && header.Frame {
+		if decoded, err = unframe(decoded); err != nil {
+			return nil, err
+		}
+	}
+
+	if header != nil && header.SHA256 != nil {
+		sum := sha256.Sum256(decoded)
+		if !bytes.Equal(sum[:], header.SHA256) {
+			return nil, ErrChecksumMismatch
+		}
+	}
+
+	// The checksum covers the plugin's output, so it is checked first
+	if header != nil && header.Plugin != "" {
+		return c.runPlugin(pluginDecode, decoded)
+	}
+	return decoded, nil
+}
+
+// recoverMarker is written in place of each region Recover cannot salvage
+const recoverMarker = "[sinogram: %d bytes lost]"
+
+// decodeRecover decodes a base64-mode body, replacing each region that cannot
+// be decoded with recoverMarker and reporting it. It reports whether anything
+// was lost.
+func (c *Codec) decodeRecover(text string) ([]byte, bool) {
+	// Rebuild the base64 text, noting for each base64 character whether it
+	// is trustworthy and which input character it came from. A foreign
+	// character most likely replaced a mapped one, so it stands for two
+	// untrustworthy base64 characters.
+	var b64 []byte
+	var valid []bool
+	var chars []int
+	add := func(b byte, ok bool, pos int) {
+		b64 = append(b64, b)
+		valid = append(valid, ok)
+		chars = append(chars, pos)
+	}
+
+	// Encoded text is made of whole pairs, so every mapped character starts
+	// at an even offset. When damage leaves an odd count since the last one,
+	// a foreign character must have replaced a single ASCII character:
+	// drop one of its stand-ins, or failing that, distrust the last
+	// character and pad it. This keeps the following quartets aligned.
+	stretch := 0
+	realign := func(pos int) {
+		if len(b64)%2 != 0 {
+			j := len(b64) - 1
+			for j >= stretch && valid[j] {
+				j--
+			}
+			if j >= stretch {
+				b64 = append(b64[:j], b64[j+1:]...)
+				valid = append(valid[:j], valid[j+1:]...)
+				chars = append(chars[:j], chars[j+1:]...)
+			} else {
+				valid[len(valid)-1] = false
+				add('A', false, pos)
+			}
+		}
+	}
+
+	// With every pair mapped, ASCII only appears in the final padding pair,
+	// so any other ASCII is damage like a foreign character
+	fullCoverage := c.mapped == MaxPairs
+	var ascii []byte
+	pos := 0
+	flushASCII := func() {
+		first := pos - len(ascii) + 1
+		foreign := fullCoverage && !bytes.HasSuffix(ascii, []byte("="))
+		for i, b := range ascii {
+			if foreign {
+				add('A', false, first+i)
+				add('A', false, first+i)
+			} else {
+				add(b, true, first+i)
+			}
+		}
+		ascii = ascii[:0]
+	}
+
+	for _, r := range text {
+		if isBase64LineBreak(r) {
+			continue
+		}
+
+		if r == '=' || (r < utf8.RuneSelf && strings.ContainsRune(Base64Charset, r)) {
+			pos++
+			ascii = append(ascii, byte(r))
+			continue
+		}
+
+		flushASCII()
+		pos++
+		if pair, ok := c.mapper.UnmapRune(r); ok {
+			realign(pos - 1)
+			add(pair[0], true, pos)
+			add(pair[1], true, pos)
+			stretch = len(b64)
+		} else {
+			add('A', false, pos)
+			add('A', false, pos)
+		}
+	}
+	flushASCII()
+	realign(pos)
+
+	var decoded []byte
+	var quartet [3]byte
+	lostFrom, lostBytes, lostTotal, recovered, regions := -1, 0, 0, 0, 0
+
+	// endLoss closes the damaged region ending before base64 character end
+	endLoss := func(end int) {
+		if lostFrom < 0 {
+			return
+		}
+		c.warnf("could not recover bytes %d-%d (characters %d-%d)",
+			lostFrom/4*3, lostFrom/4*3+lostBytes-1, chars[lostFrom], chars[end-1])
+		decoded = fmt.Appendf(decoded, recoverMarker, lostBytes)
+		lostTotal += lostBytes
+		regions++
+		lostFrom, lostBytes = -1, 0
+	}
+
+	for i := 0; i < len(b64); i += 4 {
+		end := min(i+4, len(b64))
+		ok := end-i == 4
+		for j := i; j < end; j++ {
+			ok = ok && valid[j]
+		}
+
+		var n int
+		if ok {
+			var err error
+			n, err = base64.StdEncoding.Decode(quartet[:], b64[i:end])
+			ok = err == nil
+		}
+
+		if !ok {
+			if lostFrom < 0 {
+				lostFrom = i
+			}
+			lostBytes += 3
+			continue
+		}
+
+		endLoss(i)
+		decoded = append(decoded, quartet[:n]...)
+		recovered += n
+	}
+	endLoss(len(b64))
+
+	if regions > 0 {
+		c.logf("Recovered %d bytes; about %d bytes lost in %d regions",
+			recovered, lostTotal, regions)
+	}
+	return decoded, regions > 0
+}
+
+// unframe strips the length prefix from a framed body's decoded bytes and
+// cuts them to the recorded length
+func unframe(decoded []byte) ([]byte, error) {
+	length, n := binary.Uvarint(decoded)
+	if n <= 0 {
+		return nil, ErrBadLengthPrefix
+	}
+
+	data := decoded[n:]
+	if uint64(len(data)) < length {
+		return nil, truncatedError(length, uint64(len(data)))
+	}
+	return data[:length], nil
+}
+
+func truncatedError(want, got uint64) error {
+	return fmt.Errorf("input is truncated: expected %d bytes, decoded %d", want, got)
+}
+
+// frameWriter passes on exactly a recorded number of decoded bytes as they
+// are written. Unless it starts out knowing that number, as for an aligned
+// body, it first reads and strips a framed body's length prefix.
+type frameWriter struct {
+	w         io.Writer
+	prefix    []byte // Length prefix bytes collected so far
+	length    uint64
+	written   uint64
+	haveFrame bool // Whether the length prefix is complete
+}
+
+func (f *frameWriter) Write(p []byte) (int, error) {
+	total := len(p)
+
+	for !f.haveFrame && len(p) > 0 {
+		f.prefix = append(f.prefix, p[0])
+		p = p[1:]
+
+		length, n := binary.Uvarint(f.prefix)
+		if n < 0 || (n == 0 && len(f.prefix) >= binary.MaxVarintLen64) {
+			return 0, ErrBadLengthPrefix
+		}
+		f.length, f.haveFrame = length, n > 0
+	}
+
+	// Anything past the recorded length is alignment filler and dropped
+	p = p[:min(uint64(len(p)), f.length-f.written)]
+	if _, err := f.w.Write(p); err != nil {
+		return 0, err
+	}
+	f.written += uint64(len(p))
+	return total, nil
+}
+
+// skipWriter discards the first skip bytes written to it, such as a salt,
+// and passes the rest on to w
+type skipWriter struct {
+	w    io.Writer
+	skip int
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	n := min(s.skip, len(p))
+	s.skip -= n
+	if _, err := s.w.Write(p[n:]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// finish reports whether the whole recorded length was written
+func (f *frameWriter) finish() error {
+	if !f.haveFrame {
+		return ErrBadLengthPrefix
+	}
+	if f.written < f.length {
+		return truncatedError(f.length, f.written)
+	}
+	return nil
+}
+
+// segmentError labels errors from segments after the first with their
+// 1-based segment number
+func segmentError(segment int, err error) error {
+	if segment == 1 {
+		return err
+	}
+	return fmt.Errorf("segment %d: %w", segment, err)
+}
+
+// combinedHeader describes the concatenated output of several segments.
+// It carries sum, the checksum of that output, only when every segment
+// recorded a checksum and so was verified.
+func combinedHeader(headers []*Header, sum []byte) *Header {
+	combined := &Header{Mode: headers[0].Mode, SHA256: sum}
+	for _, h := range headers {
+		if h == nil || h.SHA256 == nil {
+			combined.SHA256 = nil
+		}
+	}
+	return combined
+}
+
+// forHeader resolves the codec and mode to decode a body with, given its
+// (possibly nil) header: the header's mode overrides useBase64 and an
+// embedded dictionary replaces the loaded one
+func (c *Codec) forHeader(header *Header, useBase64 bool) (*Codec, bool, error) {
+	dc := c
+	if header != nil {
+		useBase64 = header.Mode != ModeRaw
+		if len(header.Dict) > 0 {
+			dc = c.Remapped(header.Dict)
+			c.logf("Using embedded dictionary: %d characters", len(header.Dict))
+		} else if header.Profile != "" && header.Profile != c.Profile {
+			return nil, false, fmt.Errorf("input was encoded with profile %q; decode with -profile %s",
+				header.Profile, header.Profile)
+		} else if header.DictMode != "" && header.DictMode != c.DictMode {
+			return nil, false, fmt.Errorf("input was encoded with dictionary mode %q; decode with -dict-mode %s",
+				header.DictMode, header.DictMode)
+		}
+		if header.Plugin != "" && len(c.Plugin) == 0 {
+			return nil, false, fmt.Errorf("input was transformed by plugin %q; decode with -plugin", header.Plugin)
+		}
+	}
+
+	if header != nil && header.Truncated > 0 {
+		c.warnf("input is a preview holding only the first %d bytes of the original", header.Truncated)
+	}
+
+	// A header written under UnmappedPlaceholder names the placeholder to refuse
+	if header != nil && header.Placeholder != 0 {
+		copied := *dc
+		copied.UnmappedPolicy, copied.Placeholder = UnmappedPlaceholder, header.Placeholder
+		if err := copied.checkPlaceholderChar(); err != nil {
+			return nil, false, fmt.Errorf("invalid header placeholder: %w", err)
+		}
+		dc = &copied
+	}
+
+	// Only the header can say that the body keeps ASCII literal
+	if passthrough := header != nil && header.Passthrough; dc.PassthroughASCII != passthrough {
+		copied := *dc
+		copied.PassthroughASCII = passthrough
+		dc = &copied
+	}
+
+	if dc.mappingErr != nil {
+		return nil, false, dc.mappingErr
+	}
+	if dc.mapped == 0 {
+		return nil, false, ErrNoDictionary
+	}
+
+	return dc, useBase64, nil
+}
+
+func (c *Codec) decodeData(text string, useBase64 bool) ([]byte, error) {
+	if err := c.checkPlaceholder(text, 0); err != nil {
+		return nil, err
+	}
+
+	if c.passthrough(useBase64) {
+		return c.decodePassthrough(text)
+	}
+
+	if useBase64 && c.StrictDecode {
+		if err := c.checkStrict(text, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	start := time.Now()
+	base64Text := c.unmapPairs(text)
+	c.logTiming("pair mapping", start)
+
+	if useBase64 {
+		defer c.logTiming("base64 convert", time.Now())
+		return c.decodeBase64(text, base64Text, 0)
+	}
+
+	return base64Text, nil
+}
+
+// checkPlaceholder refuses text holding the placeholder of a lossy encode
+// under UnmappedPlaceholder. Errors count runeOffset characters before
+// text, as in decodeBase64.
+func (c *Codec) checkPlaceholder(text string, runeOffset int64) error {
+	if c.UnmappedPolicy != UnmappedPlaceholder {
+		return nil
+	}
+
+	// Not IndexRune, which takes U+FFFD to match any invalid UTF-8, such
+	// as the bytes raw mode copies through
+	i := strings.Index(text, string(c.Placeholder))
+	if i < 0 {
+		return nil
+	}
+
+	return &InvalidCharacterError{
+		Pos:    runeOffset + int64(utf8.RuneCountInString(text[:i])) + 1,
+		Char:   c.Placeholder,
+		Reason: "placeholder for a pair the encoding dictionary lacked; the data is lost",
+	}
+}
+
+// checkStrict refuses base64-mode text the encoder could not have written:
+// anything but dictionary characters, base64 characters of pairs the
+// dictionary leaves unmapped, padding and line breaks. text must start on
+// a pair boundary. Errors count runeOffset characters before text, as in
+// decodeBase64.
+func (c *Codec) checkStrict(text string, runeOffset int64) error {
+	var pair []byte // Literal base64 characters of the current pair
+	pos := runeOffset
+	for _, r := range text {
+		pos++
+		switch {
+		case isBase64LineBreak(r):
+		case c.isMapped(r):
+			if len(pair) > 0 {
+				return &InvalidCharacterError{pos, r, "dictionary character splits a base64 pair", ErrMalformedBase64}
+			}
+		case r < utf8.RuneSelf && (base64Symbols[r] || r == '='):
+			if pair = append(pair, byte(r)); len(pair) < 2 {
+				continue
+			}
+			if _, ok := c.RuneForPair(string(pair)); ok {
+				return &InvalidCharacterError{pos, r,
+					fmt.Sprintf("pair %s is mapped, so the encoder would not write it as base64", pair), ErrMalformedBase64}
+			}
+			pair = pair[:0]
+		default:
+			return &InvalidCharacterError{pos, r, "character is neither in the dictionary nor base64", ErrMalformedBase64}
+		}
+	}
+	return nil
+}
+
+// decodePassthrough reverses encodePassthrough: literal text is copied and
+// each escaped run decoded
+func (c *Codec) decodePassthrough(text string) ([]byte, error) {
+	defer c.logTiming("pair mapping", time.Now())
+
+	decoded := make([]byte, 0, len(text))
+	var runeOffset int64
+
+	for {
+		literal, rest, found := strings.Cut(text, escapeOpen)
+		decoded = append(decoded, literal...)
+		if !found {
+			return decoded, nil
+		}
+		runeOffset += int64(utf8.RuneCountInString(literal)) + 1
+
+		run, rest, found := strings.Cut(rest, escapeClose)
+		if !found {
+			return nil, fmt.Errorf("unterminated escaped run starting at character %d", runeOffset)
+		}
+
+		part, err := c.decodeBase64(run, c.unmapPairs(run), runeOffset)
+		if err != nil {
+			return nil, err
+		}
+		decoded = append(decoded, part...)
+
+		runeOffset += int64(utf8.RuneCountInString(run)) + 1
+		text = rest
+	}
+}
+
+// unmapPairs converts Chinese characters in text back to their pairs
+func (c *Codec) unmapPairs(text string) []byte {
+	// Every mapped character (3+ bytes) becomes a 2-byte pair and everything
+	// else is copied, so the text length bounds the reconstructed size
+	base64Text := make([]byte, 0, len(text))
+
+	// The dictionary's mapper is called directly so the lookup can be inlined
+	dm, _ := c.mapper.(*DictMapper)
+
+	// Convert Chinese characters back to base64 pairs
+	for i := 0; i < len(text); {
+		r, size := rune(text[i]), 1
+		if r >= utf8.RuneSelf {
+			r, size = utf8.DecodeRuneInString(text[i:])
+		}
+
+		var pair [2]byte
+		var ok bool
+		if dm != nil {
+			pair, ok = dm.UnmapRune(r)
+		} else {
+			pair, ok = c.mapper.UnmapRune(r)
+		}
+		if ok {
+			base64Text = append(base64Text, pair[0], pair[1])
+		} else {
+			// Character not in mapping, keep its original bytes (handles
+			// padding pairs, see IsPaddingPair, and raw-mode bytes that
+			// are not valid UTF-8)
+			base64Text = append(base64Text, text[i:i+size]...)
+		}
+		i += size
+	}
+
+	return base64Text
+}
+
+// decodeBase64 decodes the base64 reconstructed from text. Errors report
+// the offending character's position, counting runeOffset characters
+// before text for inputs processed in pieces.
+func (c *Codec) decodeBase64(text string, base64Text []byte, runeOffset int64) ([]byte, error) {
+	if offset, problem := checkBase64(base64Text); offset >= 0 {
+		pos, r := c.locateRune(text, int64(offset))
+		return nil, &InvalidCharacterError{runeOffset + int64(pos), r, problem, ErrMalformedBase64}
+	}
+
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(base64Text)))
+	n, err := base64.StdEncoding.Decode(decoded, base64Text)
+	if err != nil {
+		var corrupt base64.CorruptInputError
+		if errors.As(err, &corrupt) {
+			pos, r := c.locateRune(text, int64(corrupt))
+			return nil, &InvalidCharacterError{runeOffset + int64(pos), r, err.Error(), ErrMalformedBase64}
+		}
+		return nil, err
+	}
+	return decoded[:n], nil
+}
+
+// base64Symbols marks the bytes of the base64 alphabet
+var base64Symbols = func() (symbols [256]bool) {
+	for i := 0; i < len(Base64Charset); i++ {
+		symbols[Base64Charset[i]] = true
+	}
+	return symbols
+}()
+
+// checkBase64 verifies the structure of reconstructed base64 before it is
+// decoded: only alphabet characters, at most two '=' and only at the end,
+// and whole 4-character groups. Line breaks are skipped, as the decoder
+// skips them. It returns the offset of the first problem and what it is,
+// or -1 if there is none.
+func checkBase64(b []byte) (int, string) {
+	symbols, padding := 0, 0
+	for i, ch := range b {
+		switch {
+		case ch == '\r' || ch == '\n':
+			continue
+		case ch == '=':
+			if padding++; padding > 2 {
+				return i, "more than two '=' padding characters"
+			}
+		case !base64Symbols[ch]:
+			return i, "character is neither in the dictionary nor base64"
+		case padding > 0:
+			return i, "data follows '=' padding"
+		}
+		symbols++
+	}
+
+	if symbols%4 != 0 {
+		return max(len(b)-1, 0), fmt.Sprintf("%d base64 characters do not form whole 4-character groups; is the input truncated or missing a pair?",
+			symbols)
+	}
+	return -1, ""
+}
+
+// locateRune maps a byte offset in the reconstructed base64 stream back to
+// the 1-based character position and rune in the encoded text
+func (c *Codec) locateRune(text string, offset int64) (int, rune) {
+	var consumed int64
+	pos := 0
+	last := utf8.RuneError
+
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		i += size
+		pos++
+		last = r
+		if _, ok := c.mapper.UnmapRune(r); ok {
+			consumed += 2
+		} else {
+			consumed += int64(size)
+		}
+		if consumed > offset {
+			return pos, r
+		}
+	}
+
+	// Offset points past the end (e.g. truncated input): report the last character
+	return pos, last
+}
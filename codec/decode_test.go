@@ -0,0 +1,143 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A newline an editor adds after the output does not change what the file
+// decodes to, in any mode, whether the file is encoded and decoded whole
+// or streamed
+func TestDecodeTrailingNewline(t *testing.T) {
+	binary := "saved in an editor\x00\xff"
+	texts := []string{"no line break", "line\n", "cr\r", "crlf\r\n", "two\n\n", ""}
+	for _, tc := range []struct {
+		name   string
+		base64 bool
+		inputs []string
+		opts   []Option
+	}{
+		{"base64", true, []string{binary}, nil},
+		{"checksum", true, []string{binary}, []Option{WithChecksum(true)}},
+		{"frame", true, []string{binary}, []Option{WithFrame(true)}},
+		{"raw", false, texts, nil},
+		{"raw-checksum", false, texts, []Option{WithChecksum(true)}},
+		{"passthrough", true, texts, []Option{WithPassthroughASCII(true)}},
+	} {
+		for _, stream := range []bool{false, true} {
+			if stream && tc.name == "passthrough" {
+				continue // Passthrough is not available when streaming
+			}
+			var maxMemory int64
+			if stream {
+				maxMemory = 1
+			}
+			c := newTestCodec(t, fullDict, append(tc.opts, WithLogger(nil), WithMaxMemory(maxMemory))...)
+
+			dir := t.TempDir()
+			for _, data := range tc.inputs {
+				input := filepath.Join(dir, "input")
+				encoded := filepath.Join(dir, "input.encoded")
+				output := filepath.Join(dir, "output")
+				if err := os.WriteFile(input, []byte(data), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := c.Encode(input, encoded, tc.base64); err != nil {
+					t.Fatalf("%s: Encode(%q): %v", tc.name, data, err)
+				}
+				text, err := os.ReadFile(encoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, suffix := range []string{"", "\n", "\r\n"} {
+					if suffix != "" && bytes.HasSuffix(text, []byte("\n")) {
+						continue // Editors add a line break only where there is none
+					}
+					name := fmt.Sprintf("%s, streamed %v, input %q, suffix %q", tc.name, stream, data, suffix)
+					if err := os.WriteFile(encoded, append(text, suffix...), 0644); err != nil {
+						t.Fatal(err)
+					}
+					if _, err := c.Decode(encoded, output, tc.base64); err != nil {
+						t.Fatalf("%s: Decode: %v", name, err)
+					}
+					if got, err := os.ReadFile(output); err != nil {
+						t.Fatal(err)
+					} else if string(got) != data {
+						t.Errorf("%s: decoded %q", name, got)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Literal text that looks like a header must not split a passthrough body
+// into segments. Streaming refuses passthrough bodies, so only decoding
+// them whole is at risk.
+func TestPassthroughHeaderMagic(t *testing.T) {
+	c := newTestCodec(t, fullDict, WithLogger(nil), WithPassthroughASCII(true))
+	for _, input := range []string{
+		"notes: SINOGRAM/2 mode=raw\nhello 你好\n",
+		"SINOGRAM/1 x\nSINOGRAM/SINOGRAM/2 \n",
+		"你好SINOGRAM/2 mode=base64",
+	} {
+		encoded, err := c.EncodeString(input, true)
+		if err != nil {
+			t.Fatalf("%q: EncodeString: %v", input, err)
+		}
+		decoded, err := c.DecodeString(encoded, true)
+		if err != nil {
+			t.Fatalf("%q: DecodeString: %v", input, err)
+		}
+		if decoded != input {
+			t.Errorf("%q: round trip gave %q", input, decoded)
+		}
+	}
+}
+
+// Invalid UTF-8 that raw mode copies through is not the default
+// placeholder U+FFFD
+func TestRawBinaryWithPlaceholderPolicy(t *testing.T) {
+	c := newTestCodec(t, fullDict, WithLogger(nil), WithUnmappedPolicy(UnmappedPlaceholder, DefaultPlaceholder))
+	data := "\xff\xfe binary \x80"
+	encoded, err := c.EncodeString(data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := c.DecodeString(encoded, false)
+	if err != nil {
+		t.Fatalf("DecodeString: %v", err)
+	}
+	if decoded != data {
+		t.Errorf("round trip gave %q, want %q", decoded, data)
+	}
+}
+
+// The header records an ordered mapping, so decoding it with the sorted
+// one fails instead of producing other data
+func TestDictModeHeader(t *testing.T) {
+	ordered := newTestCodec(t, partialDict, WithLogger(nil), WithDictMode(DictOrdered))
+	encoded, err := ordered.EncodeString("hello, world", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(encoded, " dictmode=ordered") {
+		t.Errorf("ordered output %q records no dictionary mode", encoded)
+	}
+	if decoded, err := ordered.DecodeString(encoded, true); err != nil || decoded != "hello, world" {
+		t.Errorf("DecodeString = %q, %v", decoded, err)
+	}
+
+	sorted := newTestCodec(t, partialDict, WithLogger(nil))
+	if _, err := sorted.DecodeString(encoded, true); err == nil || !strings.Contains(err.Error(), "-dict-mode ordered") {
+		t.Errorf("sorted codec decoded ordered output, error %v", err)
+	}
+	if encoded, _ := sorted.EncodeString("hello, world", true); isHeaderPrefix(encoded) {
+		t.Errorf("sorted output %q has a header", encoded)
+	}
+}
@@ -0,0 +1,620 @@
+package codec
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// LoadDictionary builds the character mapping from a Chinese text file, or
+// from standard input when filename is "-". With a CacheDir, the mapping
+// of a file is cached there.
+func (c *Codec) LoadDictionary(filename string) error {
+	if c.frozen {
+		return ErrFrozen
+	}
+	if filename == StdinDict {
+		return c.LoadDictionaryFromReader(os.Stdin)
+	}
+
+	defer c.logTiming("dictionary load", time.Now())
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return &DictionaryError{fmt.Errorf("failed to read dictionary: %w", err)}
+	}
+
+	return c.loadDictionary(filename, content, c.mappingCacheKey(content))
+}
+
+// LoadDictionaryFS builds the character mapping from the file name in fsys,
+// such as an embed.FS, so a dictionary can ship inside the program or be
+// read from an archive. The mapping is cached like LoadDictionary's.
+func (c *Codec) LoadDictionaryFS(fsys fs.FS, name string) error {
+	if c.frozen {
+		return ErrFrozen
+	}
+	defer c.logTiming("dictionary load", time.Now())
+
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return &DictionaryError{fmt.Errorf("failed to read dictionary: %w", err)}
+	}
+
+	return c.loadDictionary(name, content, c.mappingCacheKey(content))
+}
+
+// LoadDictionaryFromReader builds the character mapping from Chinese text
+// read from r. The mapping is never cached, so a dictionary that arrives
+// this way is not written to disk.
+func (c *Codec) LoadDictionaryFromReader(r io.Reader) error {
+	if c.frozen {
+		return ErrFrozen
+	}
+	defer c.logTiming("dictionary load", time.Now())
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return &DictionaryError{fmt.Errorf("failed to read dictionary: %w", err)}
+	}
+
+	return c.loadDictionary("the dictionary", content, "")
+}
+
+// loadDictionary builds the mapping from dictionary content, reusing the
+// mapping cached under key unless key is ""
+func (c *Codec) loadDictionary(name string, content []byte, key string) error {
+	a, err := c.alphabet()
+	if err != nil {
+		return &DictionaryError{err}
+	}
+	if c.Verbose && c.Logger != nil {
+		var report strings.Builder
+		newCharsetReport(content, a).Print(&report)
+		c.logLines(report.String())
+	}
+
+	uniqueChars, cached := c.loadCachedMapping(a, key)
+	if !cached {
+		if uniqueChars, err = c.dictionaryChars(a, name, content); err != nil {
+			return &DictionaryError{err}
+		}
+		c.storeCachedMapping(key, uniqueChars)
+	}
+
+	chars, preferred := c.preferChars(uniqueChars)
+	chars, replaced := c.variantChars(chars)
+	c.buildMapping(chars)
+	if err := c.checkMapping(); err != nil {
+		return &DictionaryError{err}
+	}
+	c.printStats(a, len(uniqueChars))
+	if len(c.Prefer) > 0 {
+		c.logf("Preferred: %d of %d mapped characters are from the preference list", preferred, c.mapped)
+	}
+	if len(c.Variants) > 0 {
+		c.logf("Variants: %d of %d mapped characters are shown in variant form", replaced, c.mapped)
+	}
+
+	return nil
+}
+
+// LoadFallbackDictionary fills the pairs the loaded dictionary left
+// unmapped with characters of a second dictionary, in that dictionary's
+// order and skipping characters that are already mapped. Decoding needs
+// the same two dictionaries.
+func (c *Codec) LoadFallbackDictionary(filename string) error {
+	if c.frozen {
+		return ErrFrozen
+	}
+	defer c.logTiming("fallback dictionary load", time.Now())
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return &DictionaryError{fmt.Errorf("failed to read fallback dictionary: %w", err)}
+	}
+
+	a, err := c.alphabet()
+	if err != nil {
+		return &DictionaryError{err}
+	}
+
+	key := c.mappingCacheKey(content)
+	fallback, cached := c.loadCachedMapping(a, key)
+	if !cached {
+		if fallback, err = c.dictionaryChars(a, filename, content); err != nil {
+			return &DictionaryError{err}
+		}
+		c.storeCachedMapping(key, fallback)
+	}
+
+	chars := c.mappingRunes()
+	primary := len(chars)
+	mapped := make(map[rune]bool, len(chars))
+	for _, r := range chars {
+		mapped[r] = true
+	}
+	for _, r := range fallback {
+		if len(chars) == MaxPairs {
+			break
+		}
+		if !mapped[r] {
+			chars = append(chars, r)
+			mapped[r] = true
+		}
+	}
+
+	chars, _ = c.variantChars(chars)
+	c.buildMapping(chars)
+	if err := c.checkMapping(); err != nil {
+		return &DictionaryError{err}
+	}
+
+	coverage := c.mapped
+	c.logf("Fallback dictionary: %d pairs filled from %d unique %s characters",
+		coverage-primary, len(fallback), a.Label)
+	c.logf("Coverage: %d/%d pairs (%.1f%%)",
+		coverage, MaxPairs, float64(coverage)/MaxPairs*100)
+	return nil
+}
+
+// dictionaryChars extracts the mapping characters of alphabet a from
+// dictionary content, in the order they are assigned to pairs
+func (c *Codec) dictionaryChars(a *Alphabet, name string, content []byte) ([]rune, error) {
+	uniqueChars := a.Extract(NormalizeDictionary(string(content)))
+
+	// Sort so that equal character sets always produce the same mapping,
+	// regardless of ordering or duplicate placement in the file. An ordered
+	// dictionary is trusted to list its characters in pair order instead.
+	if c.DictMode != DictOrdered {
+		sort.Slice(uniqueChars, func(i, j int) bool { return uniqueChars[i] < uniqueChars[j] })
+	}
+
+	// Name the likely mistake, such as pointing -dict at the wrong file,
+	// before the general shortfall
+	if len(uniqueChars) < MinDictChars && !utf8.Valid(content) {
+		return nil, fmt.Errorf("%w: %s is not UTF-8 text (found %d); is it a text dictionary?",
+			ErrDictionaryTooSmall, name, len(uniqueChars))
+	}
+	if len(uniqueChars) < MinDictChars {
+		// Text in another script is the usual cause, so name the script
+		if script := foreignScript(a, content); script != "" {
+			return nil, fmt.Errorf("%w: %s is mostly %s text (found %d, need %d+); dictionaries must be %s text (see -alphabet)",
+				ErrDictionaryTooSmall, name, script, len(uniqueChars), MinDictChars, a.Label)
+		}
+	}
+	if len(uniqueChars) == 0 {
+		return nil, fmt.Errorf("%w: no %s characters found in %s; is it a %s text dictionary?",
+			ErrDictionaryTooSmall, a.Label, name, a.Label)
+	}
+
+	if len(uniqueChars) < MinDictChars {
+		return nil, fmt.Errorf("%w (found: %d, need: %d+)", ErrDictionaryTooSmall, len(uniqueChars), MinDictChars)
+	}
+
+	return uniqueChars, nil
+}
+
+// preferChars chooses the characters of chars the mapping uses when there
+// are more than MaxPairs: those in Prefer first, in its order, then the
+// rest in dictionary order. The chosen characters keep their dictionary
+// order, so Prefer changes which characters are mapped but not how the
+// ones common to both choices are ordered. It also returns how many of
+// the mapped characters are preferred ones.
+func (c *Codec) preferChars(chars []rune) ([]rune, int) {
+	inDict := make(map[rune]bool, len(chars))
+	for _, r := range chars {
+		inDict[r] = true
+	}
+
+	chosen := make(map[rune]bool, MaxPairs)
+	for _, r := range c.Prefer {
+		if inDict[r] && len(chosen) < MaxPairs {
+			chosen[r] = true
+		}
+	}
+	preferred := len(chosen)
+
+	if len(chars) <= MaxPairs {
+		return chars, preferred
+	}
+
+	for _, r := range chars {
+		if len(chosen) == MaxPairs {
+			break
+		}
+		chosen[r] = true
+	}
+
+	result := make([]rune, 0, MaxPairs)
+	for _, r := range chars {
+		if chosen[r] {
+			result = append(result, r)
+		}
+	}
+	return result, preferred
+}
+
+// variantChars replaces the characters of chars that have a usable
+// variant in Variants, keeping their positions so each variant takes its
+// character's pair. It also returns how many were replaced.
+func (c *Codec) variantChars(chars []rune) ([]rune, int) {
+	if len(c.Variants) == 0 {
+		return chars, 0
+	}
+
+	inDict := make(map[rune]bool, len(chars))
+	shared := make(map[rune]int)
+	for _, r := range chars {
+		inDict[r] = true
+	}
+	for _, r := range chars {
+		if v, ok := c.Variants[r]; ok {
+			shared[v]++
+		}
+	}
+
+	result := make([]rune, len(chars))
+	replaced := 0
+	for i, r := range chars {
+		result[i] = r
+		if v, ok := c.Variants[r]; ok && v != r && !inDict[v] && shared[v] == 1 {
+			result[i] = v
+			replaced++
+		}
+	}
+	return result, replaced
+}
+
+// foreignScript returns the Unicode script of most of the letters in
+// content outside alphabet a, or "" unless they outnumber its characters
+func foreignScript(a *Alphabet, content []byte) string {
+	counts := make(map[string]int)
+	scripts := make(map[rune]string)
+	inside, outside := 0, 0
+	for _, r := range string(content) {
+		if a.Contains(r) {
+			inside++
+			continue
+		}
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		outside++
+		script, ok := scripts[r]
+		if !ok {
+			script = scriptName(r)
+			scripts[r] = script
+		}
+		counts[script]++
+	}
+
+	if outside <= inside {
+		return ""
+	}
+	dominant := ""
+	for script, n := range counts {
+		if n > counts[dominant] || (n == counts[dominant] && script < dominant) {
+			dominant = script
+		}
+	}
+	return dominant
+}
+
+// mappingCacheVersion changes whenever extraction rules change, so that
+// mappings cached by older versions are never used
+const mappingCacheVersion = "1"
+
+// mappingCacheKey identifies the mapping built from dictionary content, or
+// returns "" when caching is disabled
+func (c *Codec) mappingCacheKey(content []byte) string {
+	if c.CacheDir == "" {
+		return ""
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s %s\n", mappingCacheVersion, c.DictMode, c.alphabetName())
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadCachedMapping returns the characters of alphabet a cached under key.
+// Any problem with the cache just means a miss.
+func (c *Codec) loadCachedMapping(a *Alphabet, key string) ([]rune, bool) {
+	if key == "" {
+		return nil, false
+	}
+
+	path := filepath.Join(c.CacheDir, key+".map")
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	// A damaged entry must not produce a wrong mapping
+	chars := []rune(string(content))
+	if len(chars) < MinDictChars || len(a.Extract(string(content))) != len(chars) {
+		return nil, false
+	}
+
+	if c.Verbose {
+		c.logf("Using cached mapping: %s", path)
+	}
+	return chars, true
+}
+
+// storeCachedMapping caches the mapping characters under key. The cache is
+// only an optimization, so a failure is a warning.
+func (c *Codec) storeCachedMapping(key string, chars []rune) {
+	if key == "" {
+		return
+	}
+
+	err := os.MkdirAll(c.CacheDir, 0755)
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(c.CacheDir, key+".map"), []byte(string(chars)))
+	}
+	if err != nil {
+		c.warnf("failed to cache the dictionary mapping: %v", err)
+	}
+}
+
+// NormalizeDictionary removes every whitespace rune, including CR/LF line
+// endings and the ideographic space, plus any byte order mark, so the same
+// dictionary yields the same mapping however its lines end
+func NormalizeDictionary(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || r == '\uFEFF' {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// ExtractChineseCharacters collects unique Chinese characters from text
+func ExtractChineseCharacters(text string) []rune {
+	seen := make(map[rune]bool)
+	var chars []rune
+
+	for _, r := range text {
+		if !seen[r] && IsChineseChar(r) {
+			chars = append(chars, r)
+			seen[r] = true
+		}
+	}
+
+	return chars
+}
+
+// CharsetReport tallies the characters of a dictionary, sorting the ones
+// extraction skips into categories so cruft in the file is easy to spot
+type CharsetReport struct {
+	alphabet   *Alphabet
+	used       int // First occurrences of the alphabet's characters
+	repeated   int // Later occurrences of the same characters
+	ascii      int
+	punct      int
+	whitespace int // Including byte order marks
+	emoji      int
+	han        int // Ideographs outside the active CJK ranges
+	invalid    int // Bytes that are not valid UTF-8
+	other      map[string]int
+}
+
+// NewCharsetReport tallies content as a dictionary for DefaultAlphabet
+func NewCharsetReport(content []byte) *CharsetReport {
+	a, _ := LookupAlphabet(DefaultAlphabet)
+	return newCharsetReport(content, a)
+}
+
+// newCharsetReport tallies content as a dictionary for alphabet a
+func newCharsetReport(content []byte, a *Alphabet) *CharsetReport {
+	cr := &CharsetReport{alphabet: a, other: make(map[string]int)}
+	seen := make(map[rune]bool)
+
+	text := string(content)
+	for i, r := range text {
+		switch {
+		case a.Has(r):
+			if seen[r] {
+				cr.repeated++
+			} else {
+				cr.used++
+				seen[r] = true
+			}
+		case r == utf8.RuneError && !strings.HasPrefix(text[i:], "\uFFFD"):
+			cr.invalid++
+		case unicode.IsSpace(r) || r == '\uFEFF':
+			cr.whitespace++
+		case r < utf8.RuneSelf:
+			cr.ascii++
+		case unicode.IsPunct(r):
+			cr.punct++
+		case isEmoji(r):
+			cr.emoji++
+		case unicode.Is(unicode.Han, r):
+			cr.han++
+		default:
+			cr.other[scriptName(r)]++
+		}
+	}
+
+	return cr
+}
+
+// isEmoji reports whether r is in a pictographic block, or is one of the
+// joiners and selectors that build emoji sequences
+func isEmoji(r rune) bool {
+	return (r >= 0x1F000 && r <= 0x1FAFF) || // Mahjong tiles through Symbols and Pictographs Extended-A
+		(r >= 0x2600 && r <= 0x27BF) || // Miscellaneous Symbols, Dingbats
+		r == 0x200D || r == 0xFE0F
+}
+
+// scriptName returns the Unicode script of r, or "Unknown"
+func scriptName(r rune) string {
+	for name, table := range unicode.Scripts {
+		if unicode.Is(table, r) {
+			return name
+		}
+	}
+	return "Unknown"
+}
+
+// Print writes the tallies to w
+func (cr *CharsetReport) Print(w io.Writer) {
+	skipped := cr.repeated + cr.ascii + cr.punct + cr.whitespace + cr.emoji + cr.han + cr.invalid
+	for _, n := range cr.other {
+		skipped += n
+	}
+
+	fmt.Fprintf(w, "Dictionary characters: %d used, %d skipped\n", cr.used, skipped)
+	fmt.Fprintf(w, "  %-20s%d\n", "Repeated "+cr.alphabet.Label+":", cr.repeated)
+	fmt.Fprintf(w, "  ASCII:              %d\n", cr.ascii)
+	fmt.Fprintf(w, "  Punctuation:        %d\n", cr.punct)
+	fmt.Fprintf(w, "  Whitespace:         %d\n", cr.whitespace)
+	fmt.Fprintf(w, "  Emoji:              %d\n", cr.emoji)
+	fmt.Fprintf(w, "  Han outside ranges: %d\n", cr.han)
+	if cr.invalid > 0 {
+		fmt.Fprintf(w, "  Invalid UTF-8:      %d\n", cr.invalid)
+	}
+
+	scripts := make([]string, 0, len(cr.other))
+	for name := range cr.other {
+		scripts = append(scripts, name)
+	}
+	sort.Slice(scripts, func(i, j int) bool {
+		if cr.other[scripts[i]] != cr.other[scripts[j]] {
+			return cr.other[scripts[i]] > cr.other[scripts[j]]
+		}
+		return scripts[i] < scripts[j]
+	})
+	for _, name := range scripts {
+		fmt.Fprintf(w, "  Other (%s): %d\n", name, cr.other[name])
+	}
+}
+
+// IsChineseChar checks if rune is in CJK Unicode ranges
+func IsChineseChar(r rune) bool {
+	return (r >= 0x4E00 && r <= 0x9FFF) || // CJK Unified Ideographs
+		(r >= 0x3400 && r <= 0x4DBF) || // CJK Extension A
+		(r >= 0x20000 && r <= 0x2A6DF) // CJK Extension B
+}
+
+// buildMapping assigns chars to pairs in pair order
+func (c *Codec) buildMapping(chars []rune) {
+	c.setMapper(NewDictMapper(chars))
+}
+
+// checkMapping verifies the one-to-one invariant decoding relies on: every
+// character must be assigned exactly one pair. Collisions are reported as
+// warnings, or returned as an error when StrictDict is set.
+func (c *Codec) checkMapping() error {
+	pairsOf := make(map[rune][]string)
+	c.ForEachPair(func(pair string, r rune) {
+		pairsOf[r] = append(pairsOf[r], pair)
+	})
+	if len(pairsOf) == c.mapped {
+		return nil
+	}
+
+	collisions := 0
+	c.ForEachPair(func(pair string, r rune) {
+		if pairs := pairsOf[r]; len(pairs) > 1 && pairs[0] == pair {
+			c.warnf("character %q assigned to multiple pairs: %s", r, strings.Join(pairs, ", "))
+			collisions++
+		}
+	})
+
+	if c.StrictDict {
+		return fmt.Errorf("dictionary mapping is not one-to-one (%d pairs, %d characters, %d collisions)",
+			c.mapped, len(pairsOf), collisions)
+	}
+	return nil
+}
+
+// logTiming reports how long a processing phase took when verbose
+func (c *Codec) logTiming(phase string, start time.Time) {
+	if c.Verbose {
+		c.logf("Timing: %-16s %v", phase, time.Since(start))
+	}
+}
+
+// ForEachPair calls fn for every mapped pair in pair order, i.e. sorted by
+// the base64 alphabet position of the first and then the second character.
+// The mapping itself cannot be modified through fn.
+func (c *Codec) ForEachPair(fn func(pair string, r rune)) {
+	for i := 0; i < MaxPairs; i++ {
+		pair := pairAt(i)
+		if char := c.mapper.MapPair(pair); char != 0 {
+			fn(string(pair[:]), char)
+		}
+	}
+}
+
+// RuneForPair returns the dictionary character mapped to pair, if any
+func (c *Codec) RuneForPair(pair string) (rune, bool) {
+	if len(pair) != 2 {
+		return 0, false
+	}
+	r := c.mapper.MapPair([2]byte{pair[0], pair[1]})
+	return r, r != 0
+}
+
+// PairForRune returns the pair a dictionary character stands for, if any
+func (c *Codec) PairForRune(r rune) (string, bool) {
+	pair, ok := c.mapper.UnmapRune(r)
+	if !ok {
+		return "", false
+	}
+	return string(pair[:]), true
+}
+
+// MappedPairs returns how many of the MaxPairs pairs have a character
+func (c *Codec) MappedPairs() int {
+	return c.mapped
+}
+
+// UnmappedPairs lists the pairs without a dictionary character in pair order
+func (c *Codec) UnmappedPairs() []string {
+	var missing []string
+	for i := 0; i < MaxPairs; i++ {
+		if pair := pairAt(i); c.mapper.MapPair(pair) == 0 {
+			missing = append(missing, string(pair[:]))
+		}
+	}
+	return missing
+}
+
+// mappingRunes lists the mapped characters in pair order; buildMapping
+// always fills pairs contiguously, so this fully describes the mapping
+func (c *Codec) mappingRunes() []rune {
+	chars := make([]rune, 0, c.mapped)
+	c.ForEachPair(func(_ string, r rune) {
+		chars = append(chars, r)
+	})
+	return chars
+}
+
+// Remapped returns a copy of the codec with its mapping rebuilt from
+// characters given in pair order
+func (c *Codec) Remapped(chars []rune) *Codec {
+	mc := *c
+	mc.buildMapping(chars)
+	return &mc
+}
+
+func (c *Codec) printStats(a *Alphabet, totalChars int) {
+	coverage := c.mapped
+	c.logf("Dictionary loaded: %d unique %s characters", totalChars, a.Label)
+	c.logf("Coverage: %d/%d pairs (%.1f%%)",
+		coverage, MaxPairs, float64(coverage)/MaxPairs*100)
+}
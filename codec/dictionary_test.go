@@ -0,0 +1,97 @@
+package codec
+
+import (
+	"errors"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// pairMapping returns every pair c maps and its character
+func pairMapping(c *Codec) map[string]rune {
+	m := make(map[string]rune)
+	c.ForEachPair(func(pair string, r rune) { m[pair] = r })
+	return m
+}
+
+// Dictionaries with the same characters in any order, with or without
+// duplicates, give the same mapping
+func TestDictionaryOrderAndDuplicates(t *testing.T) {
+	content, err := os.ReadFile(partialDict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chars := ExtractChineseCharacters(string(content))
+	reversed := slices.Clone(chars)
+	slices.Reverse(reversed)
+	// Duplicates early in the text must not shift later assignments
+	shuffled := string(reversed[:10]) + string(reversed) + string(chars[:500])
+
+	load := func(text string) map[string]rune {
+		c := NewCodec(WithLogger(nil))
+		if err := c.LoadDictionaryFromReader(strings.NewReader(text)); err != nil {
+			t.Fatal(err)
+		}
+		return pairMapping(c)
+	}
+	want := load(string(chars))
+	got := load(shuffled)
+	if len(got) != len(want) {
+		t.Fatalf("mapped %d pairs, want %d", len(got), len(want))
+	}
+	for pair, r := range want {
+		if got[pair] != r {
+			t.Errorf("pair %q maps to %q, want %q", pair, got[pair], r)
+		}
+	}
+}
+
+// A dictionary in the wrong script is named as such for every alphabet
+func TestDictionaryForeignScript(t *testing.T) {
+	for _, alphabet := range []string{"cjk", "kana", "hangul", "emoji"} {
+		c := NewCodec(WithLogger(nil), WithAlphabet(alphabet))
+		text := "Latin letters only, nothing else"
+		if alphabet != "cjk" {
+			text = "只有漢字，沒有別的文字"
+		}
+		err := c.LoadDictionaryFromReader(strings.NewReader(text))
+		if !errors.Is(err, ErrDictionaryTooSmall) || !strings.Contains(err.Error(), "is mostly") {
+			t.Errorf("%s: got %v, want a too-small error naming the script", alphabet, err)
+		}
+	}
+}
+
+// Mappings are cached only in a CacheDir, and a cache that cannot be
+// written is a warning, not an error
+func TestMappingCache(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CACHE_HOME", filepath.Join(home, "cache"))
+	newTestCodec(t, fullDict, WithLogger(nil))
+	if entries, _ := os.ReadDir(home); len(entries) > 0 {
+		t.Errorf("LoadDictionary without a CacheDir wrote %s", entries[0].Name())
+	}
+
+	dir := filepath.Join(t.TempDir(), "mappings")
+	want := pairMapping(newTestCodec(t, fullDict, WithLogger(nil), WithCacheDir(dir)))
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("CacheDir holds %d entries, want 1", len(entries))
+	}
+	if got := pairMapping(newTestCodec(t, fullDict, WithLogger(nil), WithCacheDir(dir))); !maps.Equal(got, want) {
+		t.Error("cached mapping differs from the one built")
+	}
+
+	blocked := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var log strings.Builder
+	newTestCodec(t, fullDict, WithLogger(slog.New(NewLineHandler(&log, nil))), WithCacheDir(blocked))
+	if !strings.Contains(log.String(), "Warning: failed to cache") {
+		t.Errorf("unwritable CacheDir logged %q, want a warning", log.String())
+	}
+}
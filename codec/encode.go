@@ -0,0 +1,924 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ReadInput reads an input file, or standard input when path is "@-"
+func ReadInput(path string) ([]byte, error) {
+	if path == StdinPath {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// readInputHead reads at most n bytes from the start of an input
+func readInputHead(path string, n int64) ([]byte, error) {
+	in, err := OpenInput(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	return io.ReadAll(io.LimitReader(in, n))
+}
+
+// Encode converts a file to Chinese character representation and returns
+// the sizes and coverage of the encode
+func (c *Codec) Encode(inputPath, outputPath string, useBase64 bool) (EncodeResult, error) {
+	// A preview needs only the start of the input, which is read whole
+	if c.shouldStream(inputPath) && c.Limit == 0 {
+		return c.encodeFileStream(inputPath, outputPath, useBase64)
+	}
+
+	data, err := c.readEncodeInput(inputPath)
+	if err != nil {
+		return EncodeResult{}, err
+	}
+	return c.encodeTo(data, outputPath, useBase64, c.inputInfo(inputPath))
+}
+
+// inputInfo returns the file information Preserve records for the input
+// at path, or nil when there is none to record, as for standard input
+func (c *Codec) inputInfo(path string) fs.FileInfo {
+	if !c.Preserve || path == StdinPath {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	return info
+}
+
+// OutputTarget names one output of EncodeTargets and its mode
+type OutputTarget struct {
+	Path      string
+	UseBase64 bool
+}
+
+// EncodeTargets reads the input once and writes an encoding of it to each
+// target, so modes can be compared without re-reading a large input. It
+// returns a result for each target, in order.
+func (c *Codec) EncodeTargets(inputPath string, targets []OutputTarget) ([]EncodeResult, error) {
+	if c.shouldStream(inputPath) && c.Limit == 0 {
+		return nil, fmt.Errorf("multiple outputs need the whole input and cannot be used when streaming")
+	}
+
+	data, err := c.readEncodeInput(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	return c.encodeToTargets(data, targets, c.inputInfo(inputPath))
+}
+
+// EncodeStringToFile encodes in-memory content and writes the formatted
+// output to outputPath, like Encode does for a file
+func (c *Codec) EncodeStringToFile(s, outputPath string, useBase64 bool) (EncodeResult, error) {
+	return c.encodeTo([]byte(s), outputPath, useBase64, nil)
+}
+
+// EncodeStringToTargets encodes in-memory content to each target, like
+// EncodeTargets does for a file
+func (c *Codec) EncodeStringToTargets(s string, targets []OutputTarget) ([]EncodeResult, error) {
+	return c.encodeToTargets([]byte(s), targets, nil)
+}
+
+func (c *Codec) encodeToTargets(data []byte, targets []OutputTarget, info fs.FileInfo) ([]EncodeResult, error) {
+	results := make([]EncodeResult, 0, len(targets))
+	for _, target := range targets {
+		result, err := c.encodeTo(data, target.Path, target.UseBase64, info)
+		if err != nil {
+			return results, fmt.Errorf("%s: %w", target.Path, err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// readEncodeInput reads the input to encode in memory, or just its start
+// for a preview
+func (c *Codec) readEncodeInput(inputPath string) ([]byte, error) {
+	defer c.logTiming("read input", time.Now())
+
+	var data []byte
+	var err error
+	if c.Limit > 0 {
+		// One byte more than the limit shows whether the input was longer
+		data, err = readInputHead(inputPath, c.Limit+1)
+	} else {
+		data, err = c.readInput(inputPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input: %w", err)
+	}
+	return data, nil
+}
+
+// encodeTo encodes data in memory and writes the formatted output. info
+// describes the input file whose metadata Preserve records, if any.
+func (c *Codec) encodeTo(data []byte, outputPath string, useBase64 bool, info fs.FileInfo) (EncodeResult, error) {
+	encoded, result, err := c.encode(data, useBase64, info)
+	if err != nil {
+		return EncodeResult{}, err
+	}
+	if c.Verify {
+		if err := c.verifyEncoded(encoded, data, useBase64); err != nil {
+			return EncodeResult{}, err
+		}
+	}
+	output := c.formatOutput(encoded, useBase64)
+
+	start := time.Now()
+	if err := writeFileAtomic(outputPath, []byte(output)); err != nil {
+		return EncodeResult{}, err
+	}
+	c.logTiming("write output", start)
+
+	result.OutputBytes = int64(len(output))
+	return result, nil
+}
+
+// formatOutput wraps encoded text according to the codec's output format
+func (c *Codec) formatOutput(encoded string, useBase64 bool) string {
+	return c.formatPrefix(useBase64) + c.formatText(encoded) + c.formatSuffix()
+}
+
+// formatPrefix returns what the output format writes before the encoded text
+func (c *Codec) formatPrefix(useBase64 bool) string {
+	if c.Format != FormatHTML {
+		return ""
+	}
+
+	mode := ModeRaw
+	if useBase64 {
+		mode = ModeBase64
+	}
+
+	// The encoded text is the sole content of <pre>, so extracting the
+	// page's plain text from that block yields decodable input
+	return fmt.Sprintf(htmlPrefix, mode, mode)
+}
+
+// formatText escapes a piece of encoded text for the output format
+func (c *Codec) formatText(encoded string) string {
+	if c.Format != FormatHTML {
+		return encoded
+	}
+	return html.EscapeString(encoded)
+}
+
+// formatSuffix returns what the output format writes after the encoded text
+func (c *Codec) formatSuffix() string {
+	if c.Format != FormatHTML {
+		return ""
+	}
+	return htmlSuffix
+}
+
+const htmlPrefix = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="sinogram-mode" content="%s">
+<title>Sinogram</title>
+<style>
+body { margin: 2em auto; max-width: 40em; font-family: serif; }
+pre { white-space: pre-wrap; word-break: break-all; font-size: 1.25em; line-height: 1.6; }
+.note { color: #888; font-size: 0.8em; }
+</style>
+</head>
+<body>
+<p class="note">Encoded with sinogram (mode: %s)</p>
+<pre>`
+
+const htmlSuffix = `</pre>
+</body>
+</html>
+`
+
+// EncodeString converts in-memory content to Chinese character representation
+func (c *Codec) EncodeString(s string, useBase64 bool) (string, error) {
+	return c.encodeWithHeader([]byte(s), useBase64)
+}
+
+// EncodeBytes encodes data in memory in the codec's mode, base64 unless
+// set otherwise with WithBase64. It never touches the filesystem and
+// never logs, so it is safe to call for small payloads from a service.
+func (c *Codec) EncodeBytes(data []byte) (string, error) {
+	q := c.quiet()
+	encoded, err := q.encodeWithHeader(data, c.Base64)
+	if !c.frozen {
+		c.Stats = q.Stats
+	}
+	return encoded, err
+}
+
+// quiet returns a copy of the codec that neither logs nor reports timings
+func (c *Codec) quiet() *Codec {
+	q := *c
+	q.Logger = nil
+	q.Verbose = false
+	q.pairCounts = nil // Never shared with c, whose encode may be counting
+	return &q
+}
+
+// EstimateEncodedRuneCount predicts how many characters encoding inputLen
+// bytes produces without looking at the data, e.g. to size a progress bar
+// before encoding. The header line, length prefix, alignment padding and
+// MIME line breaks are counted. Every pair is assumed to be in the
+// dictionary, so the count is exact in base64 mode with a full dictionary
+// and a lower bound when pairs are left unmapped, as in raw mode or with
+// passthrough, whose output depends on the data.
+func (c *Codec) EstimateEncodedRuneCount(inputLen int, useBase64 bool) int {
+	length := int64(inputLen)
+	var truncated int64
+	if c.Limit > 0 && length > c.Limit {
+		length, truncated = c.Limit, c.Limit
+	}
+
+	var sum []byte
+	if c.Checksum {
+		sum = make([]byte, sha256.Size)
+	}
+
+	if c.framed(useBase64) {
+		length += int64(len(lengthPrefix(length)))
+	}
+	if c.salted(useBase64) {
+		length += int64(c.Salt)
+	}
+	dataLength := length
+	if c.aligned(useBase64) {
+		length += int64(alignPadding(length))
+	}
+
+	var count int
+	if !useBase64 {
+		// An odd trailing byte is written as it is
+		count = int(length/2 + length%2)
+	} else {
+		textLen := base64.StdEncoding.EncodedLen(int(length))
+		count = textLen / 2
+		if length%3 != 0 {
+			// The final pair holds '=' padding and is written as two characters
+			count++
+		}
+		if c.mime(useBase64) && textLen > 0 {
+			count += (textLen - 1) / mimeLineLength * 2
+		}
+	}
+
+	if c.Space > 0 && count > 0 {
+		count += (count - 1) / c.Space
+	}
+	if header := c.header(useBase64, sum, dataLength, truncated, nil); header != nil {
+		count += utf8.RuneCountInString(header.String())
+	}
+	return count
+}
+
+// encodeWithHeader encodes data, preceded by a header line when the
+// codec's settings need one
+func (c *Codec) encodeWithHeader(data []byte, useBase64 bool) (string, error) {
+	encoded, _, err := c.encode(data, useBase64, nil)
+	return encoded, err
+}
+
+// encode is encodeWithHeader, also returning the result of the encode.
+// info describes the input file for the header, or is nil.
+func (c *Codec) encode(data []byte, useBase64 bool, info fs.FileInfo) (string, EncodeResult, error) {
+	if c.mappingErr != nil {
+		return "", EncodeResult{}, c.mappingErr
+	}
+	if err := c.checkHeaderVersion(); err != nil {
+		return "", EncodeResult{}, err
+	}
+	if err := c.checkPlaceholderChar(); err != nil {
+		return "", EncodeResult{}, err
+	}
+	c.beginStats()
+	defer c.discardStats()
+
+	// A preview encodes only the first Limit bytes, and says so in the header
+	var truncated int64
+	if c.Limit > 0 && int64(len(data)) > c.Limit {
+		data, truncated = data[:c.Limit], c.Limit
+		c.logf("Preview: encoding only the first %d bytes of the input", c.Limit)
+	}
+	inputSize := len(data)
+
+	if len(c.Plugin) > 0 {
+		var err error
+		if data, err = c.runPlugin(pluginEncode, data); err != nil {
+			return "", EncodeResult{}, err
+		}
+	}
+
+	if !useBase64 && c.AssumeUTF8 {
+		if off := invalidUTF8Offset(data); off >= 0 {
+			return "", EncodeResult{}, invalidUTF8Error(int64(off))
+		}
+		c.warnCollisions(c.rawCollisions(data))
+	}
+
+	var sum []byte
+	if c.Checksum {
+		digest := sha256.Sum256(data)
+		sum = digest[:]
+	}
+
+	if c.framed(useBase64) {
+		data = append(lengthPrefix(int64(len(data))), data...)
+	}
+
+	if c.salted(useBase64) {
+		salt, err := newSalt(c.Salt)
+		if err != nil {
+			return "", EncodeResult{}, err
+		}
+		data = append(salt, data...)
+	}
+
+	length := int64(len(data))
+	if c.aligned(useBase64) {
+		data = append(data, make([]byte, alignPadding(length))...)
+	}
+
+	body, tally, err := c.encodeData(data, useBase64)
+	if err != nil {
+		return "", EncodeResult{}, err
+	}
+
+	if err := c.checkPure(body, 0); err != nil {
+		return "", EncodeResult{}, err
+	}
+
+	if c.Space > 0 {
+		col := 0
+		body = insertSpaces(body, c.Space, c.SpaceChar, &col)
+	}
+	if c.literalBreaks(useBase64) {
+		body += bodyEnd(body)
+	}
+
+	if header := c.header(useBase64, sum, length, truncated, info); header != nil {
+		body = header.String() + body
+	}
+	c.endStats(int64(inputSize), int64(len(body)))
+	return body, newEncodeResult(int64(inputSize), int64(len(body)), tally), nil
+}
+
+// beginStats starts counting pair usage for a new encode, unless the codec
+// is frozen
+func (c *Codec) beginStats() {
+	if !c.frozen {
+		c.pairCounts = make([]int, MaxPairs)
+	}
+}
+
+// discardStats drops the pair counts of an encode that failed before
+// endStats, so that they cannot outlive it, e.g. past Freeze
+func (c *Codec) discardStats() {
+	if !c.frozen {
+		c.pairCounts = nil
+	}
+}
+
+// endStats records the finished encode in Stats, unless the codec is frozen
+func (c *Codec) endStats(inputSize, outputSize int64) {
+	if c.Metrics != nil {
+		c.Metrics.AddEncoded(inputSize)
+	}
+	if c.frozen {
+		return
+	}
+
+	usage := make(map[string]int)
+	for idx, n := range c.pairCounts {
+		if n > 0 {
+			usage[string([]byte{Base64Charset[idx/64], Base64Charset[idx%64]})] = n
+		}
+	}
+
+	c.Stats = EncodeStats{InputSize: inputSize, OutputSize: outputSize, PairUsage: usage}
+	c.pairCounts = nil
+}
+
+// header returns the header line the codec's settings call for, or nil
+// when the output needs none. sum is the input's SHA-256 when Checksum is
+// set, length the data length before alignment padding when Align3 is and
+// info the input file whose metadata Preserve records, if any.
+func (c *Codec) header(useBase64 bool, sum []byte, length, truncated int64, info fs.FileInfo) *Header {
+	passthrough, framed, aligned := c.passthrough(useBase64), c.framed(useBase64), c.aligned(useBase64)
+	placeholder, salted := c.UnmappedPolicy == UnmappedPlaceholder, c.salted(useBase64)
+	ordered := c.DictMode == DictOrdered && !c.EmbedDict // An embedded mapping needs no dictionary
+	if !c.EmbedDict && c.Profile == "" && sum == nil && !passthrough && !framed && !aligned && !placeholder &&
+		!ordered && truncated == 0 && c.Space == 0 && !salted && len(c.Plugin) == 0 && info == nil {
+		return nil
+	}
+
+	header := &Header{
+		Version:     c.HeaderVersion,
+		Mode:        ModeRaw,
+		Profile:     c.Profile,
+		SHA256:      sum,
+		Passthrough: passthrough,
+		Frame:       framed,
+		Align3:      aligned,
+		Truncated:   truncated,
+	}
+	if aligned {
+		header.Length = length
+	}
+	if ordered {
+		header.DictMode = DictOrdered
+	}
+	if placeholder {
+		header.Placeholder = c.Placeholder
+	}
+	if c.Space > 0 {
+		header.Space, header.SpaceChar = c.Space, c.SpaceChar
+	}
+	if salted {
+		header.Salt = c.Salt
+	}
+	if len(c.Plugin) > 0 {
+		header.Plugin = c.pluginName()
+	}
+	if info != nil {
+		header.Perm, header.ModTime = info.Mode().Perm(), info.ModTime()
+	}
+	if useBase64 {
+		header.Mode = ModeBase64
+	}
+	if c.EmbedDict {
+		header.Dict = c.mappingRunes()
+	}
+	return header
+}
+
+// checkHeaderVersion rejects a HeaderVersion that headers cannot be
+// written in
+func (c *Codec) checkHeaderVersion() error {
+	switch {
+	case c.HeaderVersion < 0 || c.HeaderVersion > FormatVersion:
+		return fmt.Errorf("%w: cannot write header version %d", ErrUnsupportedFormat, c.HeaderVersion)
+	case c.HeaderVersion == 1 && len(c.Plugin) > 0:
+		return fmt.Errorf("-plugin needs header version 2, as version 1 decoders would ignore it")
+	}
+	return nil
+}
+
+func (c *Codec) encodeData(data []byte, useBase64 bool) (string, pairTally, error) {
+	if c.passthrough(useBase64) {
+		return c.encodePassthrough(data)
+	}
+
+	start := time.Now()
+	text := PairText(data, useBase64)
+	if c.mime(useBase64) {
+		col := 0
+		text = wrapMIME(text, &col)
+	}
+	c.logTiming("base64 convert", start)
+
+	defer c.logTiming("pair mapping", time.Now())
+
+	var result strings.Builder
+	tally := c.mapPairs(&result, text)
+	if c.mime(useBase64) {
+		tally.pairs -= strings.Count(text, "\r\n") // Line breaks are not data
+	}
+	if err := c.finishEncode(tally, !useBase64 && !utf8.Valid(data)); err != nil {
+		return "", tally, err
+	}
+
+	return result.String(), tally, nil
+}
+
+// literalBreaks reports whether the body keeps the input's line breaks as
+// data, as in raw mode and passthrough, so that decoding drops one line
+// break at its end: the one an editor may have added when saving
+func (c *Codec) literalBreaks(useBase64 bool) bool {
+	return !useBase64 || c.passthrough(useBase64)
+}
+
+// bodyEnd returns what to add after a body with literal line breaks that
+// ends in text, so that the line break decoding drops is never data: a
+// body ending in a line break gets another one
+func bodyEnd(text string) string {
+	switch {
+	case strings.HasSuffix(text, "\n"):
+		return "\n"
+	case strings.HasSuffix(text, "\r"):
+		return "\r\n"
+	}
+	return ""
+}
+
+// mime reports whether encoding wraps the base64 in MIME lines
+func (c *Codec) mime(useBase64 bool) bool {
+	return c.B64Variant == B64MIME && useBase64
+}
+
+// wrapMIME breaks base64 text into CRLF-separated lines of mimeLineLength
+// characters. col carries the length of the current line across calls so
+// that consecutive chunks wrap as one text. The line length and base64
+// lengths are even, so a break never falls inside a pair.
+func wrapMIME(text string, col *int) string {
+	var b strings.Builder
+	b.Grow(len(text) + len(text)/mimeLineLength*2 + 2)
+
+	for len(text) > 0 {
+		if *col == mimeLineLength {
+			b.WriteString("\r\n")
+			*col = 0
+		}
+		n := min(mimeLineLength-*col, len(text))
+		b.WriteString(text[:n])
+		text = text[n:]
+		*col += n
+	}
+
+	return b.String()
+}
+
+// insertSpaces writes sep after every every characters of text. col
+// carries the characters since the last separator across calls, so that
+// consecutive chunks are spaced as one text. No separator ends the text.
+func insertSpaces(text string, every int, sep rune, col *int) string {
+	var b strings.Builder
+	b.Grow(len(text) + len(text)/every*utf8.RuneLen(sep))
+
+	for i := 0; i < len(text); {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		if *col == every {
+			b.WriteRune(sep)
+			*col = 0
+		}
+		b.WriteString(text[i : i+size])
+		*col++
+		i += size
+	}
+	return b.String()
+}
+
+// removeSpaces reverses insertSpaces, failing if a separator is missing.
+// skipBreaks is as for unspaceReader.
+func removeSpaces(text string, every int, sep rune, skipBreaks bool) (string, error) {
+	r := &unspaceReader{br: bufio.NewReader(strings.NewReader(text)), every: every, sep: sep, skipBreaks: skipBreaks}
+	b, err := io.ReadAll(r)
+	return string(b), err
+}
+
+// unspaceReader removes the separators insertSpaces wrote from the text
+// read from br, checking that each sits where it belongs. Bytes that are
+// not valid UTF-8 pass through as they are. With skipBreaks, line breaks
+// pass through without being counted: a base64 body has none of its own,
+// so they were added later, e.g. by an editor ending the file with one.
+type unspaceReader struct {
+	br         *bufio.Reader
+	every      int
+	sep        rune
+	skipBreaks bool
+	col        int   // Characters since the last separator
+	pos        int64 // Characters read, separators included
+	pending    []byte
+}
+
+func (u *unspaceReader) Read(p []byte) (int, error) {
+	n := copy(p, u.pending)
+	u.pending = u.pending[n:]
+
+	for n < len(p) {
+		r, size, err := u.br.ReadRune()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		u.pos++
+
+		if u.skipBreaks && isBase64LineBreak(r) {
+			p[n] = byte(r)
+			n++
+			continue
+		}
+
+		if u.col == u.every {
+			if r != u.sep {
+				return n, fmt.Errorf("%w: expected %q at character %d, found %q", ErrBadSpacing, u.sep, u.pos, r)
+			}
+			u.col = 0
+			continue
+		}
+		u.col++
+
+		var buf [utf8.UTFMax]byte
+		if r == utf8.RuneError && size == 1 {
+			u.br.UnreadRune()
+			buf[0], _ = u.br.ReadByte()
+		} else {
+			utf8.EncodeRune(buf[:], r)
+		}
+		copied := copy(p[n:], buf[:size])
+		n += copied
+		u.pending = append([]byte(nil), buf[copied:size]...)
+	}
+	return n, nil
+}
+
+// ValidSpaceChar reports whether r can separate spaced output: a space
+// other than a line break, or a zero-width space. Neither can be a
+// dictionary or base64 character.
+func ValidSpaceChar(r rune) bool {
+	return (unicode.IsSpace(r) && r != '\n' && r != '\r') || r == '\u200B'
+}
+
+// passthrough reports whether encoding keeps ASCII literal. It only applies
+// in base64 mode, where the escaped runs hold base64.
+func (c *Codec) passthrough(useBase64 bool) bool {
+	return c.PassthroughASCII && useBase64
+}
+
+// framed reports whether encoding prefixes the data with its length. Like
+// passthrough it only applies in base64 mode.
+func (c *Codec) framed(useBase64 bool) bool {
+	return c.Frame && useBase64
+}
+
+// salted reports whether encoding puts random bytes before the data. Like
+// framed, it needs base64 mode.
+func (c *Codec) salted(useBase64 bool) bool {
+	return c.Salt > 0 && useBase64
+}
+
+// newSalt returns n random bytes
+func newSalt(n int) ([]byte, error) {
+	salt := make([]byte, n)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return salt, nil
+}
+
+// aligned reports whether encoding pads the data to a multiple of 3 bytes.
+// Like passthrough it only applies in base64 mode.
+func (c *Codec) aligned(useBase64 bool) bool {
+	return (c.Align3 || c.Pure) && useBase64
+}
+
+// alignPadding returns how many zero bytes pad length to a multiple of 3,
+// the base64 group size
+func alignPadding(length int64) int {
+	return int((3 - length%3) % 3)
+}
+
+// lengthPrefix returns the varint encoding of a framed body's data length
+func lengthPrefix(length int64) []byte {
+	return binary.AppendUvarint(nil, uint64(length))
+}
+
+// encodePassthrough copies the ASCII bytes of data unchanged and encodes
+// each run of other bytes between escape markers. A header magic in the
+// ASCII is escaped too, or decoding would take it for the start of a new
+// segment.
+func (c *Codec) encodePassthrough(data []byte) (string, pairTally, error) {
+	defer c.logTiming("pair mapping", time.Now())
+
+	var result strings.Builder
+	var tally pairTally
+	escape := func(run []byte) {
+		result.WriteString(escapeOpen)
+		tally.add(c.mapPairs(&result, base64.StdEncoding.EncodeToString(run)))
+		result.WriteString(escapeClose)
+	}
+
+	for i := 0; i < len(data); {
+		j := i
+		for j < len(data) && data[j] < utf8.RuneSelf {
+			j++
+		}
+		literal := data[i:j]
+		for {
+			k := bytes.Index(literal, []byte(headerMagic))
+			if k < 0 {
+				break
+			}
+			result.Write(literal[:k])
+			escape(literal[k : k+len(headerMagic)])
+			literal = literal[k+len(headerMagic):]
+		}
+		result.Write(literal)
+
+		i = j
+		for j < len(data) && data[j] >= utf8.RuneSelf {
+			j++
+		}
+		if j > i {
+			escape(data[i:j])
+		}
+		i = j
+	}
+
+	if err := c.finishEncode(tally, false); err != nil {
+		return "", tally, err
+	}
+	return result.String(), tally, nil
+}
+
+// pairTally counts the pairs of an encode other than padding: all of
+// them, those written as dictionary characters, and the valid ones that
+// had none. The rest are raw pairs that are not base64.
+type pairTally struct {
+	pairs, mapped, unmapped int
+}
+
+func (t *pairTally) add(o pairTally) {
+	t.pairs += o.pairs
+	t.mapped += o.mapped
+	t.unmapped += o.unmapped
+}
+
+// mapPairs writes the mapped form of text to result and tallies its valid
+// pairs. Those with no dictionary character are kept as-is, or replaced by
+// the placeholder under UnmappedPlaceholder.
+func (c *Codec) mapPairs(result *strings.Builder, text string) pairTally {
+	var tally pairTally
+
+	for i := 0; i+1 < len(text); i += 2 {
+		pair := text[i : i+2]
+
+		// Padding is never mapped. It is written as is, and decoding copies
+		// it back in place for the base64 decoder.
+		if IsPaddingPair(pair) {
+			result.WriteString(pair)
+			continue
+		}
+		tally.pairs++
+
+		// Only map valid base64 character pairs
+		if isValidBase64Pair(pair) {
+			if char := c.mapper.MapPair([2]byte{pair[0], pair[1]}); char != 0 {
+				result.WriteRune(char)
+				tally.mapped++
+				if c.pairCounts != nil {
+					c.pairCounts[int(base64Positions[pair[0]])*64+int(base64Positions[pair[1]])]++
+				}
+				continue
+			}
+			tally.unmapped++
+
+			if c.UnmappedPolicy == UnmappedPlaceholder {
+				result.WriteRune(c.Placeholder)
+				continue
+			}
+		}
+
+		// Keep unmapped or invalid pairs as-is
+		result.WriteString(pair)
+	}
+
+	// Odd-length raw text leaves a trailing byte; keep it rather than drop it
+	if len(text)%2 != 0 {
+		result.WriteByte(text[len(text)-1])
+	}
+
+	return tally
+}
+
+// finishEncode applies the unmapped-pair policy and prints the warnings
+// collected while encoding
+func (c *Codec) finishEncode(tally pairTally, invalidRawUTF8 bool) error {
+	unmapped := tally.unmapped
+	if unmapped > 0 && c.Metrics != nil {
+		c.Metrics.AddUnmapped(unmapped)
+	}
+
+	if unmapped > 0 {
+		switch c.UnmappedPolicy {
+		case UnmappedError:
+			return fmt.Errorf("%d %w", unmapped, ErrUnmappedPair)
+		case UnmappedPlaceholder:
+			c.warnf("%d pairs not in dictionary were replaced with %q; the output cannot be decoded",
+				unmapped, c.Placeholder)
+		default:
+			c.warnf("%d pairs not in dictionary", unmapped)
+		}
+	}
+
+	if invalidRawUTF8 {
+		c.warnf("input is not valid UTF-8; raw mode is intended for text, use base64 for binary data")
+	}
+
+	return nil
+}
+
+// checkPure enforces Pure on a piece of encoded body. Errors count
+// runeOffset characters before text, as in decodeBase64.
+func (c *Codec) checkPure(text string, runeOffset int64) error {
+	if !c.Pure {
+		return nil
+	}
+
+	pos := runeOffset
+	for _, r := range text {
+		pos++
+		if !c.isMapped(r) {
+			return fmt.Errorf("%w: character %d (%q) is not in the dictionary", ErrNotPure, pos, r)
+		}
+	}
+	return nil
+}
+
+// ValidPlaceholder reports whether r can mark unmapped pairs: it must not
+// be ASCII, a Chinese character or an escape marker, so that decoding
+// never mistakes it for data. Codecs using another alphabet also refuse
+// its characters as placeholders.
+func ValidPlaceholder(r rune) bool {
+	return r >= utf8.RuneSelf && !IsChineseChar(r) &&
+		string(r) != escapeOpen && string(r) != escapeClose
+}
+
+// checkPlaceholderChar refuses a Placeholder under UnmappedPlaceholder that
+// decoding could mistake for data: one ValidPlaceholder rejects, or a
+// character of the codec's alphabet or mapping
+func (c *Codec) checkPlaceholderChar() error {
+	if c.UnmappedPolicy != UnmappedPlaceholder {
+		return nil
+	}
+	r := c.Placeholder
+	a, err := c.alphabet()
+	if err != nil {
+		return err
+	}
+	if !ValidPlaceholder(r) || a.Has(r) || (c.mapper != nil && c.isMapped(r)) {
+		return fmt.Errorf("placeholder %q could be mistaken for encoded data; choose a character outside the %s alphabet",
+			r, a.Name)
+	}
+	return nil
+}
+
+// PairText produces the text that is split into pairs for mapping. Base64
+// output always has even length; raw text may leave one trailing byte.
+func PairText(data []byte, useBase64 bool) string {
+	if useBase64 {
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return string(data)
+}
+
+// isBase64LineBreak reports whether r is a line break character, which
+// the base64 decoder skips
+func isBase64LineBreak(r rune) bool {
+	return r == '\r' || r == '\n'
+}
+
+// IsPaddingPair reports whether pair ends base64 text with '=' padding.
+// Base64 text is a whole number of 4-character quartets, so padding only
+// ever fills the second half of the last quartet: "X=" for one '=' and
+// "==" for two. It never straddles a pair.
+func IsPaddingPair(pair string) bool {
+	return len(pair) == 2 && pair[1] == '=' &&
+		(pair[0] == '=' || strings.IndexByte(Base64Charset, pair[0]) != -1)
+}
+
+func isValidBase64Pair(pair string) bool {
+	return len(pair) == 2 &&
+		strings.IndexByte(Base64Charset, pair[0]) != -1 &&
+		strings.IndexByte(Base64Charset, pair[1]) != -1
+}
+
+// DistinctPairs collects the unique mappable pairs used by text, sorted
+func DistinctPairs(text string) []string {
+	seen := make(map[string]bool)
+	var pairs []string
+
+	for i := 0; i+1 < len(text); i += 2 {
+		pair := text[i : i+2]
+		if !seen[pair] && isValidBase64Pair(pair) {
+			pairs = append(pairs, pair)
+			seen[pair] = true
+		}
+	}
+
+	sort.Strings(pairs)
+	return pairs
+}
@@ -0,0 +1,288 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Pure pads base64 to whole groups instead of refusing '=' padding
+func TestPureEveryLength(t *testing.T) {
+	c := newTestCodec(t, fullDict, WithPure(true))
+	for n := range 10 {
+		data := bytes.Repeat([]byte{0xa5}, n)
+		encoded, err := c.EncodeString(string(data), true)
+		if err != nil {
+			t.Fatalf("length %d: EncodeString: %v", n, err)
+		}
+		decoded, err := c.DecodeString(encoded, true)
+		if err != nil {
+			t.Fatalf("length %d: DecodeString: %v", n, err)
+		}
+		if decoded != string(data) {
+			t.Errorf("length %d: round trip gave %x, want %x", n, decoded, data)
+		}
+	}
+}
+
+// Without -salt, encoding the same file twice gives identical bytes
+func TestEncodeReproducible(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.bin")
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	if err := os.WriteFile(input, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		base64 bool
+		opts   []Option
+	}{
+		{"raw", false, nil},
+		{"base64", true, nil},
+		{"everything", true, []Option{WithChecksum(true), WithFrame(true), WithEmbedDict(true), WithPreserve(true)}},
+	} {
+		var outputs [2][]byte
+		for i := range outputs {
+			c := newTestCodec(t, fullDict, append(tc.opts, WithLogger(nil))...)
+			output := filepath.Join(dir, tc.name+".encoded")
+			if _, err := c.Encode(input, output, tc.base64); err != nil {
+				t.Fatalf("%s: Encode: %v", tc.name, err)
+			}
+			var err error
+			if outputs[i], err = os.ReadFile(output); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !bytes.Equal(outputs[0], outputs[1]) {
+			t.Errorf("%s: two encodes of the same file differ", tc.name)
+		}
+	}
+}
+
+// Odd-length raw text keeps its last byte
+func TestRawOddLengthKeepsLastByte(t *testing.T) {
+	c := newTestCodec(t, fullDict, WithLogger(nil))
+	for _, s := range []string{"a", "abc", "hello", "ab\x00", "odd!\xff"} {
+		encoded, err := c.EncodeString(s, false)
+		if err != nil {
+			t.Fatalf("%q: EncodeString: %v", s, err)
+		}
+		decoded, err := c.DecodeString(encoded, false)
+		if err != nil {
+			t.Fatalf("%q: DecodeString: %v", s, err)
+		}
+		if decoded != s {
+			t.Errorf("%q: round trip gave %q", s, decoded)
+		}
+	}
+}
+
+// Raw mode is meant for text, but binary input still round-trips byte for
+// byte, with a warning
+func TestRawBinary(t *testing.T) {
+	var log bytes.Buffer
+	c := newTestCodec(t, fullDict, WithLogger(slog.New(slog.NewTextHandler(&log, nil))))
+	data := make([]byte, 0, 512)
+	for i := range 256 {
+		data = append(data, byte(i), byte(255-i))
+	}
+	log.Reset()
+
+	encoded, err := c.EncodeString(string(data), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(log.String(), "not valid UTF-8") {
+		t.Errorf("no warning about binary input; log:\n%s", log.String())
+	}
+	decoded, err := c.DecodeString(encoded, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal([]byte(decoded), data) {
+		t.Errorf("round trip gave %x, want %x", decoded, data)
+	}
+}
+
+// Framed output round-trips every length residue, including lengths where
+// the varint prefix grows a byte
+func TestFrameEveryLength(t *testing.T) {
+	c := newTestCodec(t, fullDict, WithLogger(nil), WithFrame(true))
+	lengths := []int{127, 128, 129, 16383, 16384, 16385}
+	for n := range 12 {
+		lengths = append(lengths, n)
+	}
+	for _, n := range lengths {
+		data := make([]byte, n)
+		for i := range data {
+			data[i] = byte(i*7 + 1)
+		}
+		encoded, err := c.EncodeString(string(data), true)
+		if err != nil {
+			t.Fatalf("length %d: EncodeString: %v", n, err)
+		}
+		decoded, err := c.DecodeString(encoded, true)
+		if err != nil {
+			t.Fatalf("length %d: DecodeString: %v", n, err)
+		}
+		if decoded != string(data) {
+			t.Errorf("length %d: round trip gave %d bytes", n, len(decoded))
+		}
+	}
+}
+
+// Align3 leaves no '=' in the output and round-trips every length mod 3
+func TestAlign3EveryResidue(t *testing.T) {
+	c := newTestCodec(t, fullDict, WithLogger(nil), WithAlign3(true))
+	for n := range 9 {
+		data := bytes.Repeat([]byte{0x5a}, n)
+		encoded, err := c.EncodeString(string(data), true)
+		if err != nil {
+			t.Fatalf("length %d: EncodeString: %v", n, err)
+		}
+		header, body, _ := strings.Cut(encoded, "\n")
+		if want := fmt.Sprintf("align=3 length=%d", n); !strings.HasSuffix(header, want) {
+			t.Errorf("length %d: header %q does not end in %q", n, header, want)
+		}
+		if strings.Contains(body, "=") {
+			t.Errorf("length %d: body has '=': %q", n, body)
+		}
+		decoded, err := c.DecodeString(encoded, true)
+		if err != nil {
+			t.Fatalf("length %d: DecodeString: %v", n, err)
+		}
+		if decoded != string(data) {
+			t.Errorf("length %d (mod 3 = %d): round trip gave %d bytes", n, n%3, len(decoded))
+		}
+	}
+}
+
+// Base64 ending in one or two '=' round-trips exactly
+func TestBase64Padding(t *testing.T) {
+	c := newTestCodec(t, fullDict, WithLogger(nil))
+	for _, tc := range []struct {
+		data    string
+		padding string
+	}{
+		{"a", "=="},
+		{"ab", "="},
+		{"abcd", "=="},
+		{"abcde", "="},
+		{"\xff\xfe\xfd\xfc", "=="},
+		{"\xff\xfe\xfd\xfc\xfb", "="},
+	} {
+		text := PairText([]byte(tc.data), true)
+		if !strings.HasSuffix(text, tc.padding) || strings.HasSuffix(text, tc.padding+"=") {
+			t.Fatalf("%q: base64 %q does not end in exactly %q", tc.data, text, tc.padding)
+		}
+		if !IsPaddingPair(text[len(text)-2:]) {
+			t.Errorf("%q: last pair %q is not a padding pair", tc.data, text[len(text)-2:])
+		}
+		encoded, err := c.EncodeString(tc.data, true)
+		if err != nil {
+			t.Fatalf("%q: EncodeString: %v", tc.data, err)
+		}
+		decoded, err := c.DecodeString(encoded, true)
+		if err != nil {
+			t.Fatalf("%q: DecodeString: %v", tc.data, err)
+		}
+		if decoded != tc.data {
+			t.Errorf("%q: round trip gave %q", tc.data, decoded)
+		}
+	}
+}
+
+// benchmarkInput is 1 MiB of data that uses every base64 pair
+func benchmarkInput() []byte {
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i*131 + i>>8)
+	}
+	return data
+}
+
+func BenchmarkEncode(b *testing.B) {
+	c := newTestCodec(b, fullDict, WithLogger(nil))
+	data := benchmarkInput()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for range b.N {
+		if _, err := c.EncodeBytes(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	c := newTestCodec(b, fullDict, WithLogger(nil))
+	data := benchmarkInput()
+	encoded, err := c.EncodeBytes(data)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for range b.N {
+		if _, err := c.DecodeBytes(encoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkUnmapRune compares the decode loop's dense table with the
+// map lookup it replaced
+func BenchmarkUnmapRune(b *testing.B) {
+	c := newTestCodec(b, fullDict, WithLogger(nil))
+	var runes []rune
+	pairs := make(map[rune]string)
+	c.ForEachPair(func(pair string, r rune) {
+		runes = append(runes, r)
+		pairs[r] = pair
+	})
+	m := c.Mapper()
+
+	b.Run("table", func(b *testing.B) {
+		for i := range b.N {
+			if _, ok := m.UnmapRune(runes[i%len(runes)]); !ok {
+				b.Fatal("unmapped")
+			}
+		}
+	})
+	b.Run("map", func(b *testing.B) {
+		for i := range b.N {
+			if _, ok := pairs[runes[i%len(runes)]]; !ok {
+				b.Fatal("unmapped")
+			}
+		}
+	})
+}
+
+// A placeholder from the codec's alphabet could be read as data, so
+// encoding refuses it even when the dictionary does not use it
+func TestPlaceholderInAlphabet(t *testing.T) {
+	var hangul strings.Builder
+	for r := rune(0xAC00); r < 0xAC00+300; r++ {
+		hangul.WriteRune(r)
+	}
+	c := NewCodec(WithLogger(nil), WithAlphabet("hangul"), WithUnmappedPolicy(UnmappedPlaceholder, '\uD7A3'))
+	if err := c.LoadDictionaryFromReader(strings.NewReader(hangul.String())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.EncodeString("hello", true); err == nil {
+		t.Error("EncodeString accepted a Hangul placeholder with the hangul alphabet")
+	}
+
+	c.Placeholder = DefaultPlaceholder
+	if _, err := c.EncodeString("hello", true); err != nil {
+		t.Errorf("EncodeString with the default placeholder: %v", err)
+	}
+}
@@ -0,0 +1,353 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// headerMagic starts every header line, and so every segment. It is
+// followed by the format version, a single digit, and a space.
+const (
+	headerMagic     = "SINOGRAM/"
+	headerPrefixLen = len(headerMagic) + 2
+)
+
+// Header is the optional metadata line written ahead of the encoded body,
+// in the form "SINOGRAM/2 key=value ...\n"
+type Header struct {
+	Version int    // Format version; 0 means FormatVersion when writing
+	Mode    string // ModeBase64 or ModeRaw
+	Profile string // Name of the profile the output was encoded with
+	SHA256  []byte // Checksum of the original data
+	Dict    []rune // Embedded mapping characters, in pair order
+
+	// Passthrough marks a body that keeps ASCII literal and escapes
+	// encoded runs (see Codec.PassthroughASCII)
+	Passthrough bool
+
+	// Frame marks a body whose data starts with its varint-encoded length
+	Frame bool
+
+	// Align3 marks a body padded to a multiple of 3 bytes; Length is the
+	// data length before that padding
+	Align3 bool
+	Length int64
+
+	// DictMode is DictOrdered when the mapping follows the dictionary's
+	// file order; it is empty for DictSorted, the default, and for headers
+	// written before it was recorded
+	DictMode string
+
+	// Placeholder is the character that marks unmapped pairs, or 0
+	Placeholder rune
+
+	// Truncated is the number of input bytes encoded when Codec.Limit cut
+	// the input short, or 0 for a complete encoding
+	Truncated int64
+
+	// Space is the number of body characters between separators, and
+	// SpaceChar the separator, when Codec.Space spaced the body; 0 otherwise
+	Space     int
+	SpaceChar rune
+
+	// Salt is the number of random bytes before the data (see Codec.Salt)
+	Salt int
+
+	// Plugin names the plugin the data was transformed with before
+	// encoding (see Codec.Plugin), or is empty
+	Plugin string
+
+	// Perm and ModTime are the permissions and modification time of the
+	// input file when Codec.Preserve recorded them, which Decode restores;
+	// 0 and the zero time otherwise
+	Perm    fs.FileMode
+	ModTime time.Time
+}
+
+// String renders the header line, including its trailing newline
+func (h *Header) String() string {
+	version := h.Version
+	if version == 0 {
+		version = FormatVersion
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s%d mode=%s", headerMagic, version, h.Mode)
+	if h.Profile != "" {
+		fmt.Fprintf(&b, " profile=%s", h.Profile)
+	}
+	if h.SHA256 != nil {
+		fmt.Fprintf(&b, " sha256=%x", h.SHA256)
+	}
+	if h.Passthrough {
+		b.WriteString(" passthrough=ascii")
+	}
+	if h.Frame {
+		b.WriteString(" frame=varint")
+	}
+	if h.Align3 {
+		fmt.Fprintf(&b, " align=3 length=%d", h.Length)
+	}
+	if h.DictMode != "" {
+		fmt.Fprintf(&b, " dictmode=%s", h.DictMode)
+	}
+	if h.Placeholder != 0 {
+		fmt.Fprintf(&b, " placeholder=%c", h.Placeholder)
+	}
+	if h.Truncated > 0 {
+		fmt.Fprintf(&b, " truncated=%d", h.Truncated)
+	}
+	if h.Salt > 0 {
+		fmt.Fprintf(&b, " salt=%d", h.Salt)
+	}
+	if h.Space > 0 {
+		fmt.Fprintf(&b, " space=%d:%04X", h.Space, h.SpaceChar)
+	}
+	if h.Plugin != "" {
+		fmt.Fprintf(&b, " plugin=%s", h.Plugin)
+	}
+	if h.Perm != 0 {
+		fmt.Fprintf(&b, " perm=%04o", h.Perm)
+	}
+	if !h.ModTime.IsZero() {
+		fmt.Fprintf(&b, " mtime=%s", h.ModTime.UTC().Format(time.RFC3339Nano))
+	}
+	if len(h.Dict) > 0 {
+		b.WriteString(" dict=")
+		b.WriteString(string(h.Dict))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// parseHeader splits a leading header line from text. It returns a nil
+// header and the text unchanged when no header is present.
+func parseHeader(text string) (*Header, string, error) {
+	if !isHeaderPrefix(text) {
+		return nil, text, nil
+	}
+
+	line, body, found := strings.Cut(text, "\n")
+	if !found {
+		return nil, "", fmt.Errorf("unterminated header")
+	}
+
+	header := &Header{Version: int(text[len(headerMagic)] - '0')}
+	if header.Version > FormatVersion {
+		return nil, "", fmt.Errorf("%w: header version %d is newer than %d; upgrade sinogram to decode it",
+			ErrUnsupportedFormat, header.Version, FormatVersion)
+	}
+
+	hasLength := false
+	for _, field := range strings.Fields(line)[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "mode":
+			if value != ModeBase64 && value != ModeRaw {
+				return nil, "", fmt.Errorf("invalid header mode %q", value)
+			}
+			header.Mode = value
+		case "profile":
+			header.Profile = value
+		case "sha256":
+			sum, err := hex.DecodeString(value)
+			if err != nil || len(sum) != sha256.Size {
+				return nil, "", fmt.Errorf("invalid header checksum %q", value)
+			}
+			header.SHA256 = sum
+		case "passthrough":
+			if value != "ascii" {
+				return nil, "", fmt.Errorf("invalid header passthrough %q", value)
+			}
+			header.Passthrough = true
+		case "frame":
+			if value != "varint" {
+				return nil, "", fmt.Errorf("invalid header frame %q", value)
+			}
+			header.Frame = true
+		case "align":
+			if value != "3" {
+				return nil, "", fmt.Errorf("invalid header alignment %q", value)
+			}
+			header.Align3 = true
+		case "length":
+			length, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || length < 0 {
+				return nil, "", fmt.Errorf("invalid header length %q", value)
+			}
+			header.Length = length
+			hasLength = true
+		case "dictmode":
+			if value != DictSorted && value != DictOrdered {
+				return nil, "", fmt.Errorf("invalid header dictionary mode %q", value)
+			}
+			header.DictMode = value
+		case "placeholder":
+			r, size := utf8.DecodeRuneInString(value)
+			if size != len(value) || !ValidPlaceholder(r) {
+				return nil, "", fmt.Errorf("invalid header placeholder %q", value)
+			}
+			header.Placeholder = r
+		case "truncated":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return nil, "", fmt.Errorf("invalid header truncation %q", value)
+			}
+			header.Truncated = n
+		case "salt":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return nil, "", fmt.Errorf("invalid header salt %q", value)
+			}
+			header.Salt = n
+		case "space":
+			every, char, _ := strings.Cut(value, ":")
+			n, err := strconv.Atoi(every)
+			code, codeErr := strconv.ParseUint(char, 16, 32)
+			if err != nil || codeErr != nil || n <= 0 || !ValidSpaceChar(rune(code)) {
+				return nil, "", fmt.Errorf("invalid header spacing %q", value)
+			}
+			header.Space, header.SpaceChar = n, rune(code)
+		case "plugin":
+			if value == "" {
+				return nil, "", fmt.Errorf("invalid header plugin %q", value)
+			}
+			header.Plugin = value
+		case "perm":
+			perm, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || perm == 0 || perm > uint64(fs.ModePerm) {
+				return nil, "", fmt.Errorf("invalid header permissions %q", value)
+			}
+			header.Perm = fs.FileMode(perm)
+		case "mtime":
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid header modification time %q", value)
+			}
+			header.ModTime = t
+		case "dict":
+			header.Dict = []rune(value)
+			// Any alphabet may have supplied them, so only check they are usable
+			if custom, _ := LookupAlphabet("custom"); len(custom.Extract(value)) != len(header.Dict) {
+				return nil, "", fmt.Errorf("embedded dictionary contains duplicate or unusable characters")
+			}
+		default:
+			// Version 1 ignored unknown keys so that newer headers stay
+			// readable, even those whose fields change the decoding
+			if header.Version >= 2 && !strings.HasPrefix(key, "x-") {
+				return nil, "", fmt.Errorf("%w: unknown header field %q", ErrUnsupportedFormat, key)
+			}
+		}
+	}
+
+	if header.Align3 && !hasLength {
+		return nil, "", fmt.Errorf("aligned header records no length")
+	}
+
+	return header, body, nil
+}
+
+// isHeaderPrefix reports whether s starts with the magic, version and space
+// that begin a header line
+func isHeaderPrefix(s string) bool {
+	if len(s) < headerPrefixLen || s[:len(headerMagic)] != headerMagic {
+		return false
+	}
+	version := s[len(headerMagic)]
+	return version >= '1' && version <= '9' && s[len(headerMagic)+1] == ' '
+}
+
+// mayStartHeader reports whether b, shorter than a header line prefix,
+// could be the beginning of one
+func mayStartHeader(b []byte) bool {
+	n := min(len(b), len(headerMagic))
+	if string(b[:n]) != headerMagic[:n] {
+		return false
+	}
+	if len(b) > len(headerMagic) {
+		return b[len(headerMagic)] >= '1' && b[len(headerMagic)] <= '9'
+	}
+	return true
+}
+
+// indexHeader returns the index of the first header line prefix in s, or
+// -1 if there is none
+func indexHeader(s string) int {
+	for off := 0; ; {
+		i := strings.Index(s[off:], headerMagic)
+		if i < 0 {
+			return -1
+		}
+		if isHeaderPrefix(s[off+i:]) {
+			return off + i
+		}
+		off += i + 1
+	}
+}
+
+// indexHeaderBytes is indexHeader for a byte slice
+func indexHeaderBytes(b []byte) int {
+	for off := 0; ; {
+		i := bytes.Index(b[off:], []byte(headerMagic))
+		if i < 0 {
+			return -1
+		}
+		if end := min(len(b), off+i+headerPrefixLen); isHeaderPrefix(string(b[off+i : end])) {
+			return off + i
+		}
+		off += i + 1
+	}
+}
+
+// Label prefixes recognized by trimWrapping, compared case-insensitively
+var trimLabels = []string{"encoded:", "sinogram:"}
+
+// Quote pairs recognized by trimWrapping
+var trimQuotes = [][2]string{
+	{`"`, `"`}, {"'", "'"}, {"`", "`"},
+	{"“", "”"}, {"‘", "’"}, {"「", "」"}, {"『", "』"},
+}
+
+// trimWrapping strips wrapping commonly added when encoded text is pasted,
+// applying each rule at most once, in order:
+//  1. surrounding whitespace
+//  2. a markdown code fence: an opening ``` line and a closing ``` line
+//  3. a leading "encoded:" or "sinogram:" label
+//  4. one pair of matching quotes enclosing the whole text
+//
+// None of the stripped characters occur in base64-mode output, so the
+// rules cannot eat real content there. Raw-mode text may legitimately
+// contain them; only use trimming there when the wrapping is known.
+func trimWrapping(text string) string {
+	text = strings.TrimSpace(text)
+
+	if strings.HasPrefix(text, "```") && strings.HasSuffix(text, "```") {
+		if _, inner, found := strings.Cut(text, "\n"); found {
+			text = strings.TrimSpace(strings.TrimSuffix(inner, "```"))
+		}
+	}
+
+	for _, label := range trimLabels {
+		if len(text) >= len(label) && strings.EqualFold(text[:len(label)], label) {
+			text = strings.TrimSpace(text[len(label):])
+			break
+		}
+	}
+
+	for _, q := range trimQuotes {
+		if len(text) >= len(q[0])+len(q[1]) &&
+			strings.HasPrefix(text, q[0]) && strings.HasSuffix(text, q[1]) {
+			text = strings.TrimSpace(text[len(q[0]) : len(text)-len(q[1])])
+			break
+		}
+	}
+
+	return text
+}
@@ -0,0 +1,142 @@
+package codec
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// The request header and query parameter that ask WrapHandler to transcode
+// an exchange, e.g. "X-Sinogram: 1" or "?sinogram=1"
+const (
+	HTTPHeader     = "X-Sinogram"
+	HTTPQueryParam = "sinogram"
+)
+
+// WrapHandler returns a handler that lets clients talk to h in encoded
+// text. A request that sets HTTPHeader or HTTPQueryParam to a true value
+// has its body decoded before h reads it, and h's response is encoded in
+// base64 mode as it is written, a chunk at a time; the response is marked
+// with HTTPHeader and served as UTF-8 text. Other requests pass through
+// untouched, so existing services gain the wire format without changes.
+// Settings that cannot be streamed make transcoded requests fail with
+// status 500. Failures while encoding a response that has already started
+// are logged, as the status can no longer change.
+func WrapHandler(h http.Handler, c *Codec) http.Handler {
+	q := c.quiet()
+	q.frozen = true // Requests are served concurrently, and the copy is never reconfigured
+
+	var setupErr error
+	if err := q.checkStream(true); err != nil {
+		setupErr = fmt.Errorf("cannot transcode HTTP bodies: %w", err)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", HTTPHeader)
+		if !transcodeRequested(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if setupErr != nil {
+			http.Error(w, setupErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if r.Body != nil && r.Body != http.NoBody {
+			r2 := r.Clone(r.Context())
+			r2.Body = &decodedBody{Decoder: q.NewDecoder(r.Body, true), body: r.Body}
+			r2.ContentLength = -1
+			r2.Header.Del("Content-Length")
+			r = r2
+		}
+
+		ew := &encodingWriter{ResponseWriter: w, c: q}
+		defer func() {
+			if err := ew.close(); err != nil {
+				c.warnf("failed to encode the response to %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		}()
+		h.ServeHTTP(ew, r)
+	})
+}
+
+// transcodeRequested reports whether r asks for encoded bodies. A query
+// parameter without a value counts as true.
+func transcodeRequested(r *http.Request) bool {
+	if v := r.Header.Get(HTTPHeader); v != "" {
+		on, _ := strconv.ParseBool(v)
+		return on
+	}
+	query := r.URL.Query()
+	if !query.Has(HTTPQueryParam) {
+		return false
+	}
+	v := query.Get(HTTPQueryParam)
+	on, _ := strconv.ParseBool(v)
+	return v == "" || on
+}
+
+// decodedBody is a request body decoded from the encoded original
+type decodedBody struct {
+	*Decoder
+	body io.Closer
+}
+
+// Close stops decoding and closes the original body
+func (b *decodedBody) Close() error {
+	b.Decoder.Close()
+	return b.body.Close()
+}
+
+// encodingWriter is the http.ResponseWriter that WrapHandler passes on,
+// encoding the body written to it
+type encodingWriter struct {
+	http.ResponseWriter
+	c           *Codec
+	enc         *Encoder // Started by the first Write
+	wroteHeader bool
+}
+
+// WriteHeader marks the response as encoded text and sends the header
+func (w *encodingWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	if code >= 200 { // Informational responses may precede the final one
+		w.wroteHeader = true
+		h := w.Header()
+		h.Del("Content-Length") // The handler's length is that of the data
+		h.Set(HTTPHeader, "1")
+		if w.c.Format == FormatHTML {
+			h.Set("Content-Type", "text/html; charset=utf-8")
+		} else {
+			h.Set("Content-Type", "text/plain; charset=utf-8")
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write encodes p into the response body
+func (w *encodingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc == nil {
+		w.enc = w.c.NewEncoder(w.ResponseWriter, true)
+	}
+	return w.enc.Write(p)
+}
+
+// Unwrap returns the underlying writer, for http.ResponseController
+func (w *encodingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close writes the last of the encoded body
+func (w *encodingWriter) close() error {
+	if w.enc == nil {
+		return nil
+	}
+	return w.enc.Close()
+}
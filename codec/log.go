@@ -0,0 +1,129 @@
+package codec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// lineHandler is the slog.Handler behind NewLineHandler
+type lineHandler struct {
+	mu     *sync.Mutex // Shared by the handlers derived with WithAttrs and WithGroup
+	w      io.Writer
+	level  slog.Leveler
+	attrs  string // Preformatted " key=value" attributes
+	prefix string // Group name prefix for attribute keys
+}
+
+// NewLineHandler returns a slog.Handler that writes each record to w as
+// one plain line, the way the sinogram command prints its messages: the
+// message, with warnings and errors prefixed "Warning: " and "Error: ",
+// followed by any attributes as key=value. Records below level are
+// dropped; a nil level means slog.LevelInfo.
+func NewLineHandler(w io.Writer, level slog.Leveler) slog.Handler {
+	if level == nil {
+		level = slog.LevelInfo
+	}
+	return &lineHandler{mu: new(sync.Mutex), w: w, level: level}
+}
+
+// Enabled reports whether records at l are written
+func (h *lineHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+// Handle writes r as a line
+func (h *lineHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	switch {
+	case r.Level >= slog.LevelError:
+		b.WriteString("Error: ")
+	case r.Level >= slog.LevelWarn:
+		b.WriteString("Warning: ")
+	}
+	b.WriteString(r.Message)
+	b.WriteString(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&b, h.prefix, a)
+		return true
+	})
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+// WithAttrs returns a handler that adds attrs to every line
+func (h *lineHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var b strings.Builder
+	for _, a := range attrs {
+		writeAttr(&b, h.prefix, a)
+	}
+	h2 := *h
+	h2.attrs += b.String()
+	return &h2
+}
+
+// WithGroup returns a handler that qualifies later attribute keys with name
+func (h *lineHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.prefix += name + "."
+	return &h2
+}
+
+// writeAttr appends a as " key=value", flattening groups into dotted keys
+func writeAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			writeAttr(b, prefix, ga)
+		}
+		return
+	}
+	fmt.Fprintf(b, " %s%s=%s", prefix, a.Key, a.Value)
+}
+
+// defaultLogger is the logger NewCodec starts with
+func defaultLogger() *slog.Logger {
+	return slog.New(NewLineHandler(os.Stderr, nil))
+}
+
+// logf logs a progress message at info level, if the codec has a Logger
+func (c *Codec) logf(format string, args ...any) {
+	c.logAt(slog.LevelInfo, format, args...)
+}
+
+// warnf logs a warning, if the codec has a Logger
+func (c *Codec) warnf(format string, args ...any) {
+	c.logAt(slog.LevelWarn, format, args...)
+}
+
+// logAt logs a printf-style message at level
+func (c *Codec) logAt(level slog.Level, format string, args ...any) {
+	if c.Logger == nil || !c.Logger.Enabled(context.Background(), level) {
+		return
+	}
+	c.Logger.Log(context.Background(), level, fmt.Sprintf(format, args...))
+}
+
+// logLines logs each line of text as its own progress message
+func (c *Codec) logLines(text string) {
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		c.logf("%s", line)
+	}
+}
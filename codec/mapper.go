@@ -0,0 +1,193 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// Mapper assigns characters to base64 pairs. Encoding and decoding look up
+// every pair and character through it, so another strategy, such as
+// frequency-weighted, keyed or multi-script assignment, can be swapped in
+// with WithMapper without changing the codec. A Mapper must be one-to-one:
+// UnmapRune must return the pair MapPair gave the character to.
+type Mapper interface {
+	// MapPair returns the character pair stands for, or 0 if it has none.
+	// Pairs that are not two base64 alphabet characters have none.
+	MapPair(pair [2]byte) rune
+
+	// UnmapRune returns the pair r stands for, if any
+	UnmapRune(r rune) ([2]byte, bool)
+}
+
+// DictMapper is the Mapper built from a dictionary: its characters are
+// assigned to pairs in pair order, i.e. by the base64 alphabet position of
+// the first and then the second character.
+type DictMapper struct {
+	runes [MaxPairs]rune // Indexed by pair index, 0 when unmapped
+
+	// Dense reverse table for the decode hot loop: runeIndex[r-runeBase]
+	// holds the pair index + 1 of a mapped rune, or 0 when unmapped
+	runeBase  rune
+	runeIndex []uint16
+}
+
+// NewDictMapper assigns chars to pairs in pair order. Characters beyond
+// MaxPairs are not used. A character given twice stands for both its
+// pairs when encoding and decodes to the later one.
+func NewDictMapper(chars []rune) *DictMapper {
+	m := &DictMapper{}
+	copy(m.runes[:], chars)
+	m.indexRunes()
+	return m
+}
+
+// indexRunes builds the reverse table from runes. Where a character is
+// given twice, the later pair wins.
+func (m *DictMapper) indexRunes() {
+	lo, hi := rune(-1), rune(-1)
+	for _, r := range m.runes {
+		if r == 0 {
+			continue
+		}
+		if lo < 0 {
+			lo, hi = r, r
+		}
+		lo, hi = min(lo, r), max(hi, r)
+	}
+	if lo < 0 {
+		return
+	}
+
+	m.runeBase = lo
+	m.runeIndex = make([]uint16, hi-lo+1)
+	for idx, r := range m.runes {
+		if r != 0 {
+			m.runeIndex[r-lo] = uint16(idx + 1)
+		}
+	}
+}
+
+// MapPair returns the character assigned to pair
+func (m *DictMapper) MapPair(pair [2]byte) rune {
+	hi, lo := base64Positions[pair[0]], base64Positions[pair[1]]
+	if hi < 0 || lo < 0 {
+		return 0
+	}
+	return m.runes[int(hi)*64+int(lo)]
+}
+
+// UnmapRune returns the pair r is assigned to
+func (m *DictMapper) UnmapRune(r rune) ([2]byte, bool) {
+	off := r - m.runeBase
+	if off < 0 || int(off) >= len(m.runeIndex) || m.runeIndex[off] == 0 {
+		return [2]byte{}, false
+	}
+	return pairAt(int(m.runeIndex[off]) - 1), true
+}
+
+// base64Positions holds the alphabet position of each base64 byte, or -1
+var base64Positions = func() (positions [256]int8) {
+	for i := range positions {
+		positions[i] = -1
+	}
+	for i := 0; i < len(Base64Charset); i++ {
+		positions[Base64Charset[i]] = int8(i)
+	}
+	return positions
+}()
+
+// setMapper makes m the codec's mapping, dropping any error about the
+// mapping it replaces
+func (c *Codec) setMapper(m Mapper) {
+	c.mapper, c.mappingErr = m, nil
+	c.mapped = 0
+	for i := 0; i < MaxPairs; i++ {
+		if m.MapPair(pairAt(i)) != 0 {
+			c.mapped++
+		}
+	}
+}
+
+// Mapper returns the codec's mapping
+func (c *Codec) Mapper() Mapper {
+	return c.mapper
+}
+
+// isMapped reports whether r stands for a pair
+func (c *Codec) isMapped(r rune) bool {
+	_, ok := c.mapper.UnmapRune(r)
+	return ok
+}
+
+// codecBinary is the gob form of a codec's mapping, written by
+// MarshalBinary
+type codecBinary struct {
+	Version int
+	Runes   []rune // Indexed by pair index, 0 when unmapped
+}
+
+// codecBinaryVersion changes whenever codecBinary does
+const codecBinaryVersion = 1
+
+// MarshalBinary serializes the codec's built mapping, so it can be cached
+// or sent elsewhere and restored with UnmarshalBinary without parsing the
+// dictionary again. Settings are not included; only the pair table is.
+func (c *Codec) MarshalBinary() ([]byte, error) {
+	if c.mappingErr != nil {
+		return nil, c.mappingErr
+	}
+
+	cb := codecBinary{Version: codecBinaryVersion, Runes: make([]rune, MaxPairs)}
+	for i := range cb.Runes {
+		cb.Runes[i] = c.mapper.MapPair(pairAt(i))
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cb); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the codec's mapping with one serialized by
+// MarshalBinary, as loading a dictionary would. Like LoadDictionary it
+// fails with ErrFrozen on a frozen codec, and under StrictDict with a
+// mapping that is not one-to-one.
+func (c *Codec) UnmarshalBinary(data []byte) error {
+	if c.frozen {
+		return ErrFrozen
+	}
+
+	var cb codecBinary
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&cb); err != nil {
+		return &DictionaryError{fmt.Errorf("failed to read mapping: %w", err)}
+	}
+	if cb.Version != codecBinaryVersion {
+		return &DictionaryError{fmt.Errorf("unsupported mapping version %d", cb.Version)}
+	}
+	if len(cb.Runes) != MaxPairs {
+		return &DictionaryError{fmt.Errorf("mapping has %d pairs, want %d", len(cb.Runes), MaxPairs)}
+	}
+
+	m := &DictMapper{}
+	for i, r := range cb.Runes {
+		if r != 0 && !usableChar(r) {
+			pair := pairAt(i)
+			return &DictionaryError{fmt.Errorf("mapping assigns unusable character %q to pair %s", r, pair[:])}
+		}
+		m.runes[i] = r
+	}
+	m.indexRunes()
+
+	c.setMapper(m)
+	if err := c.checkMapping(); err != nil {
+		return &DictionaryError{err}
+	}
+	return nil
+}
+
+// pairAt returns the pair with index idx (first*64 + second alphabet position)
+func pairAt(idx int) [2]byte {
+	return [2]byte{Base64Charset[idx/64], Base64Charset[idx%64]}
+}
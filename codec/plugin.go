@@ -0,0 +1,49 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// The operations a plugin is asked to perform, appended to its arguments
+const (
+	pluginEncode = "encode"
+	pluginDecode = "decode"
+)
+
+// runPlugin passes data through the plugin command for op and returns its
+// output
+func (c *Codec) runPlugin(op string, data []byte) ([]byte, error) {
+	args := append(c.Plugin[1:len(c.Plugin):len(c.Plugin)], op)
+	cmd := exec.Command(c.Plugin[0], args...)
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if i := strings.LastIndexByte(msg, '\n'); i >= 0 {
+			msg = msg[i+1:]
+		}
+		if msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("plugin %s failed to %s: %w", c.pluginName(), op, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// pluginName is the name the header records for the plugin: the base name
+// of its command, with spaces replaced so the header stays one field
+func (c *Codec) pluginName() string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return '_'
+		}
+		return r
+	}, filepath.Base(c.Plugin[0]))
+}
@@ -0,0 +1,60 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// progressReader reports the bytes read through it to Codec.Progress
+type progressReader struct {
+	r           io.Reader
+	done, total int64
+	report      func(done, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.done += int64(n)
+		p.report(p.done, p.total)
+	}
+	return n, err
+}
+
+// trackProgress returns r, the content of the input at path, reporting
+// its reads to Progress when that is set
+func (c *Codec) trackProgress(r io.Reader, path string) io.Reader {
+	if c.Progress == nil {
+		return r
+	}
+	total := int64(-1)
+	if path != StdinPath {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			total = info.Size()
+		}
+	}
+	c.Progress(0, total)
+	return &progressReader{r: r, total: total, report: c.Progress}
+}
+
+// readInput is ReadInput, reporting its progress
+func (c *Codec) readInput(path string) ([]byte, error) {
+	if c.Progress == nil {
+		return ReadInput(path)
+	}
+
+	in, err := OpenInput(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	r := c.trackProgress(in, path)
+	var buf bytes.Buffer
+	if total := r.(*progressReader).total; total > 0 {
+		buf.Grow(int(total) + bytes.MinRead)
+	}
+	_, err = buf.ReadFrom(r)
+	return buf.Bytes(), err
+}
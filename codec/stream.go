@@ -0,0 +1,1014 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// streamChunkSize is how many input bytes streaming reads at a time. It is
+// a multiple of 6 so every chunk splits into whole base64 groups (3 bytes)
+// and whole raw pairs (2 bytes).
+const streamChunkSize = 6 * 32 * 1024
+
+// shouldStream reports whether an input exceeds MaxMemory and must be
+// processed in chunks. Standard input has no known size, so it always
+// streams once a limit is set.
+func (c *Codec) shouldStream(inputPath string) bool {
+	if c.MaxMemory <= 0 {
+		return false
+	}
+	if inputPath == StdinPath {
+		return true
+	}
+
+	info, err := os.Stat(inputPath)
+	return err == nil && info.Size() > c.MaxMemory
+}
+
+// OpenInput opens an input file, or standard input when path is "@-"
+func OpenInput(path string) (io.ReadCloser, error) {
+	if path == StdinPath {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// streamFile runs a streaming transform from an input path to an output file
+func streamFile(inputPath, outputPath string, transform func(io.Reader, io.Writer) error) error {
+	in, err := OpenInput(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+	defer in.Close()
+
+	return WriteAtomic(outputPath, func(w io.Writer) error {
+		return transform(in, w)
+	})
+}
+
+// EncodeLines encodes each line of r on its own and writes it to w as one
+// line, as soon as it is read, so a growing log can be followed through
+// the encoding. Each line is a complete base64 text with its own padding.
+func (c *Codec) EncodeLines(r io.Reader, w io.Writer, useBase64 bool) error {
+	if err := c.checkLineMode(useBase64); err != nil {
+		return err
+	}
+	return eachLine(r, w, func(line string) (string, error) {
+		return c.EncodeString(line, useBase64)
+	})
+}
+
+// DecodeLines reverses EncodeLines, decoding each line of r on its own
+func (c *Codec) DecodeLines(r io.Reader, w io.Writer, useBase64 bool) error {
+	return eachLine(r, w, func(line string) (string, error) {
+		return c.DecodeString(line, useBase64)
+	})
+}
+
+// checkLineMode rejects settings whose output would not fit on one line
+func (c *Codec) checkLineMode(useBase64 bool) error {
+	switch {
+	case c.Format == FormatHTML:
+		return fmt.Errorf("line mode writes plain text and cannot use -format %s", FormatHTML)
+	case c.mime(useBase64):
+		return fmt.Errorf("line mode cannot use -b64-variant %s, whose line breaks would split lines", B64MIME)
+	case c.Checksum || c.Limit > 0 || c.header(useBase64, nil, 0, 0, nil) != nil:
+		return fmt.Errorf("line mode cannot use options that write a header line")
+	}
+	return nil
+}
+
+// eachLine applies transform to every line of r, writing each result to w
+// followed by a newline before reading the next
+func eachLine(r io.Reader, w io.Writer, transform func(string) (string, error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+
+	for n := 1; scanner.Scan(); n++ {
+		result, err := transform(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n, err)
+		}
+		if _, err := io.WriteString(w, result+"\n"); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return fmt.Errorf("a line is longer than %d bytes", maxLineLength)
+		}
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data without ever leaving a partial file
+func writeFileAtomic(path string, data []byte) error {
+	return WriteAtomic(path, func(w io.Writer) error {
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+		return nil
+	})
+}
+
+// pendingTemps holds the temporary files of the WriteAtomic calls in
+// progress, for RemovePendingTemps
+var pendingTemps = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: map[string]bool{}}
+
+// RemovePendingTemps removes the temporary files of the WriteAtomic calls
+// still in progress, which then fail. A program that exits on a signal
+// calls it first, so that an interrupted write leaves nothing behind.
+func RemovePendingTemps() {
+	pendingTemps.Lock()
+	defer pendingTemps.Unlock()
+	for path := range pendingTemps.paths {
+		os.Remove(path)
+		delete(pendingTemps.paths, path)
+	}
+}
+
+// WriteAtomic runs write against a temporary file in path's directory and
+// renames it over path only once everything succeeded, so a failure midway
+// leaves any existing file untouched and no partial file behind. An
+// existing file's permissions are kept; a new file gets 0644 less the
+// umask. Devices and pipes cannot be
+// replaced and are written directly, as is standard output when path is
+// "-".
+func WriteAtomic(path string, write func(io.Writer) error) error {
+	if path == StdoutPath {
+		return write(os.Stdout)
+	}
+
+	var perm fs.FileMode // Left as createTemp made it unless path exists
+	if info, err := os.Stat(path); err == nil {
+		if !info.Mode().IsRegular() {
+			return writeDirect(path, write)
+		}
+		perm = info.Mode().Perm()
+	}
+
+	f, err := createTemp(path)
+	if err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	tmp := f.Name()
+	pendingTemps.Lock()
+	pendingTemps.paths[tmp] = true
+	pendingTemps.Unlock()
+	defer func() {
+		pendingTemps.Lock()
+		delete(pendingTemps.paths, tmp)
+		pendingTemps.Unlock()
+	}()
+
+	err = write(f)
+	if err == nil && perm != 0 {
+		if err = f.Chmod(perm); err != nil {
+			err = fmt.Errorf("failed to write output: %w", err)
+		}
+	}
+	// Some filesystems report a full disk only when the data is flushed,
+	// which must happen before the rename makes the file visible
+	if err == nil {
+		if err = f.Sync(); err != nil {
+			err = fmt.Errorf("failed to write output: %w", err)
+		}
+	}
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write output: %w", closeErr)
+	}
+	if err == nil {
+		if err = os.Rename(tmp, path); err != nil {
+			err = fmt.Errorf("failed to write output: %w", err)
+		}
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// createTemp creates a new temporary file next to path. Unlike
+// os.CreateTemp, which uses mode 0600, it creates the file with mode 0644
+// less the umask, as os.WriteFile would create path itself.
+func createTemp(path string) (*os.File, error) {
+	prefix := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	for {
+		f, err := os.OpenFile(prefix+strconv.FormatUint(uint64(rand.Uint32()), 10),
+			os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, err
+		}
+	}
+}
+
+// writeDirect runs write against path opened in place
+func writeDirect(path string, write func(io.Writer) error) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (c *Codec) encodeFileStream(inputPath, outputPath string, useBase64 bool) (EncodeResult, error) {
+	defer c.logTiming("stream encode", time.Now())
+
+	if c.passthrough(useBase64) {
+		return EncodeResult{}, fmt.Errorf("-passthrough-ascii cannot be used when streaming")
+	}
+	if len(c.Plugin) > 0 {
+		return EncodeResult{}, fmt.Errorf("-plugin cannot be used when streaming")
+	}
+
+	// The header precedes the body, so a checksum needs a first pass over the input
+	var sum []byte
+	if c.Checksum {
+		if inputPath == StdinPath {
+			return EncodeResult{}, fmt.Errorf("-checksum cannot be used when streaming standard input")
+		}
+		var err error
+		if sum, err = fileSHA256(inputPath); err != nil {
+			return EncodeResult{}, fmt.Errorf("failed to read input: %w", err)
+		}
+	}
+
+	var salt []byte
+	if c.salted(useBase64) {
+		var err error
+		if salt, err = newSalt(c.Salt); err != nil {
+			return EncodeResult{}, err
+		}
+	}
+
+	// Likewise the length prefix and alignment padding depend on the input size
+	var prefix, padding []byte
+	var length int64
+	if c.framed(useBase64) || c.aligned(useBase64) {
+		if inputPath == StdinPath {
+			return EncodeResult{}, fmt.Errorf("-frame, -align3 and base64 -pure cannot be used when streaming standard input")
+		}
+		info, err := os.Stat(inputPath)
+		if err != nil {
+			return EncodeResult{}, fmt.Errorf("failed to read input: %w", err)
+		}
+		if c.framed(useBase64) {
+			prefix = lengthPrefix(info.Size())
+		}
+		length = int64(len(salt)+len(prefix)) + info.Size()
+		if c.aligned(useBase64) {
+			padding = make([]byte, alignPadding(length))
+		}
+	}
+	header := c.header(useBase64, sum, length, 0, c.inputInfo(inputPath))
+
+	// The output is verified as it is written, before it replaces the target
+	if c.Verify && c.Format == FormatHTML {
+		return EncodeResult{}, fmt.Errorf("-verify cannot check -format %s output when streaming", FormatHTML)
+	}
+
+	var result EncodeResult
+	err := streamFile(inputPath, outputPath, func(r io.Reader, w io.Writer) error {
+		var v *streamVerifier
+		if r = c.trackProgress(r, inputPath); c.Verify {
+			v = c.newStreamVerifier(useBase64)
+			r, w = v.input(r), io.MultiWriter(w, v)
+		}
+
+		var err error
+		r = io.MultiReader(bytes.NewReader(salt), bytes.NewReader(prefix), r, bytes.NewReader(padding))
+		result, err = c.encodeStream(r, w, useBase64, header)
+		result.InputBytes -= int64(len(salt) + len(prefix) + len(padding))
+		if v != nil {
+			err = v.finish(result.InputBytes, err)
+		}
+		return err
+	})
+	if err != nil {
+		return EncodeResult{}, err
+	}
+	if !c.frozen {
+		c.Stats.InputSize = result.InputBytes
+	}
+	return result, nil
+}
+
+// EncodeStream encodes r to w one chunk at a time, holding only a chunk
+// in memory. Settings that need the input's size or content before the
+// body is written (Checksum, Frame, Align3, base64 Pure and
+// PassthroughASCII) are refused, as the input is read only once.
+func (c *Codec) EncodeStream(r io.Reader, w io.Writer, useBase64 bool) error {
+	if err := c.checkStream(useBase64); err != nil {
+		return err
+	}
+
+	var salt []byte
+	if c.salted(useBase64) {
+		var err error
+		if salt, err = newSalt(c.Salt); err != nil {
+			return err
+		}
+	}
+
+	_, err := c.encodeStream(io.MultiReader(bytes.NewReader(salt), r), w, useBase64, c.header(useBase64, nil, 0, 0, nil))
+	return err
+}
+
+// checkStream rejects settings that EncodeStream cannot honour
+func (c *Codec) checkStream(useBase64 bool) error {
+	switch {
+	case c.passthrough(useBase64):
+		return fmt.Errorf("-passthrough-ascii cannot be used when streaming")
+	case c.Checksum:
+		return fmt.Errorf("-checksum cannot be used when streaming a reader")
+	case c.framed(useBase64) || c.aligned(useBase64):
+		return fmt.Errorf("-frame, -align3 and base64 -pure cannot be used when streaming a reader")
+	case len(c.Plugin) > 0:
+		return fmt.Errorf("-plugin cannot be used when streaming a reader")
+	}
+	return nil
+}
+
+// encodeStream encodes r to w one chunk at a time, producing the same
+// output as Encode while holding only a chunk in memory. header, if not
+// nil, is written ahead of the body. Its result counts every byte read,
+// salt and length prefix included.
+func (c *Codec) encodeStream(r io.Reader, w io.Writer, useBase64 bool, header *Header) (EncodeResult, error) {
+	if c.mappingErr != nil {
+		return EncodeResult{}, c.mappingErr
+	}
+	if err := c.checkHeaderVersion(); err != nil {
+		return EncodeResult{}, err
+	}
+	if err := c.checkPlaceholderChar(); err != nil {
+		return EncodeResult{}, err
+	}
+	c.beginStats()
+	defer c.discardStats()
+	bw := bufio.NewWriter(w)
+	out := &countingWriter{w: bw}
+
+	io.WriteString(out, c.formatPrefix(useBase64))
+	if header != nil {
+		io.WriteString(out, c.formatText(header.String()))
+	}
+
+	chunk := make([]byte, streamChunkSize)
+	var inputSize int64
+	var result strings.Builder
+	var tally pairTally
+
+	// Raw mode validates UTF-8 across chunk boundaries by carrying any
+	// incomplete trailing sequence into the next check
+	validUTF8 := true
+	var check []byte
+
+	col := 0      // Length of the current MIME line
+	spaceCol := 0 // Characters since the last separator
+	var runesOut int64
+	var checked int64 // Raw input bytes validated so far
+	collisions := 0
+	var last string // Last text written, which bodyEnd looks at
+
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			data := chunk[:n]
+			inputSize += int64(n)
+
+			if !useBase64 && validUTF8 {
+				check = append(check, data...)
+				tail := incompleteUTF8Tail(check)
+				complete := check[:len(check)-tail]
+				validUTF8 = utf8.Valid(complete)
+				if c.AssumeUTF8 {
+					if !validUTF8 {
+						return EncodeResult{}, invalidUTF8Error(checked + int64(invalidUTF8Offset(complete)))
+					}
+					collisions += c.rawCollisions(complete)
+				}
+				checked += int64(len(complete))
+				check = append(check[:0], check[len(check)-tail:]...)
+			}
+
+			text := PairText(data, useBase64)
+			if c.mime(useBase64) {
+				text = wrapMIME(text, &col)
+			}
+
+			result.Reset()
+			chunkTally := c.mapPairs(&result, text)
+			if c.mime(useBase64) {
+				chunkTally.pairs -= strings.Count(text, "\r\n") // Line breaks are not data
+			}
+			tally.add(chunkTally)
+			if tally.unmapped > 0 && c.UnmappedPolicy == UnmappedError {
+				return EncodeResult{}, c.finishEncode(tally, false)
+			}
+			if c.Pure {
+				if err := c.checkPure(result.String(), runesOut); err != nil {
+					return EncodeResult{}, err
+				}
+				runesOut += int64(utf8.RuneCountInString(result.String()))
+			}
+			text = result.String()
+			if c.Space > 0 {
+				text = insertSpaces(text, c.Space, c.SpaceChar, &spaceCol)
+			}
+			io.WriteString(out, c.formatText(text))
+			if text != "" {
+				last = text
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return EncodeResult{}, fmt.Errorf("failed to read input: %w", err)
+		}
+	}
+
+	if !useBase64 && c.AssumeUTF8 {
+		if len(check) > 0 {
+			return EncodeResult{}, invalidUTF8Error(checked)
+		}
+		c.warnCollisions(collisions)
+	}
+
+	if c.literalBreaks(useBase64) {
+		io.WriteString(out, c.formatText(bodyEnd(last)))
+	}
+	io.WriteString(out, c.formatSuffix())
+	if err := bw.Flush(); err != nil {
+		return EncodeResult{}, fmt.Errorf("failed to write output: %w", err)
+	}
+
+	if err := c.finishEncode(tally, !useBase64 && (!validUTF8 || len(check) > 0)); err != nil {
+		return EncodeResult{}, err
+	}
+	c.endStats(inputSize, out.n)
+	return newEncodeResult(inputSize, out.n, tally), nil
+}
+
+// incompleteUTF8Tail returns how many trailing bytes of b start a UTF-8
+// sequence that is cut off at the end of b
+// invalidUTF8Offset returns the offset of the first byte of b that is not
+// part of valid UTF-8, or -1 if b is valid
+func invalidUTF8Offset(b []byte) int {
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size <= 1 {
+			return i
+		}
+		i += size
+	}
+	return -1
+}
+
+func invalidUTF8Error(offset int64) error {
+	return fmt.Errorf("input is not valid UTF-8 at byte %d; raw mode is for text, use base64 for binary data", offset)
+}
+
+// rawCollisions counts the characters of raw-mode text that are also
+// dictionary characters
+func (c *Codec) rawCollisions(text []byte) int {
+	collisions := 0
+	for i := 0; i < len(text); {
+		r, size := rune(text[i]), 1
+		if r >= utf8.RuneSelf {
+			r, size = utf8.DecodeRune(text[i:])
+			if c.isMapped(r) {
+				collisions++
+			}
+		}
+		i += size
+	}
+	return collisions
+}
+
+func (c *Codec) warnCollisions(collisions int) {
+	if collisions > 0 {
+		c.warnf("%d input characters are dictionary characters; decoding will turn them into pairs", collisions)
+	}
+}
+
+func incompleteUTF8Tail(b []byte) int {
+	for i := 1; i <= utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if utf8.FullRune(b[len(b)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
+
+func (c *Codec) decodeFileStream(inputPath, outputPath string, useBase64 bool) (DecodeResult, *Header, error) {
+	if c.Trim {
+		return DecodeResult{}, nil, fmt.Errorf("-trim needs the whole input and cannot be used when streaming")
+	}
+	if c.Recover {
+		return DecodeResult{}, nil, fmt.Errorf("-recover needs the whole input and cannot be used when streaming")
+	}
+
+	defer c.logTiming("stream decode", time.Now())
+
+	var header *Header
+	var result DecodeResult
+	err := streamFile(inputPath, outputPath, func(r io.Reader, w io.Writer) error {
+		in := &countingReader{r: c.trackProgress(r, inputPath)}
+		written, h, err := c.decodeStream(in, w, useBase64)
+		c.countDecode(written, err)
+		header, result = h, DecodeResult{InputBytes: in.n, OutputBytes: written}
+		return err
+	})
+	if err != nil {
+		return DecodeResult{}, nil, fmt.Errorf("decode failed: %w", err)
+	}
+	return result, header, nil
+}
+
+// DecodeTo decodes encoded text to w in chunks, writing output as it is
+// produced so the decoded data is never held in memory as a whole. Headers,
+// segments and checksums are handled as by Decode, but a checksum mismatch
+// is only detected after the segment's bytes have reached w.
+func (c *Codec) DecodeTo(encoded string, w io.Writer, useBase64 bool) error {
+	if c.Trim {
+		encoded = trimWrapping(encoded)
+	}
+
+	written, _, err := c.decodeStream(strings.NewReader(encoded), w, useBase64)
+	c.countDecode(written, err)
+	return err
+}
+
+// DecodeStream decodes encoded text read from r to w as it arrives, like
+// DecodeTo. Reads may split the text anywhere, even inside a multi-byte
+// character: incomplete characters and base64 groups are held back until
+// the rest arrives, so the output does not depend on how r chunks its
+// data. Trim is not applied, as it needs the whole input.
+func (c *Codec) DecodeStream(r io.Reader, w io.Writer, useBase64 bool) error {
+	written, _, err := c.decodeStream(r, w, useBase64)
+	c.countDecode(written, err)
+	return err
+}
+
+// EncodeContext is EncodeStream stopping at the next chunk once ctx is
+// done, returning an error that wraps ctx.Err(). Output already written
+// to w is left as it is. A read that blocks is not interrupted.
+func (c *Codec) EncodeContext(ctx context.Context, r io.Reader, w io.Writer, useBase64 bool) error {
+	return c.EncodeStream(&contextReader{ctx: ctx, r: r}, w, useBase64)
+}
+
+// DecodeContext is DecodeStream stopping at the next chunk once ctx is
+// done, in the same way as EncodeContext
+func (c *Codec) DecodeContext(ctx context.Context, r io.Reader, w io.Writer, useBase64 bool) error {
+	return c.DecodeStream(&contextReader{ctx: ctx, r: r}, w, useBase64)
+}
+
+// contextReader fails reads once its context is done. Streams read a
+// chunk at a time, so this is checked between chunks.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// Encoder is an io.WriteCloser that encodes the data written to it and
+// writes the encoded text to an underlying writer as it goes. Close must
+// be called to flush the final characters and learn whether encoding
+// succeeded.
+type Encoder struct {
+	pw   *io.PipeWriter
+	done chan error
+
+	closeOnce sync.Once
+	err       error // Returned by every Close
+}
+
+// NewEncoder returns an Encoder writing to w. It encodes like EncodeStream,
+// so the same settings are refused, which Write then reports. Unless it is
+// frozen, the codec must not be used for anything else until the Encoder
+// is closed.
+func (c *Codec) NewEncoder(w io.Writer, useBase64 bool) *Encoder {
+	pr, pw := io.Pipe()
+	e := &Encoder{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := c.EncodeStream(pr, w, useBase64)
+		pr.CloseWithError(err) // Fails further writes once encoding stops
+		e.done <- err
+	}()
+	return e
+}
+
+// Write encodes p, returning an error once encoding has failed
+func (e *Encoder) Write(p []byte) (int, error) {
+	return e.pw.Write(p)
+}
+
+// Close ends the input, waits for the rest of the encoded text to be
+// written and returns any encoding error. Later calls return the same
+// error.
+func (e *Encoder) Close() error {
+	e.closeOnce.Do(func() {
+		e.pw.Close()
+		e.err = <-e.done
+	})
+	return e.err
+}
+
+// Decoder is an io.ReadCloser that reads encoded text from an underlying
+// reader and yields the decoded data as it arrives. Reads return the
+// decoding error, such as a checksum mismatch, in place of io.EOF.
+type Decoder struct {
+	pr *io.PipeReader
+}
+
+// NewDecoder returns a Decoder reading from r. It decodes like
+// DecodeStream. Unless it is frozen, the codec must not be used for
+// anything else until the Decoder has been read to the end or closed.
+func (c *Codec) NewDecoder(r io.Reader, useBase64 bool) *Decoder {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(c.DecodeStream(r, pw, useBase64))
+	}()
+	return &Decoder{pr: pr}
+}
+
+// Read reads decoded data
+func (d *Decoder) Read(p []byte) (int, error) {
+	return d.pr.Read(p)
+}
+
+// Close stops decoding; data not yet read is discarded
+func (d *Decoder) Close() error {
+	return d.pr.Close()
+}
+
+// decodeStream decodes r to w one chunk at a time, holding only a chunk of
+// the encoded text in memory. Like decodeWithHeader it handles appended
+// segments and verifies recorded checksums, each once its segment has been
+// written. It returns the number of bytes written and the header
+// describing the whole output.
+func (c *Codec) decodeStream(r io.Reader, w io.Writer, useBase64 bool) (int64, *Header, error) {
+	br := bufio.NewReaderSize(r, streamChunkSize)
+	bw := bufio.NewWriter(w)
+	total := sha256.New()
+	out := &countingWriter{w: io.MultiWriter(bw, total)}
+
+	var headers []*Header
+	for {
+		header, err := readStreamHeader(br)
+		if err != nil {
+			return out.n, nil, segmentError(len(headers)+1, err)
+		}
+		if header == nil && len(headers) > 0 {
+			break // The previous segment ended at EOF
+		}
+
+		dc, b64, err := c.forHeader(header, useBase64)
+		if err != nil {
+			return out.n, nil, segmentError(len(headers)+1, err)
+		}
+		if dc.passthrough(b64) {
+			return out.n, nil, segmentError(len(headers)+1,
+				fmt.Errorf("passthrough input cannot be decoded when streaming"))
+		}
+		if header != nil && header.Plugin != "" {
+			return out.n, nil, segmentError(len(headers)+1,
+				fmt.Errorf("plugin output cannot be decoded when streaming"))
+		}
+
+		// Only header-framed bodies can be followed by another segment
+		body := io.Reader(br)
+		if header != nil {
+			body = &segmentReader{br: br}
+		}
+		if dc.literalBreaks(b64) {
+			body = &trimEndReader{br: bufio.NewReader(body)}
+		}
+		if header != nil && header.Space > 0 {
+			body = &unspaceReader{br: bufio.NewReader(body), every: header.Space, sep: header.SpaceChar, skipBreaks: b64}
+		}
+
+		hash := sha256.New()
+		var bodyOut io.Writer = io.MultiWriter(out, hash)
+		var frame, align *frameWriter
+		if header != nil && header.Frame {
+			frame = &frameWriter{w: bodyOut}
+			bodyOut = frame
+		}
+		var salt *skipWriter
+		if header != nil && header.Salt > 0 {
+			salt = &skipWriter{w: bodyOut, skip: header.Salt}
+			bodyOut = salt
+		}
+		if header != nil && header.Align3 {
+			align = &frameWriter{w: bodyOut, length: uint64(header.Length), haveFrame: true}
+			bodyOut = align
+		}
+
+		if err := dc.decodeBody(body, bodyOut, b64); err != nil {
+			return out.n, nil, segmentError(len(headers)+1, err)
+		}
+		if salt != nil && salt.skip > 0 {
+			return out.n, nil, segmentError(len(headers)+1,
+				truncatedError(uint64(header.Salt), uint64(header.Salt-salt.skip)))
+		}
+		for _, fw := range []*frameWriter{align, frame} {
+			if fw == nil {
+				continue
+			}
+			if err := fw.finish(); err != nil {
+				return out.n, nil, segmentError(len(headers)+1, err)
+			}
+		}
+		if header != nil && header.SHA256 != nil && !bytes.Equal(hash.Sum(nil), header.SHA256) {
+			return out.n, nil, segmentError(len(headers)+1, ErrChecksumMismatch)
+		}
+
+		headers = append(headers, header)
+		if header == nil {
+			break
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return out.n, nil, fmt.Errorf("failed to write output: %w", err)
+	}
+
+	if len(headers) == 1 {
+		return out.n, headers[0], nil
+	}
+
+	c.logf("Decoded %d segments", len(headers))
+	return out.n, combinedHeader(headers, total.Sum(nil)), nil
+}
+
+// readStreamHeader consumes a header line if the stream is positioned at
+// one, returning nil otherwise
+func readStreamHeader(br *bufio.Reader) (*Header, error) {
+	if prefix, _ := br.Peek(headerPrefixLen); !isHeaderPrefix(string(prefix)) {
+		return nil, nil
+	}
+
+	line, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read input: %w", err)
+	}
+
+	header, _, err := parseHeader(line)
+	return header, err
+}
+
+// segmentReader reads a segment body from br, reporting EOF where the next
+// segment's header begins and leaving that header unread
+type segmentReader struct {
+	br *bufio.Reader
+}
+
+func (s *segmentReader) Read(p []byte) (int, error) {
+	// Look far enough ahead to see a header starting anywhere within p
+	buf, err := s.br.Peek(min(len(p)+headerPrefixLen-1, s.br.Size()))
+	if len(buf) == 0 {
+		return 0, err
+	}
+
+	if idx := indexHeaderBytes(buf); idx >= 0 {
+		if idx == 0 {
+			return 0, io.EOF
+		}
+		buf = buf[:idx]
+	} else if err == nil {
+		// More input follows: hold back bytes that may begin a header
+		buf = buf[:len(buf)-headerPrefixLen+1]
+	}
+
+	n := copy(p, buf)
+	s.br.Discard(n)
+	return n, nil
+}
+
+// decodeBody decodes one segment body from r to w in chunks
+func (c *Codec) decodeBody(r io.Reader, w io.Writer, useBase64 bool) error {
+	chunk := make([]byte, streamChunkSize)
+	carry := 0 // Unprocessed bytes kept at the front of chunk
+	var runesDone int64
+
+	for {
+		n, err := io.ReadFull(r, chunk[carry:])
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if errors.Is(err, ErrBadSpacing) {
+			return err
+		}
+		if err != nil && !eof {
+			return fmt.Errorf("failed to read input: %w", err)
+		}
+
+		data := chunk[:carry+n]
+		cut, runes := c.streamCut(data, useBase64, eof)
+		text := string(data[:cut])
+
+		if err := c.checkPlaceholder(text, runesDone); err != nil {
+			return err
+		}
+		if useBase64 && c.StrictDecode {
+			if err := c.checkStrict(text, runesDone); err != nil {
+				return err
+			}
+		}
+
+		decoded := c.unmapPairs(text)
+		if useBase64 {
+			if decoded, err = c.decodeBase64(text, decoded, runesDone); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(decoded); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
+		}
+
+		runesDone += runes
+		carry = copy(chunk, data[cut:])
+		if eof {
+			return nil
+		}
+	}
+}
+
+// ScanSinogram is a bufio.SplitFunc that splits encoded text into tokens
+// that each decode on their own with DecodeBytes. A segment starting with a
+// header is one token, running to the next header or the end of input,
+// since its header describes the whole body; the Scanner's buffer must be
+// large enough for it (see bufio.Scanner.Buffer). Text without a header is
+// cut wherever the buffered input allows, never inside a character and, in
+// base64 mode, only after a whole number of base64 groups.
+func (c *Codec) ScanSinogram(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if len(data) >= headerPrefixLen && isHeaderPrefix(string(data[:headerPrefixLen])) {
+		if next := indexHeaderBytes(data[headerPrefixLen:]); next >= 0 {
+			n := headerPrefixLen + next
+			return n, data[:n], nil
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+	if !atEOF && len(data) < headerPrefixLen && mayStartHeader(data) {
+		return 0, nil, nil // May be the start of a header
+	}
+
+	cut, _ := c.groupCut(data, c.Base64, atEOF)
+	if cut == 0 {
+		return 0, nil, nil
+	}
+	return cut, data[:cut], nil
+}
+
+// streamCut picks how much of a chunk of encoded text to decode now. The
+// cut never splits a character, and in base64 mode it falls where the
+// reconstructed base64 is a whole number of 4-byte groups so each piece
+// decodes independently. At EOF everything left is taken. It returns the
+// cut and the number of characters before it.
+func (c *Codec) streamCut(data []byte, useBase64 bool, eof bool) (int, int64) {
+	cut, runes := c.groupCut(data, useBase64, eof)
+
+	// A full chunk without a group boundary is not valid base64; decode it
+	// anyway so the error is reported instead of waiting for more input
+	if cut == 0 && len(data) == cap(data) {
+		return len(data), int64(utf8.RuneCount(data))
+	}
+
+	return cut, runes
+}
+
+// groupCut returns the last place data can be cut for streamCut, and the
+// number of characters before it, or 0 if there is none yet
+func (c *Codec) groupCut(data []byte, useBase64 bool, eof bool) (int, int64) {
+	cut, cutRunes := 0, int64(0)
+	produced, runes := 0, int64(0)
+
+	for i := 0; i < len(data); {
+		if !eof && !utf8.FullRune(data[i:]) {
+			break
+		}
+
+		r, size := utf8.DecodeRune(data[i:])
+		switch {
+		case c.isMapped(r):
+			produced += 2
+		case isBase64LineBreak(r):
+			// Skipped by the base64 decoder, so not part of any group
+		default:
+			produced += size
+		}
+		i += size
+		runes++
+
+		if eof || !useBase64 || produced%4 == 0 {
+			cut, cutRunes = i, runes
+		}
+	}
+
+	return cut, cutRunes
+}
+
+// trimEndReader reads a body with literal line breaks without the one
+// line break at its end that decoding drops (see Codec.literalBreaks).
+// The last two bytes read are held back until it is known whether they
+// end the body.
+type trimEndReader struct {
+	br   *bufio.Reader
+	done bool
+}
+
+func (t *trimEndReader) Read(p []byte) (int, error) {
+	if t.done {
+		return 0, io.EOF
+	}
+	want := min(len(p), t.br.Size()-2) + 2
+	peek, err := t.br.Peek(want)
+	if err == nil {
+		n := copy(p, peek[:want-2])
+		t.br.Discard(n)
+		return n, nil
+	}
+	if err != io.EOF {
+		return 0, err
+	}
+
+	rest := trimBodyEnd(string(peek))
+	n := copy(p, rest)
+	if n < len(rest) {
+		t.br.Discard(n)
+		return n, nil
+	}
+	t.br.Discard(len(peek))
+	t.done = true
+	return n, io.EOF
+}
@@ -0,0 +1,216 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// Close is often both deferred and called explicitly
+func TestEncoderCloseTwice(t *testing.T) {
+	c := newTestCodec(t, fullDict)
+	var buf bytes.Buffer
+	enc := c.NewEncoder(&buf, true)
+	if _, err := enc.Write([]byte("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan [2]error)
+	go func() {
+		first := enc.Close()
+		done <- [2]error{first, enc.Close()}
+	}()
+	select {
+	case errs := <-done:
+		if errs[0] != nil || errs[1] != nil {
+			t.Fatalf("Close: got %v, then %v", errs[0], errs[1])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second Close did not return")
+	}
+
+	decoded, err := c.DecodeString(buf.String(), true)
+	if err != nil || decoded != "hello, world" {
+		t.Fatalf("DecodeString: got %q, %v", decoded, err)
+	}
+}
+
+// peakHeap returns the most heap seen in use while running fn, sampled
+// every 100µs with garbage collection made eager so that it counts live
+// data rather than garbage
+func peakHeap(fn func()) uint64 {
+	defer debug.SetGCPercent(debug.SetGCPercent(5))
+	runtime.GC()
+
+	done := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		var most uint64
+		var m runtime.MemStats
+		ticker := time.NewTicker(100 * time.Microsecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&m)
+			most = max(most, m.HeapAlloc)
+			select {
+			case <-done:
+				peak <- most
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	fn()
+	close(done)
+	return <-peak
+}
+
+// Under a small MaxMemory, Encode and Decode stream a large input instead
+// of reading it whole
+func TestMaxMemoryBoundsAllocation(t *testing.T) {
+	const size = 8 << 20
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.bin")
+	encoded := filepath.Join(dir, "input.encoded")
+	decoded := filepath.Join(dir, "input.decoded")
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 131)
+	}
+	if err := os.WriteFile(input, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestCodec(t, fullDict, WithLogger(nil), WithMaxMemory(64<<10))
+	var err error
+	if n := peakHeap(func() { _, err = c.Encode(input, encoded, true) }); err != nil {
+		t.Fatalf("Encode: %v", err)
+	} else if n >= size {
+		t.Errorf("Encode held %d bytes for a %d-byte input", n, size)
+	}
+	if n := peakHeap(func() { _, err = c.Decode(encoded, decoded, true) }); err != nil {
+		t.Fatalf("Decode: %v", err)
+	} else if n >= size {
+		t.Errorf("Decode held %d bytes for a %d-byte output", n, size)
+	}
+}
+
+// DecodeStream gives the same output however its reader splits the text,
+// even a byte at a time through multi-byte characters
+func TestDecodeStreamOneByte(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	for _, tc := range []struct {
+		name   string
+		base64 bool
+		input  []byte
+		opts   []Option
+	}{
+		{"base64", true, data, nil},
+		{"checksum", true, data, []Option{WithChecksum(true)}},
+		{"mime", true, data, []Option{WithB64Variant(B64MIME)}},
+		{"raw", false, []byte("Plain ASCII text, odd length!"), nil},
+	} {
+		c := newTestCodec(t, fullDict, append(tc.opts, WithLogger(nil))...)
+		encoded, err := c.EncodeString(string(tc.input), tc.base64)
+		if err != nil {
+			t.Fatalf("%s: EncodeString: %v", tc.name, err)
+		}
+		var out bytes.Buffer
+		r := iotest.OneByteReader(strings.NewReader(encoded))
+		if err := c.DecodeStream(r, &out, tc.base64); err != nil {
+			t.Fatalf("%s: DecodeStream: %v", tc.name, err)
+		}
+		if !bytes.Equal(out.Bytes(), tc.input) {
+			t.Errorf("%s: decoded %d bytes that differ from the %d encoded", tc.name, out.Len(), len(tc.input))
+		}
+	}
+}
+
+// A write that fails midway leaves neither a partial file nor a temporary
+// one, and an existing file keeps its content
+func TestWriteAtomicFailure(t *testing.T) {
+	errFull := errors.New("no space left on device")
+	failing := func(w io.Writer) error {
+		if _, err := io.WriteString(w, "partial output"); err != nil {
+			return err
+		}
+		return errFull
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.encoded")
+	if err := WriteAtomic(path, failing); !errors.Is(err, errFull) {
+		t.Fatalf("WriteAtomic: got %v, want the write's error", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("left behind: %s", e.Name())
+	}
+
+	if err := os.WriteFile(path, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAtomic(path, failing); !errors.Is(err, errFull) {
+		t.Fatalf("WriteAtomic over a file: got %v, want the write's error", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "previous" {
+		t.Errorf("existing file now holds %q (%v), want it unchanged", data, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files in the output directory, want only the existing one", len(entries))
+	}
+}
+
+// A new file gets the same mode as os.WriteFile with 0644 would give it,
+// so the umask applies; an existing file keeps its mode
+func TestWriteAtomicMode(t *testing.T) {
+	dir := t.TempDir()
+	reference := filepath.Join(dir, "reference")
+	if err := os.WriteFile(reference, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.Stat(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "out.encoded")
+	write := func(w io.Writer) error {
+		_, err := io.WriteString(w, "output")
+		return err
+	}
+	if err := WriteAtomic(path, write); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if got.Mode() != want.Mode() {
+		t.Errorf("new file has mode %v, want %v", got.Mode(), want.Mode())
+	}
+
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteAtomic(path, write); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if got.Mode().Perm() != 0600 {
+		t.Errorf("replaced file has mode %v, want 0600", got.Mode())
+	}
+}
@@ -0,0 +1,48 @@
+package codec
+
+import (
+	"fmt"
+	"html/template"
+)
+
+// FuncMap returns template functions that encode and decode with c, for
+// rendering encoded blobs directly in Go templates:
+//
+//	sinogramEncode  encodes a string or byte slice, like EncodeBytes
+//	sinogramDecode  decodes encoded text to a string, like DecodeBytes
+//
+// Install them with template.New(name).Funcs(codec.FuncMap(c)), or in
+// text/template after converting the map to its FuncMap. Templates may
+// execute concurrently, so c should be frozen (see Freeze).
+func FuncMap(c *Codec) template.FuncMap {
+	return template.FuncMap{
+		"sinogramEncode": func(v any) (string, error) {
+			data, err := templateBytes(v)
+			if err != nil {
+				return "", err
+			}
+			return c.EncodeBytes(data)
+		},
+		"sinogramDecode": func(text string) (string, error) {
+			decoded, err := c.DecodeBytes(text)
+			return string(decoded), err
+		},
+	}
+}
+
+// templateBytes converts a template argument to the bytes to encode
+func templateBytes(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case Bytes:
+		return v, nil
+	case JSONBytes:
+		return v, nil
+	case SQLBytes:
+		return v, nil
+	}
+	return nil, fmt.Errorf("cannot encode %T; pass a string or byte slice", v)
+}
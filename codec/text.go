@@ -0,0 +1,213 @@
+package codec
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// textCodec is the codec Bytes values marshal with, set by SetTextCodec
+var textCodec atomic.Pointer[Codec]
+
+// SetTextCodec sets the codec that Bytes values encode and decode with,
+// in the codec's mode (see WithBase64). The codec must have its dictionary
+// loaded and must not be reconfigured afterwards, which Freeze enforces;
+// marshaling only reads it, so values can be marshaled from several
+// goroutines at once.
+func SetTextCodec(c *Codec) {
+	textCodec.Store(c)
+}
+
+// TextCodecSource picks the codec for BytesWith, JSONBytesWith and
+// SQLBytesWith values. It is called on the zero value of the type, so
+// implementations are usually empty structs returning a package-level
+// codec; returning nil falls back to the codec set with SetTextCodec.
+// The same rules as for SetTextCodec apply to the codec returned.
+type TextCodecSource interface {
+	TextCodec() *Codec
+}
+
+// defaultTextCodec is the TextCodecSource of Bytes, JSONBytes and SQLBytes
+type defaultTextCodec struct{}
+
+// TextCodec returns nil, leaving the choice to SetTextCodec
+func (defaultTextCodec) TextCodec() *Codec { return nil }
+
+// Bytes is binary data that marshals to encoded text through
+// encoding.TextMarshaler and encoding.TextUnmarshaler, so blobs in YAML,
+// TOML and other text formats read as Chinese text. It uses the codec set
+// with SetTextCodec; use BytesWith to choose another.
+type Bytes []byte
+
+// MarshalText encodes b, like EncodeBytes
+func (b Bytes) MarshalText() ([]byte, error) {
+	return BytesWith[defaultTextCodec](b).MarshalText()
+}
+
+// UnmarshalText decodes text into b, like DecodeBytes
+func (b *Bytes) UnmarshalText(text []byte) error {
+	return (*BytesWith[defaultTextCodec])(b).UnmarshalText(text)
+}
+
+// BytesWith is Bytes using the codec S picks, so values of different
+// types in one program can use different dictionaries or modes:
+//
+//	type logoCodec struct{}
+//
+//	func (logoCodec) TextCodec() *codec.Codec { return logo }
+//
+//	type Config struct {
+//		Logo codec.BytesWith[logoCodec]
+//	}
+type BytesWith[S TextCodecSource] []byte
+
+// MarshalText encodes b, like EncodeBytes
+func (b BytesWith[S]) MarshalText() ([]byte, error) {
+	c, err := loadTextCodec[S]()
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := c.quiet().encodeWithHeader(b, c.Base64)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encoded), nil
+}
+
+// UnmarshalText decodes text into b, like DecodeBytes
+func (b *BytesWith[S]) UnmarshalText(text []byte) error {
+	c, err := loadTextCodec[S]()
+	if err != nil {
+		return err
+	}
+	decoded, _, err := c.quiet().decodeWithHeader(string(text), c.Base64)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// loadTextCodec returns the codec S picks, or else the one set with
+// SetTextCodec
+func loadTextCodec[S TextCodecSource]() (*Codec, error) {
+	var s S
+	if c := s.TextCodec(); c != nil {
+		return c, nil
+	}
+	c := textCodec.Load()
+	if c == nil {
+		return nil, fmt.Errorf("%w: call SetTextCodec before marshaling Bytes", ErrNoDictionary)
+	}
+	return c, nil
+}
+
+// JSONBytes is binary data that marshals to a JSON string of encoded text
+// in place of the standard base64 that encoding/json uses for []byte. Like
+// []byte, and unlike Bytes, a nil value marshals to null and null
+// unmarshals to nil. It uses the codec set with SetTextCodec; use
+// JSONBytesWith to choose another.
+type JSONBytes []byte
+
+// MarshalJSON encodes b as a JSON string, or null when b is nil
+func (b JSONBytes) MarshalJSON() ([]byte, error) {
+	return JSONBytesWith[defaultTextCodec](b).MarshalJSON()
+}
+
+// UnmarshalJSON decodes a JSON string into b; null sets b to nil
+func (b *JSONBytes) UnmarshalJSON(data []byte) error {
+	return (*JSONBytesWith[defaultTextCodec])(b).UnmarshalJSON(data)
+}
+
+// JSONBytesWith is JSONBytes using the codec S picks (see BytesWith)
+type JSONBytesWith[S TextCodecSource] []byte
+
+// MarshalJSON encodes b as a JSON string, or null when b is nil
+func (b JSONBytesWith[S]) MarshalJSON() ([]byte, error) {
+	if b == nil {
+		return []byte("null"), nil
+	}
+	text, err := BytesWith[S](b).MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(string(text))
+}
+
+// UnmarshalJSON decodes a JSON string into b; null sets b to nil
+func (b *JSONBytesWith[S]) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*b = nil
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	var decoded BytesWith[S]
+	if err := decoded.UnmarshalText([]byte(text)); err != nil {
+		return err
+	}
+	if decoded == nil {
+		decoded = BytesWith[S]{}
+	}
+	*b = JSONBytesWith[S](decoded)
+	return nil
+}
+
+// SQLBytes is binary data stored as encoded text, so binary values fit in
+// TEXT columns. It implements driver.Valuer and sql.Scanner; a nil value
+// is stored as NULL and NULL scans to nil. It uses the codec set with
+// SetTextCodec; use SQLBytesWith to choose another.
+type SQLBytes []byte
+
+// Value encodes b as a string, or returns nil when b is nil
+func (b SQLBytes) Value() (driver.Value, error) {
+	return SQLBytesWith[defaultTextCodec](b).Value()
+}
+
+// Scan decodes a string or []byte column value into b; NULL sets b to nil
+func (b *SQLBytes) Scan(src any) error {
+	return (*SQLBytesWith[defaultTextCodec])(b).Scan(src)
+}
+
+// SQLBytesWith is SQLBytes using the codec S picks (see BytesWith)
+type SQLBytesWith[S TextCodecSource] []byte
+
+// Value encodes b as a string, or returns nil when b is nil
+func (b SQLBytesWith[S]) Value() (driver.Value, error) {
+	if b == nil {
+		return nil, nil
+	}
+	text, err := BytesWith[S](b).MarshalText()
+	if err != nil {
+		return nil, err
+	}
+	return string(text), nil
+}
+
+// Scan decodes a string or []byte column value into b; NULL sets b to nil
+func (b *SQLBytesWith[S]) Scan(src any) error {
+	var text []byte
+	switch v := src.(type) {
+	case nil:
+		*b = nil
+		return nil
+	case string:
+		text = []byte(v)
+	case []byte:
+		text = v
+	default:
+		return fmt.Errorf("cannot scan %T into SQLBytes", src)
+	}
+	var decoded BytesWith[S]
+	if err := decoded.UnmarshalText(text); err != nil {
+		return err
+	}
+	if decoded == nil {
+		decoded = BytesWith[S]{}
+	}
+	*b = SQLBytesWith[S](decoded)
+	return nil
+}
@@ -0,0 +1,63 @@
+package codec
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// rawCodec is the codec the rawBytes test type picks
+var rawCodec *Codec
+
+type rawBytes struct{}
+
+func (rawBytes) TextCodec() *Codec { return rawCodec }
+
+// Types with their own TextCodecSource use their codec; the rest use the
+// one set with SetTextCodec
+func TestTextCodecPerType(t *testing.T) {
+	global := newTestCodec(t, fullDict, WithBase64(true))
+	rawCodec = newTestCodec(t, fullDict, WithBase64(false))
+	t.Cleanup(func() {
+		rawCodec = nil
+		SetTextCodec(nil)
+	})
+	SetTextCodec(global)
+
+	type doc struct {
+		Default JSONBytes
+		Raw     JSONBytesWith[rawBytes]
+	}
+	in := doc{Default: JSONBytes("hello"), Raw: JSONBytesWith[rawBytes]("hello")}
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]string
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := global.EncodeString("hello", true); fields["Default"] != want {
+		t.Errorf("Default marshaled to %q, want base64 mode %q", fields["Default"], want)
+	}
+	if want, _ := rawCodec.EncodeString("hello", false); fields["Raw"] != want {
+		t.Errorf("Raw marshaled to %q, want raw mode %q", fields["Raw"], want)
+	}
+
+	var out doc
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if string(out.Default) != "hello" || string(out.Raw) != "hello" {
+		t.Errorf("round trip gave %q and %q, want hello", out.Default, out.Raw)
+	}
+
+	// A source returning nil falls back to SetTextCodec
+	rawCodec = nil
+	text, err := BytesWith[rawBytes]("hello").MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := global.EncodeString("hello", true); string(text) != want {
+		t.Errorf("fallback marshaled to %q, want %q", text, want)
+	}
+}
@@ -0,0 +1,98 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+)
+
+// verifier is the codec that decodes an encode's output to verify it: a
+// quiet copy that leaves trimming and recovery, which would hide damage,
+// to the caller
+func (c *Codec) verifier() *Codec {
+	q := c.quiet()
+	q.Trim, q.Recover = false, false
+	return q
+}
+
+// verifyEncoded decodes the encoded text in memory and checks that it
+// reproduces data, so that an encode the dictionary made lossy fails
+// instead of writing an output that cannot be decoded back
+func (c *Codec) verifyEncoded(encoded string, data []byte, useBase64 bool) error {
+	defer c.logTiming("verify", time.Now())
+
+	if c.Limit > 0 && int64(len(data)) > c.Limit {
+		data = data[:c.Limit] // A preview only holds the start of the input
+	}
+	decoded, _, err := c.verifier().decodeWithHeader(encoded, useBase64)
+	if err != nil {
+		return fmt.Errorf("%w: the output does not decode: %v", ErrVerifyFailed, err)
+	}
+	if sha256.Sum256(decoded) != sha256.Sum256(data) {
+		return fmt.Errorf("%w: the output decodes to %d bytes that differ from the %d input bytes",
+			ErrVerifyFailed, len(decoded), len(data))
+	}
+	c.logf("Verified: the output decodes back to the input")
+	return nil
+}
+
+// streamVerifier decodes a streamed encode's output as it is written,
+// hashing the decoded data to compare with the input's hash
+type streamVerifier struct {
+	c    *Codec
+	in   hash.Hash // The input, as it is read
+	pw   *io.PipeWriter
+	got  hash.Hash // The decoded output
+	n    int64     // Decoded bytes
+	done chan error
+}
+
+// newStreamVerifier starts decoding what is written to it in the
+// background. The input must be passed through the reader returned by
+// input, so that it can be compared.
+func (c *Codec) newStreamVerifier(useBase64 bool) *streamVerifier {
+	pr, pw := io.Pipe()
+	v := &streamVerifier{c: c, in: sha256.New(), pw: pw, got: sha256.New(), done: make(chan error, 1)}
+	go func() {
+		n, _, err := c.verifier().decodeStream(pr, v.got, useBase64)
+		v.n = n
+		// Keep reading after a failure, so the encode still completes
+		io.Copy(io.Discard, pr)
+		v.done <- err
+	}()
+	return v
+}
+
+// input returns r, hashed as it is read
+func (v *streamVerifier) input(r io.Reader) io.Reader {
+	return io.TeeReader(r, v.in)
+}
+
+// Write passes encoded output on to the decoder
+func (v *streamVerifier) Write(p []byte) (int, error) {
+	return v.pw.Write(p)
+}
+
+// finish waits for the decoder to reach the end of the output and checks
+// that it reproduced the inputSize bytes of input. It is passed the
+// encode's error, which it returns if set, and must be called even then to
+// stop the decoder.
+func (v *streamVerifier) finish(inputSize int64, encodeErr error) error {
+	v.pw.CloseWithError(encodeErr)
+	err := <-v.done
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: the output does not decode: %v", ErrVerifyFailed, err)
+	}
+	if !bytes.Equal(v.got.Sum(nil), v.in.Sum(nil)) {
+		return fmt.Errorf("%w: the output decodes to %d bytes that differ from the %d input bytes",
+			ErrVerifyFailed, v.n, inputSize)
+	}
+	v.c.logf("Verified: the output decodes back to the input")
+	return nil
+}
@@ -0,0 +1,3 @@
+module github.com/Kaiser-Zheng/sinogram
+
+go 1.22
@@ -1,257 +1,2351 @@
 package main
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Kaiser-Zheng/sinogram/codec"
+)
+
+const defaultDictFile = "dictionary.md"
+
+// logger carries the command's warnings to stderr, keeping stdout for output
+var logger = slog.New(codec.NewLineHandler(os.Stderr, nil))
+
+// errUsage is returned by subcommands called with the wrong arguments
+var errUsage = errors.New("usage")
+
+// Exit codes, so that scripts can tell the kinds of failure apart
+const (
+	exitError      = 1 // Any failure not covered below
+	exitUsage      = 2 // Invalid flags or arguments, as the flag package uses
+	exitDictionary = 3 // Dictionary missing or unusable, or too small for the input
+	exitIO         = 4 // Input or output file could not be read or written
+	exitIntegrity  = 5 // Encoded input could not be decoded or failed verification
+
+	exitInterrupted = 130 // Stopped by a signal, as shells report an interrupt
 )
 
-const (
-	defaultDictFile = "dictionary.md"
-	base64Charset   = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
-	minDictChars    = 256  // Minimum characters for basic functionality
-	maxPairs        = 4096 // 64 * 64 possible base64 pairs
-)
+// exitOnSignal makes an interrupt or termination signal exit the program
+// after removing the temporary files of the outputs still being written,
+// which are then left as they were
+func exitOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		codec.RemovePendingTemps()
+		os.Exit(exitInterrupted)
+	}()
+}
+
+// defaultOutput derives an output file name from the input path
+func defaultOutput(inputPath, suffix string) string {
+	if inputPath == codec.StdinPath {
+		return "stdin" + suffix
+	}
+	return inputPath + suffix
+}
+
+// checkOverwrite refuses to replace an existing file at path unless force
+// is set, so that a mistyped output name cannot destroy a file. Standard
+// output and devices such as /dev/null are always written.
+func checkOverwrite(path string, force bool) error {
+	if force || path == codec.StdoutPath {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	return fmt.Errorf("%w; use -force to replace it", &fs.PathError{Op: "write", Path: path, Err: fs.ErrExist})
+}
+
+// checkOutputs is checkOverwrite for the output of an encode, or for each
+// of its targets when it has several
+func checkOutputs(output string, targets []codec.OutputTarget, force bool) error {
+	if targets == nil {
+		return checkOverwrite(output, force)
+	}
+	for _, target := range targets {
+		if err := checkOverwrite(target.Path, force); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countPairs reports how many distinct pairs an input uses, which is the
+// minimum dictionary size needed to encode it with full coverage
+func countPairs(inputPath string, useBase64, verbose bool) error {
+	data, err := codec.ReadInput(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+
+	pairs := codec.DistinctPairs(codec.PairText(data, useBase64))
+
+	fmt.Printf("Distinct pairs: %d/%d (%.1f%%)\n",
+		len(pairs), codec.MaxPairs, float64(len(pairs))/codec.MaxPairs*100)
+
+	if verbose {
+		printPairs(pairs)
+	}
+
+	return nil
+}
+
+// printPairs lists pairs 16 to a line
+func printPairs(pairs []string) {
+	for i := 0; i < len(pairs); i += 16 {
+		end := min(i+16, len(pairs))
+		fmt.Println(strings.Join(pairs[i:end], " "))
+	}
+}
+
+// pairHistogramSize is how many of the most used pairs -verbose lists
+const pairHistogramSize = 10
+
+// printEncodeResult logs the sizes of an encode and, when verbose, the
+// pairs it used most
+func printEncodeResult(c *codec.Codec, result codec.EncodeResult, useBase64, verbose bool) {
+	logger.Info(fmt.Sprintf("Original size: %d bytes", result.InputBytes))
+	if useBase64 {
+		logger.Info(fmt.Sprintf("Base64 size: %d bytes", base64.StdEncoding.EncodedLen(int(result.InputBytes))))
+	}
+	logger.Info(fmt.Sprintf("Encoded size: %d bytes", result.OutputBytes))
+	if verbose {
+		logger.Info(fmt.Sprintf("Pair coverage: %.1f%% (%d unmapped)", result.Coverage, result.UnmappedPairs))
+		printPairUsage(c, pairHistogramSize)
+	}
+	logger.Info("Encoding complete: output saved")
+}
+
+// printEncodeResults logs the result of an encode to each target
+func printEncodeResults(c *codec.Codec, targets []codec.OutputTarget, results []codec.EncodeResult, verbose bool) {
+	for i, result := range results {
+		logger.Info(fmt.Sprintf("Output: %s", targets[i].Path))
+		printEncodeResult(c, result, targets[i].UseBase64, verbose)
+	}
+}
+
+// printPairUsage lists the top most used pairs of the codec's last encode
+// with a bar scaled to the most used one
+func printPairUsage(c *codec.Codec, top int) {
+	usage := c.Stats.PairUsage
+	if len(usage) == 0 {
+		return
+	}
+
+	pairs := make([]string, 0, len(usage))
+	total := 0
+	for pair, n := range usage {
+		pairs = append(pairs, pair)
+		total += n
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if usage[pairs[i]] != usage[pairs[j]] {
+			return usage[pairs[i]] > usage[pairs[j]]
+		}
+		return pairs[i] < pairs[j]
+	})
+
+	logger.Info(fmt.Sprintf("Pairs used: %d distinct, %d total", len(pairs), total))
+	logger.Info("Most used pairs:")
+	most := usage[pairs[0]]
+	for _, pair := range pairs[:min(top, len(pairs))] {
+		n := usage[pair]
+		char, _ := c.RuneForPair(pair)
+		logger.Info(fmt.Sprintf("  %s %c %8d %5.2f%% %s", pair, char, n,
+			float64(n)/float64(total)*100, strings.Repeat("#", max(n*40/most, 1))))
+	}
+}
+
+// streamLines runs a line transform from an input path to an output file.
+// The output is written in place rather than atomically so that it can be
+// followed while lines arrive.
+func streamLines(inputPath, outputPath string, transform func(io.Reader, io.Writer) error) error {
+	in, err := codec.OpenInput(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+	defer in.Close()
+
+	if outputPath == codec.StdoutPath {
+		return transform(in, os.Stdout)
+	}
+
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+
+	if err := transform(in, out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to write output: %w", err)
+	}
+	return nil
+}
+
+// generateSampleDictionary creates a default dictionary file
+func generateSampleDictionary(filename string) error {
+	sample := `第一回甄士隱夢幻識通靈賈雨村風塵懷閨秀作者自云因曾歷過番之後故將真事去而借說撰此石頭記書也曰但中所何又是哉今碌無成忽念及當日有女子細推了覺其行止見皆出於我上堂鬚眉不若彼裙釵實愧則餘悔益大可奈時欲已往賴天恩下承祖德錦衣紈絝飫甘饜美肥背父母教育負師兄規訓至半生潦倒罪編述以告普人固能免然閣本萬肖護短併使泯滅雖茆椽蓬牖瓦灶繩床晨月夕階柳庭花亦未傷襟筆墨學文爲用假語言敷演段來悅耳目乃題綱正義開卷即知意原友情並非怨世駡矣涉態得叙旨閱切詩浮着甚苦奔忙盛席華筵終散場悲喜千般同渺古盡荒唐謾紅袖啼痕重更痴抱恨長字看血十年辛尋常列位官你道從起根由近諳深趣味待在注明方聞惑媧氏煉補山稽崖高經二丈四頑三六五百零塊皇只單剩便棄青埂峰誰煅性眾俱獨己材堪入選遂嗟夜號慚悼俄僧遠骨骼凡豐神迥异笑坐邊談快論先些雲霧海僊玄到榮富貴聽打動心想要間享這粗蠢口吐向那弟物禮適耀繁慕質卻稍況仙形體定品必濟利如蒙發點慈攜帶溫柔鄉裡受幾永佩洪劫忘畢齊憨善樂依恃足好多魔八個緊相連屬瞬息极換究竟境歸空的熾進話复求再強制歎靜極思數既們莫并奇處踮腳罷施佛法助還案否感謝咒符展術登變鮮瑩洁玉且縮扇墜小拿托掌体寶沒須鐫妙昌隆邦簪纓族地安身業禁問件携望乞示白飄投舍訪跡分就茫離合歡炎涼面首偈與蒼枉許係前倩寄傳落胎親陳家瑣閒詞全備或适解悶朝代紀輿國反失考据寫賢忠理廷治俗政樣才微班姑蔡縱抄恐愛呢答太耶漢等添綴難野史蹈轍套新別致取拘市井少特訕謗君貶妻奸淫凶惡胜种穢污臭屠毒坏佳部共濫滿紙潘建西兩艷賦擬男名姓旁撥亂劇丑鬟婢乎逐悉矛盾睹敢似委消愁破歪熟噴飯供酒興衰際遇追蹤躡加穿鑿徒為貧食累怀貪戀色貨工夫願稱檢讀他醉飽臥避把玩豈省壽命筋力比謀虛妄舌害腿令眼胡牽扯淑娘舊稿忖晌遍指責佞誅邪罵仁臣良孝倫關功頌眷窮錄邀約私訂偷盟毫干尾悟易改吳樓東魯孔梅溪鑒曹雪芹軒披載增刪次纂章金陵絕酸淚都脂硯齋甲戌評仍按陷南隅蘇城閶門最流外里街內清巷廟窄狹呼葫蘆住宦費嫡封稟恬淡每觀修竹酌吟膝兒乳喚英蓮歲夏晝房手倦拋伏几憩朦朧睡辨廂放現公該結冤尚趁機會夾孽造罕河岸畔絳珠草株赤瑕宮瑛侍露灌溉始久延精滋養脫木僅游饑蜜果膳渴飲水湯酬報郁纏綿恰偶乘平緣警挂償惠勾陪碎膩概篇總香竊暗泄鬼愚度吾交割楚完猶集隨系請濁洞洗諦沉預跳火坑遞接奪牌坊幅對聯跟舉步聲霹靂崩叫睛烈芭蕉冉奶走越粉妝琢乖伸鬥耍熱鬧癩跣跛瘋癲揮霍哭主運爹睬耐煩撤句慣嬌菱澌防節元宵煙豫各幹營北邙銷影試晚隔壁居儒化表飛州仕末宗基喪京整淹蹇暫賣老倚佇引聊送童獻茶嚴爺拜慌恕誑駕略讓客候妨廳翻弄籍窗嗽丫擷儀容姿呆猛抬敝巾服窘腰圓厚闊兼劍星直鼻權腮轉雄壯襤褸什麼幫周疑怪困狂巨留早秋宴另具顧刻值占律卜頻斂額儔蟾光逢搔匵价奩淺誕謂團尊旅寂寥納辭拂院臾設杯盤肴款斟漫漸濃觥限斝簫管戶弦歌輪彩凝輝愈豪乾七寓晴欄捧仰騰兆履霓賀斗充沽囊路措突宜速春闈戰置謬銀冬九黃期買舟晤收介吃竿醒昨荐謁和鼓達黑陰倏霄啟社燈檻急逃婦妥找音響旦死病孺构疾醫療炸油鍋逸燒篱抵條焰軍民救勢熄怜片礫惟跌商議田庄偏旱鼠盜蜂搶狗兵剿捕折岳肅貫務農殷婿狼狽幸薄計哄賺朽屋稼穡勉支持活懶驚唬忿痛積暮攻景巧拄拐杖掙挫麻屣鶉曉冢堆聚閉孫順迎算宿慧徹陋室笏枯楊舞蛛絲雕梁綠紗糊鬢霜土隴帳底鴛鴦箱丐嘆保擇膏粱嫌帽鎖枷扛憐襖寒紫蟒唱認嫁裳拍肩褡褳烘信遣討靠僕針線喝任牢轎烏猩袍府怔象丟歇嚷差瞪禍`
+
+	return writeFile(filename, sample)
+}
+
+// writeFile replaces filename with content, atomically like encode and
+// decode outputs
+func writeFile(filename, content string) error {
+	return codec.WriteAtomic(filename, func(w io.Writer) error {
+		_, err := io.WriteString(w, content)
+		return err
+	})
+}
+
+// generateCorpusDictionary writes a dictionary holding every distinct
+// Chinese character of a corpus, optionally ordered most frequent first.
+// A positive sampleSize keeps only that many of the most frequent ones.
+func generateCorpusDictionary(corpusPath, filename string, byFrequency bool, sampleSize int) (int, error) {
+	content, err := codec.ReadInput(corpusPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read corpus: %w", err)
+	}
+
+	text := string(content)
+	chars := codec.ExtractChineseCharacters(text)
+
+	if len(chars) < codec.MinDictChars {
+		return 0, &codec.DictionaryError{Err: fmt.Errorf("corpus has too few distinct Chinese characters (found: %d, need: %d+)",
+			len(chars), codec.MinDictChars)}
+	}
+
+	if byFrequency || sampleSize > 0 {
+		freq := make(map[rune]int)
+		for _, r := range text {
+			freq[r]++
+		}
+		// Stable sort keeps first-appearance order among equally frequent characters
+		sort.SliceStable(chars, func(i, j int) bool { return freq[chars[i]] > freq[chars[j]] })
+	}
+
+	if sampleSize > len(chars) {
+		logger.Warn(fmt.Sprintf("corpus has only %d distinct Chinese characters, fewer than the sample size %d",
+			len(chars), sampleSize))
+	} else if sampleSize > 0 {
+		chars = chars[:sampleSize]
+	}
+
+	if err := writeFile(filename, string(chars)); err != nil {
+		return 0, fmt.Errorf("failed to write dictionary: %w", err)
+	}
+
+	return len(chars), nil
+}
+
+const profileExt = ".conf"
+
+// Profile is a named set of defaults stored as "<name>.conf" in the
+// profile directory, one "key = value" per line with '#' comments
+type Profile struct {
+	Name string
+	Dict string // Dictionary path; relative paths resolve against the profile directory
+	Mode string // codec.ModeBase64 or codec.ModeRaw, empty to keep the default
+
+	// Alphabet names the registered alphabet to map with, empty to keep
+	// the default
+	Alphabet string
+}
+
+// profileDir returns the directory holding profile files
+func profileDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate config directory: %w", err)
+	}
+	return filepath.Join(dir, "sinogram", "profiles"), nil
+}
+
+// validProfileName reports whether name is safe to use as a file name and
+// as a header value
+func validProfileName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// loadProfile reads the named profile from the profile directory
+func loadProfile(name string) (*Profile, error) {
+	if !validProfileName(name) {
+		return nil, fmt.Errorf("invalid profile name %q (use letters, digits, '-' and '_')", name)
+	}
+
+	dir, err := profileDir()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, name+profileExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile %q: %w", name, err)
+	}
+
+	return parseProfile(name, dir, string(content))
+}
+
+func parseProfile(name, dir, content string) (*Profile, error) {
+	profile := &Profile{Name: name}
+
+	for n, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("profile %q line %d: expected key = value", name, n+1)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch key {
+		case "dict":
+			if !filepath.IsAbs(value) {
+				value = filepath.Join(dir, value)
+			}
+			profile.Dict = value
+		case "mode":
+			if _, err := parseMode(value); err != nil {
+				return nil, fmt.Errorf("profile %q line %d: %w", name, n+1, err)
+			}
+			profile.Mode = value
+		case "alphabet":
+			if _, ok := codec.LookupAlphabet(value); !ok {
+				return nil, fmt.Errorf("profile %q line %d: unknown alphabet %q (use %s)",
+					name, n+1, value, strings.Join(codec.Alphabets(), ", "))
+			}
+			profile.Alphabet = value
+		default:
+			return nil, fmt.Errorf("profile %q line %d: unknown key %q", name, n+1, key)
+		}
+	}
+
+	return profile, nil
+}
+
+// listProfiles loads every profile in the profile directory, sorted by name
+func listProfiles() ([]*Profile, error) {
+	dir, err := profileDir()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile directory: %w", err)
+	}
+
+	var profiles []*Profile
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), profileExt)
+		if !ok || entry.IsDir() || !validProfileName(name) {
+			continue
+		}
+		profile, err := loadProfile(name)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+// runProfile implements "sinogram profile list"
+func runProfile(args []string) error {
+	if len(args) != 1 || args[0] != "list" {
+		return fmt.Errorf("%w: sinogram profile list", errUsage)
+	}
+
+	dir, err := profileDir()
+	if err != nil {
+		return err
+	}
+
+	profiles, err := listProfiles()
+	if err != nil {
+		return err
+	}
+
+	if len(profiles) == 0 {
+		fmt.Printf("No profiles found in %s\n", dir)
+		return nil
+	}
+
+	for _, p := range profiles {
+		mode := p.Mode
+		if mode == "" {
+			mode = "-"
+		}
+		alphabet := p.Alphabet
+		if alphabet == "" {
+			alphabet = "-"
+		}
+		fmt.Printf("%-16s mode=%-6s alphabet=%-6s dict=%s\n", p.Name, mode, alphabet, p.Dict)
+	}
+	return nil
+}
+
+// commands maps subcommand names, given as the first argument, to their handlers
+var commands = map[string]func(args []string) error{
+	"benchmark-dict": runBenchmarkDict,
+	"check-corpus":   runCheckCorpus,
+	"dict":           runDict,
+	"dict-diff":      runDictDiff,
+	"gen-dict":       runGenDict,
+	"pack":           runPack,
+	"profile":        runProfile,
+	"repl":           runRepl,
+	"rune-info":      runRuneInfo,
+	"serve":          runServe,
+	"unpack":         runUnpack,
+	"validate-dict":  runValidateDict,
+}
+
+// dictCommands maps the subcommands of "sinogram dict" to their handlers,
+// which the older top-level names gen-dict, validate-dict and dict-diff
+// still reach
+var dictCommands = map[string]func(args []string) error{
+	"gen":   runGenDict,
+	"check": runValidateDict,
+	"diff":  runDictDiff,
+}
+
+// runDict implements "sinogram dict gen|check|diff ...", grouping the
+// commands that work on dictionaries
+func runDict(args []string) error {
+	if len(args) > 0 {
+		if run, ok := dictCommands[args[0]]; ok {
+			return run(args[1:])
+		}
+	}
+	return fmt.Errorf("%w: sinogram dict gen|check|diff [flags]", errUsage)
+}
+
+// runGenDict implements "sinogram dict gen [-from corpus] [-freq] [-sample-size n] [-force] [-o file]"
+func runGenDict(args []string) error {
+	fs := flag.NewFlagSet("dict gen", flag.ExitOnError)
+	from := fs.String("from", "", "Corpus file to extract characters from (default: built-in sample)")
+	output := fs.String("o", defaultDictFile, "Output dictionary file")
+	byFrequency := fs.Bool("freq", false, "Order characters by frequency in the corpus, most frequent first")
+	sampleSize := fs.Int("sample-size", 0, "Keep only this many of the corpus's most frequent characters (0: all)")
+	force := fs.Bool("force", false, "Replace an existing output file")
+	fs.Parse(args)
+
+	if *sampleSize != 0 {
+		if *from == "" {
+			return fmt.Errorf("-sample-size requires -from")
+		}
+		if *sampleSize < codec.MinDictChars {
+			return fmt.Errorf("-sample-size must be at least %d", codec.MinDictChars)
+		}
+	}
+	if err := checkOverwrite(*output, *force); err != nil {
+		return err
+	}
+
+	if *from == "" {
+		if err := generateSampleDictionary(*output); err != nil {
+			return err
+		}
+		fmt.Printf("Sample dictionary generated: %s\n", *output)
+		return nil
+	}
+
+	count, err := generateCorpusDictionary(*from, *output, *byFrequency, *sampleSize)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Dictionary generated: %s (%d unique Chinese characters)\n", *output, count)
+	return nil
+}
+
+// runRuneInfo implements "sinogram rune-info [-dict file] [-dict-mode mode] [-alphabet name] [-top n] file"
+func runRuneInfo(args []string) error {
+	fs := flag.NewFlagSet("rune-info", flag.ExitOnError)
+	dictFile := fs.String("dict", commandDictFile(), "Dictionary file path")
+	dictMode := fs.String("dict-mode", codec.DictSorted, "How dictionary characters map to pairs: sorted or ordered")
+	alphabet := fs.String("alphabet", codec.DefaultAlphabet, alphabetHelp)
+	top := fs.Int("top", 10, "Number of most frequent characters to list")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("%w: sinogram rune-info [-dict file] [-dict-mode mode] [-alphabet name] [-top n] file", errUsage)
+	}
+
+	if err := checkDictMode(*dictMode); err != nil {
+		return err
+	}
+	if err := checkAlphabet(*alphabet); err != nil {
+		return err
+	}
+	if err := checkStdinDict(*dictFile, fs.Arg(0)); err != nil {
+		return err
+	}
+
+	data, err := codec.ReadInput(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+
+	segments, err := codec.SplitSegments(string(data))
+	if err != nil {
+		return err
+	}
+
+	// Segments that embed their dictionary need none to be loaded
+	c := codec.NewCodec(codec.WithCacheDir(mappingCacheDir()))
+	c.DictMode = *dictMode
+	c.Alphabet = *alphabet
+	for _, seg := range segments {
+		if seg.Header == nil || len(seg.Header.Dict) == 0 {
+			if err := c.LoadDictionary(*dictFile); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	info := newRuneInfo()
+	for _, seg := range segments {
+		dc := c
+		if seg.Header != nil && len(seg.Header.Dict) > 0 {
+			dc = c.Remapped(seg.Header.Dict)
+		}
+		info.add(dc, seg.Body)
+	}
+
+	info.print(*top)
+	return nil
+}
+
+// runValidateDict implements "sinogram dict check [-dict file] [-dict-mode mode] [-alphabet name] [-min-coverage pct] [-charset-report]"
+func runValidateDict(args []string) error {
+	fs := flag.NewFlagSet("dict check", flag.ExitOnError)
+	dictFile := fs.String("dict", commandDictFile(), "Dictionary file path")
+	dictMode := fs.String("dict-mode", codec.DictSorted, "How dictionary characters map to pairs: sorted or ordered")
+	alphabet := fs.String("alphabet", codec.DefaultAlphabet, alphabetHelp)
+	minCoverage := fs.Float64("min-coverage", 100, "Percentage of the 4096 pairs that must be mapped")
+	charset := fs.Bool("charset-report", false, "Tally the characters skipped during extraction by category")
+	fs.Parse(args)
+
+	if err := checkDictMode(*dictMode); err != nil {
+		return err
+	}
+	if err := checkAlphabet(*alphabet); err != nil {
+		return err
+	}
+
+	c := codec.NewCodec(codec.WithCacheDir(mappingCacheDir()))
+	c.DictMode = *dictMode
+	c.Alphabet = *alphabet
+	c.StrictDict = true
+
+	// Standard input can only be read once, so the report and the mapping
+	// share one read
+	var err error
+	if *charset {
+		var content []byte
+		if content, err = readDictionary(*dictFile); err != nil {
+			return err
+		}
+		codec.NewCharsetReport(content).Print(os.Stdout)
+		err = c.LoadDictionaryFromReader(bytes.NewReader(content))
+	} else {
+		err = c.LoadDictionary(*dictFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	missing := c.UnmappedPairs()
+	if len(missing) > 0 {
+		fmt.Printf("Unmapped pairs: %d\n", len(missing))
+		printPairs(missing)
+	}
+
+	coverage := float64(codec.MaxPairs-len(missing)) / codec.MaxPairs * 100
+	if coverage < *minCoverage {
+		return &codec.DictionaryError{Err: fmt.Errorf("coverage %.1f%% is below the required %.1f%%", coverage, *minCoverage)}
+	}
+
+	fmt.Printf("Dictionary meets the required coverage of %.1f%%\n", *minCoverage)
+	return nil
+}
+
+// runDictDiff implements "sinogram dict diff [-dict-mode mode] [-alphabet name] old new": it
+// compares the mappings of two dictionaries and fails if files encoded with
+// the old one would not decode with the new one
+func runDictDiff(args []string) error {
+	fs := flag.NewFlagSet("dict diff", flag.ExitOnError)
+	dictMode := fs.String("dict-mode", codec.DictSorted, "How dictionary characters map to pairs: sorted or ordered")
+	alphabet := fs.String("alphabet", codec.DefaultAlphabet, alphabetHelp)
+	positional := parseInterspersed(fs, args)
+
+	if len(positional) != 2 {
+		return fmt.Errorf("%w: sinogram dict diff [-dict-mode mode] [-alphabet name] old new", errUsage)
+	}
+	if positional[0] == codec.StdinDict && positional[1] == codec.StdinDict {
+		return fmt.Errorf("only one dictionary can be read from standard input")
+	}
+
+	if err := checkDictMode(*dictMode); err != nil {
+		return err
+	}
+	if err := checkAlphabet(*alphabet); err != nil {
+		return err
+	}
+
+	codecs := make([]*codec.Codec, 2)
+	for i, path := range positional {
+		codecs[i] = codec.NewCodec(codec.WithCacheDir(mappingCacheDir()))
+		codecs[i].DictMode = *dictMode
+		codecs[i].Alphabet = *alphabet
+		if err := codecs[i].LoadDictionary(path); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	old, updated := codecs[0], codecs[1]
+
+	var added, removed []rune
+	updated.ForEachPair(func(_ string, r rune) {
+		if _, ok := old.PairForRune(r); !ok {
+			added = append(added, r)
+		}
+	})
+	old.ForEachPair(func(_ string, r rune) {
+		if _, ok := updated.PairForRune(r); !ok {
+			removed = append(removed, r)
+		}
+	})
+
+	fmt.Printf("Characters added:   %d\n", len(added))
+	if len(added) > 0 {
+		fmt.Printf("  %s\n", string(added))
+	}
+	fmt.Printf("Characters removed: %d\n", len(removed))
+	if len(removed) > 0 {
+		fmt.Printf("  %s\n", string(removed))
+	}
+
+	// Only pairs the old dictionary mapped can appear as characters in old
+	// output; pairs it left unmapped were written as base64 and still decode
+	gained := 0
+	var changed []string
+	for i := 0; i < codec.MaxPairs; i++ {
+		pair := string([]byte{codec.Base64Charset[i/64], codec.Base64Charset[i%64]})
+		was, hadOld := old.RuneForPair(pair)
+		now, hasNew := updated.RuneForPair(pair)
+		switch {
+		case hadOld && !hasNew:
+			changed = append(changed, fmt.Sprintf("  %s: %c -> (unmapped)", pair, was))
+		case hadOld && was != now:
+			changed = append(changed, fmt.Sprintf("  %s: %c -> %c", pair, was, now))
+		case !hadOld && hasNew:
+			gained++
+		}
+	}
+
+	fmt.Printf("Pairs newly mapped: %d\n", gained)
+	fmt.Printf("Pairs changed:      %d\n", len(changed))
+	for _, line := range changed {
+		fmt.Println(line)
+	}
+
+	if len(changed) > 0 {
+		return fmt.Errorf("%d pairs changed; files encoded with %s will not decode correctly with %s",
+			len(changed), positional[0], positional[1])
+	}
+	fmt.Printf("Compatible: files encoded with %s decode with %s\n", positional[0], positional[1])
+	return nil
+}
+
+// readDictionary reads a dictionary file, or standard input for "-"
+func readDictionary(path string) ([]byte, error) {
+	var content []byte
+	var err error
+	if path == codec.StdinDict {
+		content, err = io.ReadAll(os.Stdin)
+	} else {
+		content, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, &codec.DictionaryError{Err: fmt.Errorf("failed to read dictionary: %w", err)}
+	}
+	return content, nil
+}
+
+// readPreferList reads the characters of a -prefer-common list, which is
+// Chinese text like a dictionary, most preferred first
+func readPreferList(path string) ([]rune, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read preference list: %w", err)
+	}
+
+	chars := codec.ExtractChineseCharacters(codec.NormalizeDictionary(string(content)))
+	if len(chars) == 0 {
+		return nil, fmt.Errorf("no Chinese characters found in %s", path)
+	}
+	return chars, nil
+}
+
+// readVariantTable reads a simplified-to-traditional table and returns
+// the replacements that show characters in the target variant. Each line
+// lists a simplified character followed by its traditional forms, the
+// first of which is used, as in OpenCC's STCharacters.txt. Blank lines,
+// lines starting with '#' and characters outside the Chinese ranges are
+// skipped.
+func readVariantTable(path, target string) (map[rune]rune, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read variant table: %w", err)
+	}
+
+	variants := make(map[rune]rune)
+	for i, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var chars []rune
+		for _, field := range fields {
+			r, size := utf8.DecodeRuneInString(field)
+			if size != len(field) {
+				return nil, fmt.Errorf("%s:%d: %q is not a single character", path, i+1, field)
+			}
+			chars = append(chars, r)
+		}
+		if len(chars) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected a simplified character and its traditional forms", path, i+1)
+		}
+
+		simplified := chars[0]
+		if !codec.IsChineseChar(simplified) {
+			continue
+		}
+		if target == codec.VariantTraditional {
+			if traditional := chars[1]; codec.IsChineseChar(traditional) {
+				if _, seen := variants[simplified]; !seen {
+					variants[simplified] = traditional
+				}
+			}
+			continue
+		}
+		for _, traditional := range chars[1:] {
+			if _, seen := variants[traditional]; !seen && codec.IsChineseChar(traditional) {
+				variants[traditional] = simplified
+			}
+		}
+	}
+	return variants, nil
+}
+
+// checkStdinDict rejects reading both the dictionary and an input from
+// standard input
+func checkStdinDict(dictFile string, inputs ...string) error {
+	if dictFile != codec.StdinDict {
+		return nil
+	}
+	for _, input := range inputs {
+		if input == codec.StdinPath {
+			return fmt.Errorf("-dict - reads the dictionary from standard input, so the input cannot be %s", codec.StdinPath)
+		}
+	}
+	return nil
+}
+
+// commandDictFile returns the -dict default for subcommands, which honor
+// SINOGRAM_DICT like the top-level flag
+func commandDictFile() string {
+	if dict := os.Getenv("SINOGRAM_DICT"); dict != "" {
+		return dict
+	}
+	return defaultDictFile
+}
+
+// mappingCacheDir returns where the command caches dictionary mappings, or
+// "" to build them afresh when there is no user cache directory
+func mappingCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "sinogram", "mappings")
+}
+
+// alphabetHelp describes the -alphabet flag, listing the registered alphabets
+var alphabetHelp = "Alphabet dictionary characters are taken from: " + strings.Join(codec.Alphabets(), ", ")
+
+// checkAlphabet rejects alphabet names that are not registered
+func checkAlphabet(name string) error {
+	if _, ok := codec.LookupAlphabet(name); !ok {
+		return fmt.Errorf("unknown alphabet %q (use %s)", name, strings.Join(codec.Alphabets(), ", "))
+	}
+	return nil
+}
+
+// checkDictMode rejects unknown -dict-mode values
+func checkDictMode(mode string) error {
+	if mode != codec.DictSorted && mode != codec.DictOrdered {
+		return fmt.Errorf("unknown dictionary mode %q (use %s or %s)", mode, codec.DictSorted, codec.DictOrdered)
+	}
+	return nil
+}
+
+// runRepl implements "sinogram repl [-dict file] [-dict-mode mode] [-alphabet name] [-b64=false]":
+// it loads the dictionary once, then encodes lines typed as "e <text>" and
+// decodes lines typed as "d <text>" until "q" or end of input
+func runRepl(args []string) error {
+	fs := flag.NewFlagSet("repl", flag.ExitOnError)
+	dictFile := fs.String("dict", commandDictFile(), "Dictionary file path")
+	dictMode := fs.String("dict-mode", codec.DictSorted, "How dictionary characters map to pairs: sorted or ordered")
+	alphabet := fs.String("alphabet", codec.DefaultAlphabet, alphabetHelp)
+	useBase64 := fs.Bool("b64", true, "Use base64 encoding")
+	fs.Parse(args)
+
+	if err := checkDictMode(*dictMode); err != nil {
+		return err
+	}
+	if err := checkAlphabet(*alphabet); err != nil {
+		return err
+	}
+	if *dictFile == codec.StdinDict {
+		return fmt.Errorf("repl reads commands from standard input, so -dict - cannot be used")
+	}
+
+	c := codec.NewCodec(codec.WithCacheDir(mappingCacheDir()))
+	c.DictMode = *dictMode
+	c.Alphabet = *alphabet
+	if err := c.LoadDictionary(*dictFile); err != nil {
+		return err
+	}
+
+	fmt.Println(`Type "e <text>" to encode, "d <text>" to decode, "q" to quit`)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, 1<<20)
+	for {
+		fmt.Print("> ")
+		if !scanner.Scan() {
+			break
+		}
+
+		cmd, text, _ := strings.Cut(scanner.Text(), " ")
+		switch cmd {
+		case "e":
+			encoded, err := c.EncodeString(text, *useBase64)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			fmt.Println(encoded)
+		case "d":
+			decoded, err := c.DecodeString(text, *useBase64)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				continue
+			}
+			if utf8.ValidString(decoded) {
+				fmt.Println(decoded)
+			} else {
+				fmt.Printf("%q\n", decoded)
+			}
+		case "q", "quit":
+			return nil
+		case "":
+		default:
+			fmt.Printf("Unknown command %q; use e, d or q\n", cmd)
+		}
+	}
+
+	fmt.Println()
+	return scanner.Err()
+}
+
+// runServe implements "sinogram serve [-addr host:port] [-dict file] [-dict-mode mode] [-alphabet name] [-b64=false] [-max-body n]":
+// it serves POST /encode, which answers with the encoding of the request
+// body, and POST /decode, which answers with the decoded data
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "Address to listen on")
+	dictFile := fs.String("dict", commandDictFile(), "Dictionary file path")
+	dictMode := fs.String("dict-mode", codec.DictSorted, "How dictionary characters map to pairs: sorted or ordered")
+	alphabet := fs.String("alphabet", codec.DefaultAlphabet, alphabetHelp)
+	useBase64 := fs.Bool("b64", true, "Use base64 encoding")
+	maxBody := fs.Int64("max-body", 32<<20, "Largest request body accepted, in bytes")
+	fs.Parse(args)
+
+	if err := checkDictMode(*dictMode); err != nil {
+		return err
+	}
+	if err := checkAlphabet(*alphabet); err != nil {
+		return err
+	}
+	if *maxBody <= 0 {
+		return fmt.Errorf("-max-body must be positive")
+	}
+
+	c := codec.NewCodec(codec.WithCacheDir(mappingCacheDir()))
+	c.DictMode = *dictMode
+	c.Alphabet = *alphabet
+	if err := c.LoadDictionary(*dictFile); err != nil {
+		return err
+	}
+	c.Logger = nil // Per-request messages would only clutter the server's output
+	if err := c.Freeze(); err != nil {
+		return err
+	}
+
+	transform := func(convert func(body string) (string, error), contentType string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "use POST", http.StatusMethodNotAllowed)
+				return
+			}
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, *maxBody))
+			if err != nil {
+				status := http.StatusBadRequest
+				if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+					status = http.StatusRequestEntityTooLarge
+				}
+				http.Error(w, fmt.Sprintf("failed to read request: %v", err), status)
+				return
+			}
+			result, err := convert(string(body))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			w.Header().Set("Content-Type", contentType)
+			io.WriteString(w, result)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/encode", transform(func(body string) (string, error) {
+		return c.EncodeString(body, *useBase64)
+	}, "text/plain; charset=utf-8"))
+	mux.Handle("/decode", transform(func(body string) (string, error) {
+		return c.DecodeString(body, *useBase64)
+	}, "application/octet-stream"))
+
+	logger.Info(fmt.Sprintf("Serving /encode and /decode on http://%s", *addr))
+	return http.ListenAndServe(*addr, mux)
+}
+
+// parseInterspersed parses fs from args, allowing flags to follow positional
+// arguments as in "sinogram pack dir -o out", and returns the positionals
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// runPack implements "sinogram pack [-dict file] [-dict-mode mode] [-alphabet name] [-gzip] [-reproducible] [-force] [-o file] dir":
+// it encodes a tar archive of dir, so a whole tree becomes one encoded file
+func runPack(args []string) error {
+	fs := flag.NewFlagSet("pack", flag.ExitOnError)
+	dictFile := fs.String("dict", commandDictFile(), "Dictionary file path")
+	dictMode := fs.String("dict-mode", codec.DictSorted, "How dictionary characters map to pairs: sorted or ordered")
+	alphabet := fs.String("alphabet", codec.DefaultAlphabet, alphabetHelp)
+	compress := fs.Bool("gzip", false, "Compress the archive before encoding")
+	reproducible := fs.Bool("reproducible", false, "Omit modification times and owners so equal trees pack identically")
+	output := fs.String("o", "", "Output file (default: dir + .encoded)")
+	force := fs.Bool("force", false, "Replace an existing output file")
+	positional := parseInterspersed(fs, args)
+
+	if len(positional) != 1 {
+		return fmt.Errorf("%w: sinogram pack [-dict file] [-dict-mode mode] [-alphabet name] [-gzip] [-reproducible] [-force] [-o file] dir", errUsage)
+	}
+	root := positional[0]
+
+	if info, err := os.Stat(root); err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
+	}
+
+	if err := checkDictMode(*dictMode); err != nil {
+		return err
+	}
+	if err := checkAlphabet(*alphabet); err != nil {
+		return err
+	}
+
+	c := codec.NewCodec(codec.WithCacheDir(mappingCacheDir()))
+	c.DictMode = *dictMode
+	c.Alphabet = *alphabet
+	c.UnmappedPolicy = codec.UnmappedError
+	if err := c.LoadDictionary(*dictFile); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		*output = defaultOutput(filepath.Clean(root), ".encoded")
+	}
+	if err := checkOverwrite(*output, *force); err != nil {
+		return err
+	}
+
+	// The archive is encoded while it is built, so the tree is never held in memory
+	var files int
+	err := codec.WriteAtomic(*output, func(w io.Writer) error {
+		enc := c.NewEncoder(w, true)
+		var err error
+		files, err = writeArchive(root, enc, *compress, *reproducible)
+		if closeErr := enc.Close(); closeErr != nil {
+			return closeErr // Also why the archive writer failed, if it did
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Packed %d files from %s into %s\n", files, root, *output)
+	return nil
+}
+
+// writeArchive writes a tar archive of the directories and regular files
+// under root, gzip-compressed when compress is set, and returns the number
+// of files written. Paths in the archive are relative to root. Entries are
+// written in lexical order; reproducible also drops what varies between
+// equal trees, namely modification times and owners.
+func writeArchive(root string, w io.Writer, compress, reproducible bool) (int, error) {
+	var zw *gzip.Writer
+	if compress {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+
+	var files int
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			logger.Warn(fmt.Sprintf("skipping %s, which is not a regular file", path))
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if reproducible {
+			hdr.ModTime = time.Unix(0, 0)
+			hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+			hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname = 0, 0, "", ""
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		return files, fmt.Errorf("failed to archive %s: %w", root, err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return files, err
+	}
+	if zw != nil {
+		return files, zw.Close()
+	}
+	return files, nil
+}
+
+// runUnpack implements "sinogram unpack [-dict file] [-dict-mode mode] [-alphabet name] [-o dir] file",
+// reversing pack
+func runUnpack(args []string) error {
+	fs := flag.NewFlagSet("unpack", flag.ExitOnError)
+	dictFile := fs.String("dict", commandDictFile(), "Dictionary file path")
+	dictMode := fs.String("dict-mode", codec.DictSorted, "How dictionary characters map to pairs: sorted or ordered")
+	alphabet := fs.String("alphabet", codec.DefaultAlphabet, alphabetHelp)
+	output := fs.String("o", ".", "Directory to extract into")
+	force := fs.Bool("force", false, "Replace existing files")
+	positional := parseInterspersed(fs, args)
+
+	if len(positional) != 1 {
+		return fmt.Errorf("%w: sinogram unpack [-dict file] [-dict-mode mode] [-alphabet name] [-force] [-o dir] file", errUsage)
+	}
+
+	if err := checkDictMode(*dictMode); err != nil {
+		return err
+	}
+	if err := checkAlphabet(*alphabet); err != nil {
+		return err
+	}
+	if err := checkStdinDict(*dictFile, positional[0]); err != nil {
+		return err
+	}
+
+	in, err := codec.OpenInput(positional[0])
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+	defer in.Close()
+
+	c := codec.NewCodec(codec.WithCacheDir(mappingCacheDir()))
+	c.DictMode = *dictMode
+	c.Alphabet = *alphabet
+	if err := c.LoadDictionary(*dictFile); err != nil {
+		return err
+	}
+
+	dec := c.NewDecoder(in, true)
+	defer dec.Close() // Stops the decoder if extraction stopped early
+
+	files, err := extractArchive(dec, *output, *force)
+	if err == nil {
+		// Decode to the end so a checksum after the archive is still verified
+		_, err = io.Copy(io.Discard, dec)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Unpacked %d files into %s\n", files, *output)
+	return nil
+}
+
+// extractArchive extracts a tar archive, gzip-compressed or not, into dest
+// and returns the number of files written. Entries that would land outside
+// dest are refused, and so are existing files unless force is set; a file
+// the archive itself holds twice is replaced by its later entry.
+func extractArchive(r io.Reader, dest string, force bool) (int, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read archive: %w", err)
+		}
+		r = zr
+	} else {
+		r = br
+	}
+	tr := tar.NewReader(r)
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// Directory modes are applied last, so read-only directories can still be filled
+	var dirs []*tar.Header
+	var files int
+	extracted := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return files, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		name := filepath.FromSlash(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return files, fmt.Errorf("refusing to extract %q outside %s", hdr.Name, dest)
+		}
+		target := filepath.Join(dest, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return files, err
+			}
+			dirs = append(dirs, hdr)
+		case tar.TypeReg:
+			if err := checkOverwrite(target, force || extracted[target]); err != nil {
+				return files, err
+			}
+			if err := extractFile(tr, hdr, target); err != nil {
+				return files, err
+			}
+			extracted[target] = true
+			files++
+		default:
+			logger.Warn(fmt.Sprintf("skipping %s, which is not a regular file", hdr.Name))
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		target := filepath.Join(dest, filepath.FromSlash(dirs[i].Name))
+		if err := os.Chmod(target, dirs[i].FileInfo().Mode().Perm()); err != nil {
+			return files, err
+		}
+		os.Chtimes(target, dirs[i].ModTime, dirs[i].ModTime)
+	}
+
+	return files, nil
+}
+
+// extractFile writes one regular file from the archive with its mode and
+// modification time. Like every output, it is written to a temporary file
+// and renamed into place once complete, so a failure or an interrupt
+// leaves no truncated file.
+func extractFile(r io.Reader, hdr *tar.Header, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	err := codec.WriteAtomic(target, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+	}
+
+	if err := os.Chmod(target, hdr.FileInfo().Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
+
+// stringList is a flag.Value collecting every use of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// modeReport holds the result of encoding an input in one mode
+type modeReport struct {
+	mode     string
+	err      error // Why the input could not be encoded, if it could not
+	lossless bool
+	coverage float64 // Share of pairs written as dictionary characters
+	bytes    int
+	chars    int
+}
+
+// compareModes encodes an input in memory in base64 and raw mode, decodes
+// each result and reports which round trips are lossless, the coverage and
+// output size of each, and which mode to use
+func compareModes(c *codec.Codec, inputPath string) error {
+	data, err := codec.ReadInput(inputPath)
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+
+	// Passthrough would compare only the encoded runs, not the modes
+	cc := *c
+	cc.PassthroughASCII = false
+
+	var reports []modeReport
+	for _, useBase64 := range []bool{true, false} {
+		report := modeReport{mode: codec.ModeRaw}
+		if useBase64 {
+			report.mode = codec.ModeBase64
+		}
+
+		encoded, err := cc.EncodeString(string(data), useBase64)
+		if err != nil {
+			report.err = err
+			reports = append(reports, report)
+			continue
+		}
+		decoded, err := cc.DecodeString(encoded, useBase64)
+		report.lossless = err == nil && decoded == string(data)
+		report.bytes = len(encoded)
+		report.chars = utf8.RuneCountInString(encoded)
+
+		mapped, pairs := 0, 0
+		for _, n := range cc.Stats.PairUsage {
+			mapped += n
+		}
+		text := codec.PairText(data, useBase64)
+		for i := 0; i+1 < len(text); i += 2 {
+			if !codec.IsPaddingPair(text[i : i+2]) {
+				pairs++
+			}
+		}
+		report.coverage = 100
+		if pairs > 0 {
+			report.coverage = float64(mapped) / float64(pairs) * 100
+		}
+		reports = append(reports, report)
+	}
+
+	fmt.Println()
+	fmt.Printf("%-6s  %8s  %8s  %10s  %10s\n", "Mode", "Lossless", "Coverage", "Bytes", "Chars")
+	for _, r := range reports {
+		if r.err != nil {
+			fmt.Printf("%-6s  %v\n", r.mode, r.err)
+			continue
+		}
+		lossless := "no"
+		if r.lossless {
+			lossless = "yes"
+		}
+		fmt.Printf("%-6s  %8s  %7.1f%%  %10d  %10d\n", r.mode, lossless, r.coverage, r.bytes, r.chars)
+	}
 
-// Codec handles encoding/decoding between base64 pairs and Chinese characters
-type Codec struct {
-	pairToRune map[string]rune
-	runeToPair map[rune]string
+	b64, raw := reports[0], reports[1]
+	switch {
+	case b64.err != nil && (raw.err != nil || !raw.lossless):
+		fmt.Printf("Recommendation: neither mode encodes this input losslessly with these settings\n")
+	case raw.err != nil || !raw.lossless:
+		fmt.Printf("Recommendation: %s; raw mode does not round-trip this input\n", codec.ModeBase64)
+	case !utf8.Valid(data):
+		fmt.Printf("Recommendation: %s; the input is not UTF-8 text, which raw mode leaves mostly unmapped\n", codec.ModeBase64)
+	case b64.err != nil || raw.bytes < b64.bytes:
+		fmt.Printf("Recommendation: %s (-b64=false); the input is text that round-trips and the output is smaller\n", codec.ModeRaw)
+	default:
+		fmt.Printf("Recommendation: %s; its output is no larger and it is safe for any input\n", codec.ModeBase64)
+	}
+	return nil
 }
 
-func NewCodec() *Codec {
-	return &Codec{
-		pairToRune: make(map[string]rune),
-		runeToPair: make(map[rune]string),
+// runCheckCorpus implements "sinogram check-corpus [-dict file] [-dict-mode mode] [-alphabet name] [-b64=false] dir":
+// it round-trips every file under dir in memory and reports those that do
+// not come back byte for byte
+func runCheckCorpus(args []string) error {
+	fs := flag.NewFlagSet("check-corpus", flag.ExitOnError)
+	dictFile := fs.String("dict", commandDictFile(), "Dictionary file path")
+	dictMode := fs.String("dict-mode", codec.DictSorted, "How dictionary characters map to pairs: sorted or ordered")
+	alphabet := fs.String("alphabet", codec.DefaultAlphabet, alphabetHelp)
+	useBase64 := fs.Bool("b64", true, "Use base64 encoding")
+	positional := parseInterspersed(fs, args)
+
+	if len(positional) != 1 {
+		return fmt.Errorf("%w: sinogram check-corpus [-dict file] [-dict-mode mode] [-alphabet name] [-b64=false] dir", errUsage)
 	}
-}
+	root := positional[0]
 
-// LoadDictionary builds the character mapping from a Chinese text file
-func (c *Codec) LoadDictionary(filename string) error {
-	content, err := os.ReadFile(filename)
-	if err != nil {
-		return fmt.Errorf("failed to read dictionary: %w", err)
+	if info, err := os.Stat(root); err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
 	}
 
-	uniqueChars := extractChineseCharacters(string(content))
+	if err := checkDictMode(*dictMode); err != nil {
+		return err
+	}
+	if err := checkAlphabet(*alphabet); err != nil {
+		return err
+	}
 
-	if len(uniqueChars) < minDictChars {
-		return fmt.Errorf("insufficient Chinese characters (found: %d, need: %d+)",
-			len(uniqueChars), minDictChars)
+	c := codec.NewCodec(codec.WithDictMode(*dictMode), codec.WithAlphabet(*alphabet), codec.WithCacheDir(mappingCacheDir()))
+	if err := c.LoadDictionary(*dictFile); err != nil {
+		return err
 	}
 
-	c.buildMapping(uniqueChars)
-	c.printStats(len(uniqueChars))
+	files, failed, err := checkCorpus(c, root, *useBase64)
+	if err != nil {
+		return err
+	}
 
+	fmt.Printf("Checked %d files: %d round-trip, %d failed\n", files, files-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files do not round-trip with these settings", failed, files)
+	}
 	return nil
 }
 
-// extractChineseCharacters collects unique Chinese characters from text
-func extractChineseCharacters(text string) []rune {
-	seen := make(map[rune]bool)
-	var chars []rune
+// checkCorpus round-trips every regular file under root, printing each
+// one that fails, and returns the number of files checked and failed
+func checkCorpus(c *codec.Codec, root string, useBase64 bool) (files, failed int, err error) {
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			logger.Warn(fmt.Sprintf("skipping %s, which is not a regular file", path))
+			return nil
+		}
 
-	for _, r := range text {
-		if !seen[r] && isChineseChar(r) {
-			chars = append(chars, r)
-			seen[r] = true
+		files++
+		if err := checkRoundTrip(c, path, useBase64); err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", path, err)
 		}
+		return nil
+	})
+	if err != nil {
+		return files, failed, fmt.Errorf("failed to walk %s: %w", root, err)
 	}
-
-	return chars
-}
-
-// isChineseChar checks if rune is in CJK Unicode ranges
-func isChineseChar(r rune) bool {
-	return (r >= 0x4E00 && r <= 0x9FFF) || // CJK Unified Ideographs
-		(r >= 0x3400 && r <= 0x4DBF) || // CJK Extension A
-		(r >= 0x20000 && r <= 0x2A6DF) // CJK Extension B
+	return files, failed, nil
 }
 
-// buildMapping creates bidirectional mapping between base64 pairs and Chinese chars
-func (c *Codec) buildMapping(chars []rune) {
-	idx := 0
+// checkRoundTrip encodes the file at path in memory, decodes the result
+// and reports how it fails to reproduce the file exactly, if it does
+func checkRoundTrip(c *codec.Codec, path string, useBase64 bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
 
-	for i := 0; i < 64 && idx < len(chars); i++ {
-		for j := 0; j < 64 && idx < len(chars); j++ {
-			pair := string([]byte{base64Charset[i], base64Charset[j]})
-			char := chars[idx]
+	encoded, err := c.EncodeString(string(data), useBase64)
+	if err != nil {
+		return fmt.Errorf("encode: %w", err)
+	}
+	decoded, err := c.DecodeString(encoded, useBase64)
+	if err != nil {
+		return fmt.Errorf("decode: %w", err)
+	}
 
-			c.pairToRune[pair] = char
-			c.runeToPair[char] = pair
-			idx++
+	if decoded != string(data) {
+		at := 0
+		for at < len(decoded) && at < len(data) && decoded[at] == data[at] {
+			at++
 		}
+		return fmt.Errorf("decoded %d bytes differ from the %d original bytes at offset %d", len(decoded), len(data), at)
 	}
+	return nil
 }
 
-func (c *Codec) printStats(totalChars int) {
-	coverage := len(c.pairToRune)
-	fmt.Printf("Dictionary loaded: %d unique Chinese characters\n", totalChars)
-	fmt.Printf("Coverage: %d/%d pairs (%.1f%%)\n",
-		coverage, maxPairs, float64(coverage)/maxPairs*100)
+// dictBenchmark holds the result of encoding a sample with one dictionary
+type dictBenchmark struct {
+	dict     string
+	coverage float64
+	bytes    int
+	chars    int
+	unmapped int     // Output characters the dictionary does not provide
+	entropy  float64 // Shannon entropy of the output, in bits per character
 }
 
-// Encode converts a file to Chinese character representation
-func (c *Codec) Encode(inputPath, outputPath string, useBase64 bool) error {
-	data, err := os.ReadFile(inputPath)
+// runBenchmarkDict implements "sinogram benchmark-dict -dict a.md -dict b.md [-dict-mode mode] [-alphabet name] [-b64=false] sample":
+// it encodes the sample with each dictionary and compares the results
+func runBenchmarkDict(args []string) error {
+	fs := flag.NewFlagSet("benchmark-dict", flag.ExitOnError)
+	var dicts stringList
+	fs.Var(&dicts, "dict", "Dictionary file to compare (repeatable)")
+	dictMode := fs.String("dict-mode", codec.DictSorted, "How dictionary characters map to pairs: sorted or ordered")
+	alphabet := fs.String("alphabet", codec.DefaultAlphabet, alphabetHelp)
+	useBase64 := fs.Bool("b64", true, "Use base64 encoding")
+	positional := parseInterspersed(fs, args)
+
+	if len(positional) != 1 {
+		return fmt.Errorf("%w: sinogram benchmark-dict -dict file [-dict file]... [-dict-mode mode] [-alphabet name] [-b64=false] sample", errUsage)
+	}
+	if len(dicts) == 0 {
+		dicts = stringList{commandDictFile()}
+	}
+
+	if err := checkDictMode(*dictMode); err != nil {
+		return err
+	}
+	if err := checkAlphabet(*alphabet); err != nil {
+		return err
+	}
+	for _, dict := range dicts {
+		if err := checkStdinDict(dict, positional[0]); err != nil {
+			return err
+		}
+	}
+
+	data, err := codec.ReadInput(positional[0])
 	if err != nil {
 		return fmt.Errorf("failed to read input: %w", err)
 	}
 
-	encoded := c.encodeData(data, useBase64)
+	var results []dictBenchmark
+	for _, dict := range dicts {
+		c := codec.NewCodec(codec.WithCacheDir(mappingCacheDir()))
+		c.DictMode = *dictMode
+		c.Alphabet = *alphabet
+		if err := c.LoadDictionary(dict); err != nil {
+			logger.Warn(fmt.Sprintf("skipping %s: %v", dict, err))
+			continue
+		}
 
-	if err := os.WriteFile(outputPath, []byte(encoded), 0644); err != nil {
-		return fmt.Errorf("failed to write output: %w", err)
+		encoded, err := c.EncodeString(string(data), *useBase64)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("skipping %s: %v", dict, err))
+			continue
+		}
+
+		result := dictBenchmark{
+			dict:     dict,
+			coverage: float64(c.MappedPairs()) / codec.MaxPairs * 100,
+			bytes:    len(encoded),
+			chars:    utf8.RuneCountInString(encoded),
+			entropy:  shannonEntropy(encoded),
+		}
+		for _, r := range encoded {
+			if _, ok := c.PairForRune(r); !ok && !unicode.IsSpace(r) {
+				result.unmapped++
+			}
+		}
+		results = append(results, result)
 	}
 
-	c.printEncodeStats(len(data), len(encoded), useBase64)
+	if len(results) == 0 {
+		return fmt.Errorf("no dictionary could be benchmarked")
+	}
+
+	width := len("Dictionary")
+	for _, r := range results {
+		width = max(width, len(r.dict))
+	}
+
+	fmt.Println()
+	fmt.Printf("%-*s  %8s  %10s  %10s  %8s  %8s\n", width, "Dictionary", "Coverage", "Bytes", "Chars", "Unmapped", "Entropy")
+	smallest := results[0]
+	for _, r := range results {
+		fmt.Printf("%-*s  %7.1f%%  %10d  %10d  %8d  %8.3f\n",
+			width, r.dict, r.coverage, r.bytes, r.chars, r.unmapped, r.entropy)
+		if r.bytes < smallest.bytes {
+			smallest = r
+		}
+	}
+	fmt.Printf("Smallest output: %s\n", smallest.dict)
+
 	return nil
 }
 
-func (c *Codec) encodeData(data []byte, useBase64 bool) string {
-	var text string
-	if useBase64 {
-		text = base64.StdEncoding.EncodeToString(data)
-	} else {
-		text = string(data)
+// shannonEntropy returns the entropy of the characters of text in bits per
+// character; text spread evenly over more characters scores higher
+func shannonEntropy(text string) float64 {
+	counts := make(map[rune]int)
+	total := 0
+	for _, r := range text {
+		counts[r]++
+		total++
 	}
 
-	// Pad to even length
-	if len(text)%2 != 0 {
-		text += "="
+	var entropy float64
+	for _, n := range counts {
+		p := float64(n) / float64(total)
+		entropy -= p * math.Log2(p)
 	}
+	return entropy
+}
 
-	var result strings.Builder
-	unmapped := 0
+// runeInfo tallies the characters of encoded text by how decoding treats them
+type runeInfo struct {
+	counts     map[rune]int
+	total      int
+	mapped     int // Characters of the dictionary in use
+	unmapped   int // Chinese characters missing from the dictionary
+	base64     int // Base64 alphabet characters left as unmapped pairs
+	padding    int
+	whitespace int
+	other      int // Anything else, which base64-mode output never contains
+	minCJK     rune
+	maxCJK     rune
+}
 
-	for i := 0; i < len(text)-1; i += 2 {
-		pair := text[i : i+2]
+func newRuneInfo() *runeInfo {
+	return &runeInfo{counts: make(map[rune]int), minCJK: utf8.MaxRune}
+}
 
-		// Only map valid base64 character pairs
-		if c.isValidBase64Pair(pair) {
-			if char, ok := c.pairToRune[pair]; ok {
-				result.WriteRune(char)
-				continue
-			}
-			unmapped++
+// add tallies text, classifying characters against c's mapping
+func (ri *runeInfo) add(c *codec.Codec, text string) {
+	for _, r := range text {
+		ri.counts[r]++
+		ri.total++
+
+		_, mapped := c.PairForRune(r)
+		switch {
+		case mapped:
+			ri.mapped++
+		case codec.IsChineseChar(r):
+			ri.unmapped++
+		case r < utf8.RuneSelf && strings.ContainsRune(codec.Base64Charset, r):
+			ri.base64++
+		case r == '=':
+			ri.padding++
+		case unicode.IsSpace(r):
+			ri.whitespace++
+		default:
+			ri.other++
+		}
+
+		if codec.IsChineseChar(r) {
+			ri.minCJK = min(ri.minCJK, r)
+			ri.maxCJK = max(ri.maxCJK, r)
 		}
+	}
+}
+
+// print writes the summary and a verdict on dictionary compatibility
+func (ri *runeInfo) print(top int) {
+	fmt.Printf("Characters:   %d (%d distinct)\n", ri.total, len(ri.counts))
+	fmt.Printf("Mapped:       %d\n", ri.mapped)
+	fmt.Printf("Unmapped CJK: %d\n", ri.unmapped)
+	fmt.Printf("Base64 ASCII: %d\n", ri.base64)
+	fmt.Printf("Padding:      %d\n", ri.padding)
+	fmt.Printf("Whitespace:   %d\n", ri.whitespace)
+	fmt.Printf("Other:        %d\n", ri.other)
+	if ri.maxCJK > 0 {
+		fmt.Printf("CJK range:    U+%04X..U+%04X\n", ri.minCJK, ri.maxCJK)
+	}
 
-		// Keep unmapped or invalid pairs as-is
-		result.WriteString(pair)
+	chars := make([]rune, 0, len(ri.counts))
+	for r := range ri.counts {
+		chars = append(chars, r)
 	}
+	sort.Slice(chars, func(i, j int) bool {
+		if ri.counts[chars[i]] != ri.counts[chars[j]] {
+			return ri.counts[chars[i]] > ri.counts[chars[j]]
+		}
+		return chars[i] < chars[j]
+	})
 
-	if unmapped > 0 {
-		fmt.Printf("Warning: %d pairs not in dictionary\n", unmapped)
+	if top > 0 && len(chars) > 0 {
+		fmt.Println("Most frequent:")
+		for _, r := range chars[:min(top, len(chars))] {
+			fmt.Printf("  %q %d\n", r, ri.counts[r])
+		}
 	}
 
-	return result.String()
+	switch {
+	case ri.unmapped > 0:
+		fmt.Println("Warning: Chinese characters outside the dictionary; the file was likely encoded with a different one")
+	case ri.other > 0:
+		fmt.Println("Warning: unexpected characters; the file may be contaminated or raw-mode output")
+	default:
+		fmt.Println("All characters are consistent with the dictionary")
+	}
 }
 
-func (c *Codec) isValidBase64Pair(pair string) bool {
-	return len(pair) == 2 &&
-		strings.IndexByte(base64Charset, pair[0]) != -1 &&
-		strings.IndexByte(base64Charset, pair[1]) != -1
+// parseOutputTargets parses an -o value listing several outputs, as in
+// "base64:a.txt,raw:b.txt"
+func parseOutputTargets(spec string) ([]codec.OutputTarget, error) {
+	var targets []codec.OutputTarget
+	for _, item := range strings.Split(spec, ",") {
+		mode, path, found := strings.Cut(item, ":")
+		if !found || path == "" {
+			return nil, fmt.Errorf("invalid output %q; list outputs as mode:file, e.g. %s:a.txt,%s:b.txt",
+				item, codec.ModeBase64, codec.ModeRaw)
+		}
+		useBase64, err := parseMode(mode)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, codec.OutputTarget{Path: path, UseBase64: useBase64})
+	}
+	return targets, nil
 }
 
-func (c *Codec) printEncodeStats(inputSize, outputSize int, useBase64 bool) {
-	fmt.Printf("Original size: %d bytes\n", inputSize)
-	if useBase64 {
-		b64Size := base64.StdEncoding.EncodedLen(inputSize)
-		fmt.Printf("Base64 size: %d bytes\n", b64Size)
+// parseMode converts a mode name into the useBase64 setting
+func parseMode(mode string) (bool, error) {
+	switch mode {
+	case codec.ModeBase64:
+		return true, nil
+	case codec.ModeRaw:
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid mode %q (use %s or %s)", mode, codec.ModeBase64, codec.ModeRaw)
 	}
-	fmt.Printf("Encoded size: %d bytes\n", outputSize)
-	fmt.Printf("Encoding complete: output saved\n")
 }
 
-// Decode converts Chinese character representation back to original data
-func (c *Codec) Decode(inputPath, outputPath string, useBase64 bool) error {
-	data, err := os.ReadFile(inputPath)
-	if err != nil {
-		return fmt.Errorf("failed to read input: %w", err)
+// explicitFlags reports which flags of fs were set on the command line
+func explicitFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return explicit
+}
+
+// applyEnvDefaults fills settings not given on the command line from the
+// environment: explicit flags win over env vars, which win over defaults
+func applyEnvDefaults(fs *flag.FlagSet, dictFile *string, useBase64 *bool) error {
+	explicit := explicitFlags(fs)
+
+	if dict := os.Getenv("SINOGRAM_DICT"); dict != "" && !explicit["dict"] {
+		*dictFile = dict
+	}
+
+	if mode := os.Getenv("SINOGRAM_MODE"); mode != "" && !explicit["b64"] {
+		b64, err := parseMode(mode)
+		if err != nil {
+			return fmt.Errorf("SINOGRAM_MODE: %w", err)
+		}
+		*useBase64 = b64
 	}
 
-	decoded, err := c.decodeData(string(data), useBase64)
+	return nil
+}
+
+// applyProfile fills settings not given on the command line from a named
+// profile, which takes precedence over environment variables
+func applyProfile(fs *flag.FlagSet, name string, dictFile *string, useBase64 *bool, alphabet *string) error {
+	profile, err := loadProfile(name)
 	if err != nil {
-		return fmt.Errorf("decode failed: %w", err)
+		return err
 	}
 
-	if err := os.WriteFile(outputPath, decoded, 0644); err != nil {
-		return fmt.Errorf("failed to write output: %w", err)
+	explicit := explicitFlags(fs)
+
+	if profile.Dict != "" && !explicit["dict"] {
+		*dictFile = profile.Dict
+	}
+
+	if profile.Mode != "" && !explicit["b64"] {
+		*useBase64, _ = parseMode(profile.Mode)
+	}
+
+	if profile.Alphabet != "" && !explicit["alphabet"] {
+		*alphabet = profile.Alphabet
 	}
 
-	fmt.Printf("Decoding complete: %d bytes written\n", len(decoded))
 	return nil
 }
 
-func (c *Codec) decodeData(text string, useBase64 bool) ([]byte, error) {
-	var base64Text strings.Builder
+// exitCode returns the exit code for err, or fallback when err does not
+// fall into one of the categories the exit codes distinguish
+func exitCode(err error, fallback int) int {
+	var dictErr *codec.DictionaryError
+	var charErr *codec.InvalidCharacterError
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.Is(err, errUsage):
+		return exitUsage
+	case errors.As(err, &dictErr), errors.Is(err, codec.ErrNoDictionary), errors.Is(err, codec.ErrUnmappedPair),
+		errors.Is(err, codec.ErrNotPure):
+		return exitDictionary
+	case errors.As(err, &charErr), errors.Is(err, codec.ErrChecksumMismatch), errors.Is(err, codec.ErrBadLengthPrefix),
+		errors.Is(err, codec.ErrMalformedBase64), errors.Is(err, codec.ErrBadSpacing), errors.Is(err, codec.ErrVerifyFailed):
+		return exitIntegrity
+	case errors.As(err, &pathErr), errors.As(err, &linkErr):
+		return exitIO
+	}
+	return fallback
+}
+
+// setAction stores the input and output of "sinogram encode [input
+// [output]]" or "sinogram decode [input [output]]" where -e or -d and -o
+// would have put them. A missing or "-" input is standard input, and its
+// output defaults to standard output. With clipboard, a missing input and
+// output are the clipboard instead, which clipIn and clipOut report; the
+// caller connects it to standard input and output. fromString reports an
+// -input-string, which takes the place of the input.
+func setAction(action string, positional []string, clipboard bool, encodeFile, decodeFile, outputFile *string,
+	fromString bool) (clipIn, clipOut bool, err error) {
+	if len(positional) > 2 {
+		return false, false, fmt.Errorf("%w: sinogram %s [flags] [input [output]]", errUsage, action)
+	}
+	if len(positional) == 2 {
+		if *outputFile != "" {
+			return false, false, fmt.Errorf("give the output either as an argument or with -o, not both")
+		}
+		*outputFile = positional[1]
+	}
 
-	// Convert Chinese characters back to base64 pairs
-	for _, r := range text {
-		if pair, ok := c.runeToPair[r]; ok {
-			base64Text.WriteString(pair)
-		} else {
-			// Character not in mapping, keep as-is (handles padding, etc.)
-			base64Text.WriteRune(r)
+	input := codec.StdinPath
+	if len(positional) > 0 && positional[0] != "-" {
+		input = positional[0]
+	}
+	if action == "encode" && fromString {
+		if input != codec.StdinPath {
+			return false, false, fmt.Errorf("-input-string cannot be combined with an input file")
 		}
+		input = ""
+	} else if clipboard && len(positional) == 0 {
+		clipIn = true
 	}
 
-	base64Str := base64Text.String()
+	if *outputFile == "" {
+		switch {
+		case clipboard:
+			*outputFile, clipOut = codec.StdoutPath, true
+		case input == codec.StdinPath || input == "":
+			*outputFile = codec.StdoutPath
+		}
+	}
+	if clipboard && !clipIn && !clipOut {
+		return false, false, fmt.Errorf("-clipboard has nothing to do when both the input and output are given")
+	}
 
-	if useBase64 {
-		return base64.StdEncoding.DecodeString(base64Str)
+	if action == "encode" {
+		*encodeFile = input
+	} else {
+		*decodeFile = input
+	}
+	return clipIn, clipOut, nil
+}
+
+func main() {
+	exitOnSignal()
+
+	// Dispatch subcommands before parsing the top-level flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "encode":
+			runEncode(os.Args[2:])
+			return
+		case "decode":
+			runDecode(os.Args[2:])
+			return
+		}
+		if run, ok := commands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(exitCode(err, exitError))
+			}
+			return
+		}
 	}
 
-	return []byte(base64Str), nil
+	// The top-level -e and -d flags predate "encode" and "decode" and are
+	// kept so that existing scripts still work
+	runCodec("", os.Args[1:])
 }
 
-// generateSampleDictionary creates a default dictionary file
-func generateSampleDictionary(filename string) error {
-	sample := `第一回甄士隱夢幻識通靈賈雨村風塵懷閨秀作者自云因曾歷過番之後故將真事去而借說撰此石頭記書也曰但中所何又是哉今碌無成忽念及當日有女子細推了覺其行止見皆出於我上堂鬚眉不若彼裙釵實愧則餘悔益大可奈時欲已往賴天恩下承祖德錦衣紈絝飫甘饜美肥背父母教育負師兄規訓至半生潦倒罪編述以告普人固能免然閣本萬肖護短併使泯滅雖茆椽蓬牖瓦灶繩床晨月夕階柳庭花亦未傷襟筆墨學文爲用假語言敷演段來悅耳目乃題綱正義開卷即知意原友情並非怨世駡矣涉態得叙旨閱切詩浮着甚苦奔忙盛席華筵終散場悲喜千般同渺古盡荒唐謾紅袖啼痕重更痴抱恨長字看血十年辛尋常列位官你道從起根由近諳深趣味待在注明方聞惑媧氏煉補山稽崖高經二丈四頑三六五百零塊皇只單剩便棄青埂峰誰煅性眾俱獨己材堪入選遂嗟夜號慚悼俄僧遠骨骼凡豐神迥异笑坐邊談快論先些雲霧海僊玄到榮富貴聽打動心想要間享這粗蠢口吐向那弟物禮適耀繁慕質卻稍況仙形體定品必濟利如蒙發點慈攜帶溫柔鄉裡受幾永佩洪劫忘畢齊憨善樂依恃足好多魔八個緊相連屬瞬息极換究竟境歸空的熾進話复求再強制歎靜極思數既們莫并奇處踮腳罷施佛法助還案否感謝咒符展術登變鮮瑩洁玉且縮扇墜小拿托掌体寶沒須鐫妙昌隆邦簪纓族地安身業禁問件携望乞示白飄投舍訪跡分就茫離合歡炎涼面首偈與蒼枉許係前倩寄傳落胎親陳家瑣閒詞全備或适解悶朝代紀輿國反失考据寫賢忠理廷治俗政樣才微班姑蔡縱抄恐愛呢答太耶漢等添綴難野史蹈轍套新別致取拘市井少特訕謗君貶妻奸淫凶惡胜种穢污臭屠毒坏佳部共濫滿紙潘建西兩艷賦擬男名姓旁撥亂劇丑鬟婢乎逐悉矛盾睹敢似委消愁破歪熟噴飯供酒興衰際遇追蹤躡加穿鑿徒為貧食累怀貪戀色貨工夫願稱檢讀他醉飽臥避把玩豈省壽命筋力比謀虛妄舌害腿令眼胡牽扯淑娘舊稿忖晌遍指責佞誅邪罵仁臣良孝倫關功頌眷窮錄邀約私訂偷盟毫干尾悟易改吳樓東魯孔梅溪鑒曹雪芹軒披載增刪次纂章金陵絕酸淚都脂硯齋甲戌評仍按陷南隅蘇城閶門最流外里街內清巷廟窄狹呼葫蘆住宦費嫡封稟恬淡每觀修竹酌吟膝兒乳喚英蓮歲夏晝房手倦拋伏几憩朦朧睡辨廂放現公該結冤尚趁機會夾孽造罕河岸畔絳珠草株赤瑕宮瑛侍露灌溉始久延精滋養脫木僅游饑蜜果膳渴飲水湯酬報郁纏綿恰偶乘平緣警挂償惠勾陪碎膩概篇總香竊暗泄鬼愚度吾交割楚完猶集隨系請濁洞洗諦沉預跳火坑遞接奪牌坊幅對聯跟舉步聲霹靂崩叫睛烈芭蕉冉奶走越粉妝琢乖伸鬥耍熱鬧癩跣跛瘋癲揮霍哭主運爹睬耐煩撤句慣嬌菱澌防節元宵煙豫各幹營北邙銷影試晚隔壁居儒化表飛州仕末宗基喪京整淹蹇暫賣老倚佇引聊送童獻茶嚴爺拜慌恕誑駕略讓客候妨廳翻弄籍窗嗽丫擷儀容姿呆猛抬敝巾服窘腰圓厚闊兼劍星直鼻權腮轉雄壯襤褸什麼幫周疑怪困狂巨留早秋宴另具顧刻值占律卜頻斂額儔蟾光逢搔匵价奩淺誕謂團尊旅寂寥納辭拂院臾設杯盤肴款斟漫漸濃觥限斝簫管戶弦歌輪彩凝輝愈豪乾七寓晴欄捧仰騰兆履霓賀斗充沽囊路措突宜速春闈戰置謬銀冬九黃期買舟晤收介吃竿醒昨荐謁和鼓達黑陰倏霄啟社燈檻急逃婦妥找音響旦死病孺构疾醫療炸油鍋逸燒篱抵條焰軍民救勢熄怜片礫惟跌商議田庄偏旱鼠盜蜂搶狗兵剿捕折岳肅貫務農殷婿狼狽幸薄計哄賺朽屋稼穡勉支持活懶驚唬忿痛積暮攻景巧拄拐杖掙挫麻屣鶉曉冢堆聚閉孫順迎算宿慧徹陋室笏枯楊舞蛛絲雕梁綠紗糊鬢霜土隴帳底鴛鴦箱丐嘆保擇膏粱嫌帽鎖枷扛憐襖寒紫蟒唱認嫁裳拍肩褡褳烘信遣討靠僕針線喝任牢轎烏猩袍府怔象丟歇嚷差瞪禍`
+// runEncode implements "sinogram encode [flags] [input [output]]"
+func runEncode(args []string) {
+	runCodec("encode", args)
+}
 
-	return os.WriteFile(filename, []byte(sample), 0644)
+// runDecode implements "sinogram decode [flags] [input [output]]"
+func runDecode(args []string) {
+	runCodec("decode", args)
 }
 
-func main() {
-	// Command-line flags
-	encodeFile := flag.String("e", "", "Encode: specify input file")
-	decodeFile := flag.String("d", "", "Decode: specify input file")
-	dictFile := flag.String("dict", defaultDictFile, "Dictionary file path")
-	outputFile := flag.String("o", "", "Output file name")
-	useBase64 := flag.Bool("b64", true, "Use base64 encoding (default: true)")
-	genDict := flag.Bool("gen-dict", false, "Generate sample dictionary")
+// runCodec parses the flags of "sinogram encode" or "sinogram decode", or
+// with an empty action those of the top-level -e and -d form, and carries
+// out the action. Failures exit with the code for their kind.
+func runCodec(action string, args []string) {
+	name := "sinogram"
+	if action != "" {
+		name += " " + action
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		if action != "" {
+			fmt.Fprintf(os.Stderr, "Usage:\n  sinogram %s [flags] [input [output]]\n\nFlags:\n", action)
+			fs.PrintDefaults()
+			return
+		}
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "Usage:\n  sinogram encode [flags] file\n  sinogram decode [flags] file\n  sinogram <command> [flags] [arguments]\n\n")
+		fmt.Fprintf(os.Stderr, "Commands: %s\n\nFlags of encode and decode:\n", strings.Join(names, ", "))
+		fs.PrintDefaults()
+	}
+
+	// Command-line flags. Only the top-level form takes its input with -e
+	// or -d, and only encoding takes -input-string.
+	encodeFile, decodeFile, inputString := new(string), new(string), new(string)
+	if action == "" {
+		encodeFile = fs.String("e", "", "Encode: specify input file (@- for stdin)")
+		decodeFile = fs.String("d", "", "Decode: specify input file (@- for stdin)")
+	}
+	if action != "decode" {
+		inputString = fs.String("input-string", "", "Encode: literal content to encode")
+	}
+	dictFile := fs.String("dict", defaultDictFile, "Dictionary file path")
+	fallbackDict := fs.String("dict2", "", "Fallback dictionary that fills the pairs the -dict dictionary leaves unmapped")
+	dictMode := fs.String("dict-mode", codec.DictSorted, "How dictionary characters map to pairs: sorted or ordered (file order)")
+	alphabet := fs.String("alphabet", codec.DefaultAlphabet, alphabetHelp)
+	normalizeOutput := fs.String("normalize-output", "", "Show mapped characters in this script variant: simplified or traditional (needs -variant-table)")
+	variantTable := fs.String("variant-table", "", "Simplified-to-traditional character table for -normalize-output")
+	preferCommon := fs.String("prefer-common", "", "Map characters listed in this file ahead of the rest of a dictionary with more than 4096")
+	profileName := fs.String("profile", "", "Use the dictionary, mode and alphabet of a named profile")
+	outputFile := fs.String("o", "", "Output file name")
+	format := fs.String("format", codec.FormatText, "Encode output format: text or html")
+	useBase64 := fs.Bool("b64", true, "Use base64 encoding (default: true)")
+	genDict := fs.Bool("gen-dict", false, "Generate sample dictionary (same as sinogram dict gen)")
+	embedDict := fs.Bool("embed-dict", false, "Encode: embed the mapping in the output so decoding needs no dictionary")
+	noCache := fs.Bool("no-cache", false, "Build the dictionary mapping without using or updating the cache")
+	strictDict := fs.Bool("strict-dict", false, "Refuse dictionaries whose mapping is not one-to-one")
+	checksum := fs.Bool("checksum", false, "Encode: record the input's SHA-256 in a header for decode to verify")
+	force := fs.Bool("force", false, "Replace an existing output file")
+	preserve := fs.Bool("preserve", false, "Encode: record the input's permissions and modification time for decode to restore")
+	verify := fs.Bool("verify", false, "Encode: decode the output in memory and fail unless it matches the input")
+	backup := fs.Bool("backup", false, "Decode: keep an existing output as .bak until the result is verified")
+	onUnmapped := fs.String("on-unmapped", codec.UnmappedPassthrough, "Encode: what to do with pairs not in the dictionary: passthrough, error or placeholder")
+	placeholder := fs.String("placeholder", string(codec.DefaultPlaceholder), "Character written for unmapped pairs with -on-unmapped placeholder")
+	b64Variant := fs.String("b64-variant", codec.B64Std, "Encode: base64 form to map: std or mime (CRLF line breaks every 76 characters)")
+	space := fs.Int("space", 0, "Encode: insert a separator after every N encoded characters for readability (0: none)")
+	spaceChar := fs.String("space-char", string(codec.DefaultSpaceChar), "Separator written by -space: a space character other than a line break")
+	pure := fs.Bool("pure", false, "Encode: fail unless the encoded text consists only of dictionary characters (implies -align3 in base64 mode)")
+	align3 := fs.Bool("align3", false, "Encode: zero-pad the input to a multiple of 3 bytes so the output has no '=' padding")
+	salt := fs.Int("salt", 0, "Encode: put N random bytes before the data so identical inputs encode differently (0: none)")
+	frame := fs.Bool("frame", false, "Encode: record the input length so decode restores exactly that many bytes")
+	passthroughASCII := fs.Bool("passthrough-ascii", false, "Encode: keep ASCII text literal and encode only the other bytes")
+	assumeUTF8 := fs.Bool("assume-utf8", false, "Encode: in raw mode, reject input that is not valid UTF-8 and warn about dictionary characters in it")
+	limit := fs.Int64("limit", 0, "Encode: encode only the first N input bytes, marking the output as a truncated preview (0: all)")
+	recoverDamaged := fs.Bool("recover", false, "Decode: replace undecodable regions with a marker and continue instead of failing")
+	strictDecode := fs.Bool("strict-decode", false, "Decode: in base64 mode, refuse characters and base64 pairs the encoder would not have written")
+	trim := fs.Bool("trim", false, "Decode: strip surrounding quotes, code fences and labels from pasted input")
+	compare := fs.String("compare-modes", "", "Encode an input in both modes in memory and recommend one")
+	countOnly := fs.String("count-only", "", "Count distinct pairs an input needs (no dictionary required)")
+	lineMode := fs.Bool("line-mode", false, "Encode or decode each input line on its own, writing it out as soon as it is read")
+	verbose := fs.Bool("verbose", false, "Print additional details")
+	maxMemory := fs.Int64("max-memory", 0, "Stream inputs larger than this many bytes instead of reading them whole (0: never)")
+	headerVersion := fs.Int("header-version", 0, "Encode: format version of the header line: 1 for decoders older than format 2 (0: current)")
+	plugin := fs.String("plugin", "", "Command, with arguments, that transforms the data before encoding and after decoding")
+	clipboard := fs.Bool("clipboard", false, "With encode or decode: read a missing input from, and write a missing output to, the system clipboard")
+	noProgress := fs.Bool("no-progress", false, "Do not show a progress bar while encoding or decoding large files")
+
+	var clipIn, clipOut bool
+	if action == "" {
+		fs.Parse(args)
+		if *clipboard {
+			fmt.Fprintf(os.Stderr, "Error: -clipboard needs sinogram encode or sinogram decode\n")
+			os.Exit(exitUsage)
+		}
+	} else {
+		positional := parseInterspersed(fs, args)
+		var err error
+		clipIn, clipOut, err = setAction(action, positional, *clipboard,
+			encodeFile, decodeFile, outputFile, explicitFlags(fs)["input-string"])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	// -input-string "" encodes the empty string, so only whether it was given counts
+	fromString := explicitFlags(fs)["input-string"]
 
-	flag.Parse()
+	if err := applyEnvDefaults(fs, dictFile, useBase64); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	if *profileName != "" {
+		if err := applyProfile(fs, *profileName, dictFile, useBase64, alphabet); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitCode(err, exitUsage))
+		}
+	}
 
 	// Generate dictionary if requested
 	if *genDict {
-		if err := generateSampleDictionary(defaultDictFile); err != nil {
+		err := checkOverwrite(defaultDictFile, *force)
+		if err == nil {
+			err = generateSampleDictionary(defaultDictFile)
+		}
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+			os.Exit(exitCode(err, exitError))
 		}
 		fmt.Printf("Sample dictionary generated: %s\n", defaultDictFile)
 		return
 	}
 
-	// Initialize codec and load dictionary
-	codec := NewCodec()
-	if err := codec.LoadDictionary(*dictFile); err != nil {
+	// Count pairs if requested
+	if *countOnly != "" {
+		if err := countPairs(*countOnly, *useBase64, *verbose); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitCode(err, exitError))
+		}
+		return
+	}
+
+	if *format != codec.FormatText && *format != codec.FormatHTML {
+		fmt.Fprintf(os.Stderr, "Error: unknown format %q (use %s or %s)\n", *format, codec.FormatText, codec.FormatHTML)
+		os.Exit(exitUsage)
+	}
+
+	if err := checkDictMode(*dictMode); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	if err := checkAlphabet(*alphabet); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+
+	switch *onUnmapped {
+	case codec.UnmappedPassthrough, codec.UnmappedError, codec.UnmappedPlaceholder:
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown unmapped-pair policy %q (use %s, %s or %s)\n",
+			*onUnmapped, codec.UnmappedPassthrough, codec.UnmappedError, codec.UnmappedPlaceholder)
+		os.Exit(exitUsage)
+	}
+
+	placeholderRune, size := utf8.DecodeRuneInString(*placeholder)
+	alpha, _ := codec.LookupAlphabet(*alphabet)
+	if size != len(*placeholder) || size <= 1 || !codec.ValidPlaceholder(placeholderRune) || alpha.Has(placeholderRune) {
+		fmt.Fprintf(os.Stderr, "Error: -placeholder must be a single character that is neither ASCII, Chinese nor in the %s alphabet\n", *alphabet)
+		os.Exit(exitUsage)
+	}
+
+	if *b64Variant != codec.B64Std && *b64Variant != codec.B64MIME {
+		fmt.Fprintf(os.Stderr, "Error: unknown base64 variant %q (use %s or %s)\n", *b64Variant, codec.B64Std, codec.B64MIME)
+		os.Exit(exitUsage)
+	}
+
+	spaceRune, size := utf8.DecodeRuneInString(*spaceChar)
+	if size != len(*spaceChar) || !codec.ValidSpaceChar(spaceRune) {
+		fmt.Fprintf(os.Stderr, "Error: -space-char must be a single space character other than a line break\n")
+		os.Exit(exitUsage)
+	}
+
+	if *space < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -space must not be negative\n")
+		os.Exit(exitUsage)
+	}
+
+	if *space > 0 && *b64Variant == codec.B64MIME {
+		fmt.Fprintf(os.Stderr, "Error: -space cannot be combined with -b64-variant %s\n", codec.B64MIME)
+		os.Exit(exitUsage)
+	}
+
+	// Clipboard input only takes the place of standard input later on
+	if err := checkStdinDict(*dictFile, *encodeFile, *decodeFile); err != nil && !clipIn {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		os.Exit(exitUsage)
+	}
+
+	switch *normalizeOutput {
+	case "":
+		if *variantTable != "" {
+			fmt.Fprintf(os.Stderr, "Error: -variant-table needs -normalize-output\n")
+			os.Exit(exitUsage)
+		}
+	case codec.VariantSimplified, codec.VariantTraditional:
+		if *variantTable == "" {
+			fmt.Fprintf(os.Stderr, "Error: -normalize-output needs a -variant-table\n")
+			os.Exit(exitUsage)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown variant %q (use %s or %s)\n",
+			*normalizeOutput, codec.VariantSimplified, codec.VariantTraditional)
+		os.Exit(exitUsage)
+	}
+
+	if *pure && *passthroughASCII {
+		fmt.Fprintf(os.Stderr, "Error: -pure cannot be combined with -passthrough-ascii\n")
+		os.Exit(exitUsage)
+	}
+
+	if *recoverDamaged && *backup {
+		fmt.Fprintf(os.Stderr, "Error: -recover cannot be combined with -backup\n")
+		os.Exit(exitUsage)
+	}
+
+	if *recoverDamaged && *strictDecode {
+		fmt.Fprintf(os.Stderr, "Error: -recover cannot be combined with -strict-decode\n")
+		os.Exit(exitUsage)
+	}
+
+	// An -o listing several mode:file outputs encodes the input once per mode
+	var targets []codec.OutputTarget
+	if strings.Contains(*outputFile, ",") {
+		if *decodeFile != "" {
+			fmt.Fprintf(os.Stderr, "Error: multiple outputs are only supported when encoding\n")
+			os.Exit(exitUsage)
+		}
+		var err error
+		if targets, err = parseOutputTargets(*outputFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	if *lineMode && (fromString || targets != nil || *backup || *maxMemory > 0 || *verify || *preserve) {
+		fmt.Fprintf(os.Stderr, "Error: -line-mode cannot be combined with -input-string, multiple outputs, -backup, -max-memory, -verify or -preserve\n")
+		os.Exit(exitUsage)
+	}
+
+	if *limit < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -limit must not be negative\n")
+		os.Exit(exitUsage)
+	}
+
+	if *assumeUTF8 && *useBase64 {
+		fmt.Fprintf(os.Stderr, "Error: -assume-utf8 requires raw mode (-b64=false)\n")
+		os.Exit(exitUsage)
+	}
+
+	if *passthroughASCII && !*useBase64 {
+		fmt.Fprintf(os.Stderr, "Error: -passthrough-ascii requires base64 mode\n")
+		os.Exit(exitUsage)
+	}
+
+	if *salt < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -salt must not be negative\n")
+		os.Exit(exitUsage)
+	}
+
+	if *salt > 0 && !*useBase64 {
+		fmt.Fprintf(os.Stderr, "Error: -salt requires base64 mode\n")
+		os.Exit(exitUsage)
+	}
+
+	if *frame && !*useBase64 {
+		fmt.Fprintf(os.Stderr, "Error: -frame requires base64 mode\n")
+		os.Exit(exitUsage)
+	}
+
+	if *align3 && !*useBase64 {
+		fmt.Fprintf(os.Stderr, "Error: -align3 requires base64 mode\n")
+		os.Exit(exitUsage)
+	}
+
+	if *headerVersion < 0 || *headerVersion > codec.FormatVersion {
+		fmt.Fprintf(os.Stderr, "Error: -header-version must be between 1 and %d\n", codec.FormatVersion)
+		os.Exit(exitUsage)
+	}
+
+	// Initialize codec and load dictionary. Decoding input that carries an
+	// embedded dictionary needs none, so that failure is deferred to Decode.
+	opts := []codec.Option{
+		codec.WithBase64(*useBase64),
+		codec.WithFormat(*format),
+		codec.WithDictMode(*dictMode),
+		codec.WithAlphabet(*alphabet),
+		codec.WithVerbose(*verbose),
+		codec.WithEmbedDict(*embedDict),
+		codec.WithTrim(*trim),
+		codec.WithRecover(*recoverDamaged),
+		codec.WithStrictDecode(*strictDecode),
+		codec.WithAssumeUTF8(*assumeUTF8),
+		codec.WithLimit(*limit),
+		codec.WithStrictDict(*strictDict),
+		codec.WithProfile(*profileName),
+		codec.WithMaxMemory(*maxMemory),
+		codec.WithChecksum(*checksum),
+		codec.WithVerify(*verify),
+		codec.WithPreserve(*preserve),
+		codec.WithBackup(*backup),
+		codec.WithPassthroughASCII(*passthroughASCII),
+		codec.WithFrame(*frame),
+		codec.WithSalt(*salt),
+		codec.WithHeaderVersion(*headerVersion),
+		codec.WithAlign3(*align3),
+		codec.WithPure(*pure),
+		codec.WithB64Variant(*b64Variant),
+		codec.WithUnmappedPolicy(*onUnmapped, placeholderRune),
+		codec.WithSpace(*space, spaceRune),
+	}
+	if !*noCache {
+		opts = append(opts, codec.WithCacheDir(mappingCacheDir()))
+	}
+	if *preferCommon != "" {
+		prefer, err := readPreferList(*preferCommon)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitCode(err, exitUsage))
+		}
+		opts = append(opts, codec.WithPrefer(prefer))
+	}
+	if args := strings.Fields(*plugin); len(args) > 0 {
+		opts = append(opts, codec.WithPlugin(args[0], args[1:]...))
+	}
+	if *normalizeOutput != "" {
+		variants, err := readVariantTable(*variantTable, *normalizeOutput)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitCode(err, exitUsage))
+		}
+		opts = append(opts, codec.WithVariants(variants))
+	}
+	var bar *progressBar
+	if !*noProgress && !*lineMode && (*encodeFile != "" || *decodeFile != "") {
+		if bar = newProgressBar(progressThreshold); bar != nil {
+			opts = append(opts, codec.WithProgress(bar.update))
+		}
+	}
+	c := codec.NewCodec(opts...)
+	dictErr := c.LoadDictionary(*dictFile)
+	if dictErr == nil && *fallbackDict != "" {
+		if err := c.LoadFallbackDictionary(*fallbackDict); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitDictionary)
+		}
+	}
+	if dictErr != nil && *decodeFile == "" {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", dictErr)
+		os.Exit(exitDictionary)
+	}
+
+	// The clipboard is connected once a piped dictionary has been read
+	if clipIn {
+		data, err := readClipboard()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitIO)
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitIO)
+		}
+		go func() {
+			w.Write(data)
+			w.Close()
+		}()
+		os.Stdin = r
+	}
+	if clipOut {
+		cw, err := newClipboardWriter()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitIO)
+		}
+		os.Stdout = cw.File
+		// Failures exit before this runs, leaving the clipboard untouched
+		defer func() {
+			if err := cw.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(exitIO)
+			}
+			logger.Info("Output copied to the clipboard")
+		}()
+	}
+
+	// Compare modes if requested
+	if *compare != "" {
+		if err := compareModes(c, *compare); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitCode(err, exitError))
+		}
+		return
+	}
+
+	// Handle encoding of a literal string
+	if fromString {
+		output := *outputFile
+		if output == "" {
+			output = "string.encoded"
+		}
+		if err := checkOutputs(output, targets, *force); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitCode(err, exitError))
+		}
+
+		var err error
+		if targets != nil {
+			var results []codec.EncodeResult
+			results, err = c.EncodeStringToTargets(*inputString, targets)
+			printEncodeResults(c, targets, results, *verbose)
+		} else {
+			var result codec.EncodeResult
+			if result, err = c.EncodeStringToFile(*inputString, output, *useBase64); err == nil {
+				printEncodeResult(c, result, *useBase64, *verbose)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Encoding error: %v\n", err)
+			os.Exit(exitCode(err, exitError))
+		}
+		return
 	}
 
 	// Handle encoding
 	if *encodeFile != "" {
 		output := *outputFile
 		if output == "" {
-			output = *encodeFile + ".encoded"
+			output = defaultOutput(*encodeFile, ".encoded")
+		}
+		if err := checkOutputs(output, targets, *force); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitCode(err, exitError))
 		}
 
-		if err := codec.Encode(*encodeFile, output, *useBase64); err != nil {
+		var err error
+		if *lineMode {
+			err = streamLines(*encodeFile, output, func(r io.Reader, w io.Writer) error {
+				return c.EncodeLines(r, w, *useBase64)
+			})
+		} else if targets != nil {
+			var results []codec.EncodeResult
+			results, err = c.EncodeTargets(*encodeFile, targets)
+			bar.finish()
+			printEncodeResults(c, targets, results, *verbose)
+		} else {
+			var result codec.EncodeResult
+			result, err = c.Encode(*encodeFile, output, *useBase64)
+			bar.finish()
+			if err == nil {
+				printEncodeResult(c, result, *useBase64, *verbose)
+			}
+		}
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Encoding error: %v\n", err)
-			os.Exit(1)
+			os.Exit(exitCode(err, exitError))
 		}
 		return
 	}
@@ -260,16 +2354,38 @@ func main() {
 	if *decodeFile != "" {
 		output := *outputFile
 		if output == "" {
-			output = *decodeFile + ".decoded"
+			output = defaultOutput(*decodeFile, ".decoded")
+		}
+		// -backup replaces the output by design, keeping the original
+		if err := checkOverwrite(output, *force || *backup); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitCode(err, exitError))
 		}
 
-		if err := codec.Decode(*decodeFile, output, *useBase64); err != nil {
+		var err error
+		if *lineMode {
+			err = streamLines(*decodeFile, output, func(r io.Reader, w io.Writer) error {
+				return c.DecodeLines(r, w, *useBase64)
+			})
+		} else {
+			var result codec.DecodeResult
+			result, err = c.Decode(*decodeFile, output, *useBase64)
+			bar.finish()
+			if err == nil {
+				logger.Info(fmt.Sprintf("Decoding complete: %d bytes written", result.OutputBytes))
+			}
+		}
+		if err != nil {
+			if errors.Is(err, codec.ErrNoDictionary) {
+				err = dictErr
+			}
 			fmt.Fprintf(os.Stderr, "Decoding error: %v\n", err)
-			os.Exit(1)
+			os.Exit(exitCode(err, exitIntegrity))
 		}
 		return
 	}
 
 	// No action specified
-	flag.Usage()
+	fs.Usage()
+	os.Exit(exitUsage)
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf8"
+)
+
+// testDict is the full dictionary shipped at the repository root
+const testDict = "dictionary_4096.md"
+
+// A corpus too small for a dictionary is a dictionary failure, like a
+// failed dict check
+func TestGenDictSmallCorpusExitCode(t *testing.T) {
+	dir := t.TempDir()
+	corpus := filepath.Join(dir, "corpus.txt")
+	if err := os.WriteFile(corpus, []byte("只有幾個字"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := runGenDict([]string{"-from", corpus, "-o", filepath.Join(dir, "dict.md")})
+	if err == nil {
+		t.Fatal("runGenDict accepted a 5-character corpus")
+	}
+	if code := exitCode(err, exitError); code != exitDictionary {
+		t.Fatalf("exit code %d, want %d (%v)", code, exitDictionary, err)
+	}
+}
+
+// writeTree creates files, by slash-separated path, under dir
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readFile returns the content of path, failing the test if it is missing
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// packTree packs files into an encoded archive and returns its path
+func packTree(t *testing.T, files map[string]string, flags ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeTree(t, src, files)
+
+	packed := filepath.Join(dir, "src.encoded")
+	args := append([]string{"-dict", testDict, "-o", packed}, flags...)
+	if err := runPack(append(args, src)); err != nil {
+		t.Fatalf("pack: %v", err)
+	}
+	return packed
+}
+
+func TestUnpackRefusesExistingFiles(t *testing.T) {
+	packed := packTree(t, map[string]string{"a.txt": "from the archive"})
+	dest := t.TempDir()
+	writeTree(t, dest, map[string]string{"a.txt": "already here"})
+
+	err := runUnpack([]string{"-dict", testDict, "-o", dest, packed})
+	if code := exitCode(err, exitError); code != exitIO {
+		t.Fatalf("unpack over an existing file: exit code %d, want %d (%v)", code, exitIO, err)
+	}
+	if got := readFile(t, filepath.Join(dest, "a.txt")); got != "already here" {
+		t.Fatalf("existing file changed to %q", got)
+	}
+
+	if err := runUnpack([]string{"-dict", testDict, "-force", "-o", dest, packed}); err != nil {
+		t.Fatalf("unpack -force: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dest, "a.txt")); got != "from the archive" {
+		t.Fatalf("unpack -force left %q", got)
+	}
+}
+
+// A file cut short by a damaged archive is never left behind
+func TestUnpackLeavesNoPartialFile(t *testing.T) {
+	big := make([]byte, 300<<10)
+	for i := range big {
+		big[i] = byte(i * 31 >> 3)
+	}
+	packed := packTree(t, map[string]string{"big.bin": string(big)})
+
+	data, err := os.ReadFile(packed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut at a character boundary, well into the file's content
+	cut := len(data) / 2
+	for cut > 0 && !utf8.RuneStart(data[cut]) {
+		cut--
+	}
+	if err := os.WriteFile(packed, data[:cut], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	if err := runUnpack([]string{"-dict", testDict, "-o", dest, packed}); err == nil {
+		t.Fatal("unpack of a truncated archive succeeded")
+	}
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("left behind: %s", e.Name())
+	}
+}
+
+// -reproducible packs equal trees identically, whatever their mtimes
+func TestPackReproducible(t *testing.T) {
+	files := map[string]string{"a.txt": "alpha", "sub/b.txt": "beta"}
+	first := readFile(t, packTree(t, files, "-reproducible"))
+	second := readFile(t, packTree(t, files, "-reproducible"))
+	if first != second {
+		t.Fatal("two packs of equal trees differ")
+	}
+}
+
+// A nested tree survives pack and unpack, with and without -gzip
+func TestPackUnpackNested(t *testing.T) {
+	files := map[string]string{
+		"top.txt":            "top",
+		"a/mid.txt":          "middle",
+		"a/b/c/deep.bin":     "\x00\x01\xfe\xff",
+		"a/b/sibling.txt":    "sibling",
+		"other/中文名.txt":      "名字",
+		"other/empty.txt":    "",
+		"a/b/c/d/e/last.txt": "last",
+	}
+	src := filepath.Join(t.TempDir(), "src")
+	writeTree(t, src, files)
+	if err := os.Chmod(filepath.Join(src, "top.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, flags := range [][]string{nil, {"-gzip"}} {
+		packed := filepath.Join(t.TempDir(), "src.encoded")
+		if err := runPack(append([]string{"-dict", testDict, "-o", packed}, append(flags, src)...)); err != nil {
+			t.Fatalf("pack %v: %v", flags, err)
+		}
+
+		dest := t.TempDir()
+		if err := runUnpack([]string{"-dict", testDict, "-o", dest, packed}); err != nil {
+			t.Fatalf("unpack %v: %v", flags, err)
+		}
+		for name, want := range files {
+			if got := readFile(t, filepath.Join(dest, filepath.FromSlash(name))); got != want {
+				t.Errorf("%v: %s = %q, want %q", flags, name, got, want)
+			}
+		}
+		info, err := os.Stat(filepath.Join(dest, "top.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != 0755 {
+			t.Errorf("%v: top.txt has mode %v, want 0755", flags, perm)
+		}
+	}
+}
+
+// Profiles can select an alphabet, which must be registered
+func TestProfileAlphabet(t *testing.T) {
+	profile, err := parseProfile("k", "/profiles", "dict = kana.md\nalphabet = kana\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Alphabet != "kana" {
+		t.Errorf("Alphabet = %q, want kana", profile.Alphabet)
+	}
+	if _, err := parseProfile("k", "/profiles", "alphabet = klingon\n"); err == nil {
+		t.Error("parseProfile accepted an unknown alphabet")
+	}
+}
+
+// encode and decode parse their own flag sets, so they can run one after
+// the other in one process with flags after the file names
+func TestEncodeDecodeFlagSets(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in.txt")
+	encoded := filepath.Join(dir, "in.encoded")
+	decoded := filepath.Join(dir, "out.txt")
+	if err := os.WriteFile(in, []byte("hello, world\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	runEncode([]string{in, encoded, "-dict", testDict, "-checksum", "-no-progress"})
+	runDecode([]string{"-dict", testDict, encoded, decoded})
+	if got := readFile(t, decoded); got != "hello, world\n" {
+		t.Errorf("round trip gave %q", got)
+	}
+}
+
+// An empty -input-string encodes the empty string rather than counting as
+// no input, which would read standard input
+func TestEncodeEmptyInputString(t *testing.T) {
+	dir := t.TempDir()
+	stdin, err := os.Create(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	if _, err := stdin.WriteString("not this"); err != nil {
+		t.Fatal(err)
+	}
+	stdin.Seek(0, io.SeekStart)
+	saved := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = saved }()
+
+	out := filepath.Join(dir, "empty.encoded")
+	runEncode([]string{"-dict", testDict, "-input-string", "", "-o", out})
+	if got := readFile(t, out); got != "" {
+		t.Errorf("encoded the empty string as %q", got)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// progressThreshold is the input size, in bytes, from which encoding and
+// decoding show a progress bar
+const progressThreshold = 64 << 20
+
+// progressInterval is how often the progress bar is redrawn
+const progressInterval = 200 * time.Millisecond
+
+// progressBar draws the progress of reading an input on standard error,
+// once the input is known to reach min bytes
+type progressBar struct {
+	min     int64
+	start   time.Time
+	drawn   time.Time // When the bar was last drawn; zero until it is shown
+	done    int64
+	total   int64
+	stopped bool
+}
+
+// newProgressBar returns a progress bar for inputs of at least min bytes,
+// or nil when standard error is not a terminal, where it would be noise
+func newProgressBar(min int64) *progressBar {
+	info, err := os.Stderr.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return &progressBar{min: min}
+}
+
+// update records that done of total bytes have been read, total being -1
+// when unknown, and redraws the bar now and then. It is a codec.Progress
+// function.
+func (b *progressBar) update(done, total int64) {
+	if b.stopped {
+		return
+	}
+	if b.start.IsZero() {
+		b.start = time.Now()
+	}
+	b.done, b.total = done, total
+	if b.drawn.IsZero() && max(done, total) < b.min {
+		return
+	}
+	if done == total {
+		b.finish()
+		return
+	}
+	if now := time.Now(); now.Sub(b.drawn) >= progressInterval {
+		b.drawn = now
+		b.draw()
+	}
+}
+
+// finish draws the bar a last time, if it was shown, and ends its line.
+// It may be called on a nil bar.
+func (b *progressBar) finish() {
+	if b == nil || b.stopped {
+		return
+	}
+	b.stopped = true
+	if !b.drawn.IsZero() || (b.done > 0 && max(b.done, b.total) >= b.min) {
+		b.draw()
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// draw writes the bar over the current line: the share read when the
+// total is known, the bytes read, the throughput and the time left
+func (b *progressBar) draw() {
+	elapsed := time.Since(b.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(b.done) / elapsed
+	}
+
+	var line strings.Builder
+	if b.total > 0 {
+		const width = 30
+		frac := float64(b.done) / float64(b.total)
+		filled := int(frac * width)
+		line.WriteString("[" + strings.Repeat("=", filled))
+		if filled < width {
+			line.WriteString(">" + strings.Repeat(" ", width-filled-1))
+		}
+		fmt.Fprintf(&line, "] %5.1f%%  %s / %s", frac*100, formatBytes(b.done), formatBytes(b.total))
+	} else {
+		line.WriteString(formatBytes(b.done))
+	}
+	fmt.Fprintf(&line, "  %s/s", formatBytes(int64(rate)))
+	if b.total > 0 && b.done < b.total && rate > 0 {
+		left := time.Duration(float64(b.total-b.done) / rate * float64(time.Second))
+		fmt.Fprintf(&line, "  ETA %s", formatDuration(left))
+	}
+	// Clear what a longer line drawn before left behind
+	fmt.Fprintf(os.Stderr, "\r%s\033[K", line.String())
+}
+
+// formatBytes formats n bytes with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatDuration formats d as minutes and seconds, or hours, minutes and
+// seconds
+func formatDuration(d time.Duration) string {
+	s := int64(d.Round(time.Second).Seconds())
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
@@ -0,0 +1,125 @@
+//go:build js && wasm
+
+// Command wasm exposes the codec to JavaScript, so pages can encode and
+// decode in the browser without sending data anywhere. Build it with
+//
+//	GOOS=js GOARCH=wasm go build -o sinogram.wasm ./wasm
+//
+// and load it with the wasm_exec.js that ships with Go. It defines
+// sinogram.encode(bytes, dict) and sinogram.decode(text, dict) on the
+// global object. Both return a Promise: encode resolves to the encoded
+// text of a Uint8Array or string, decode to the decoded Uint8Array. dict
+// is the dictionary's content; decode may pass "" for text that embeds
+// its dictionary. Failures reject the Promise with an Error.
+package main
+
+import (
+	"errors"
+	"strings"
+	"syscall/js"
+
+	"github.com/Kaiser-Zheng/sinogram/codec"
+)
+
+// lastDict and lastCodec remember the most recent dictionary, as a page
+// usually passes the same one to every call
+var (
+	lastDict  string
+	lastCodec *codec.Codec
+)
+
+func main() {
+	js.Global().Set("sinogram", js.ValueOf(map[string]any{
+		"encode": js.FuncOf(encode),
+		"decode": js.FuncOf(decode),
+	}))
+	select {} // Keep the exported functions callable
+}
+
+// encode implements sinogram.encode(bytes, dict)
+func encode(_ js.Value, args []js.Value) any {
+	if len(args) != 2 {
+		return reject(errors.New("encode takes bytes and a dictionary"))
+	}
+	data, err := bytesArg(args[0])
+	if err != nil {
+		return reject(err)
+	}
+	c, err := codecFor(args[1])
+	if err != nil {
+		return reject(err)
+	}
+	if c.MappedPairs() == 0 {
+		return reject(codec.ErrNoDictionary)
+	}
+
+	encoded, err := c.EncodeBytes(data)
+	if err != nil {
+		return reject(err)
+	}
+	return resolve(encoded)
+}
+
+// decode implements sinogram.decode(text, dict)
+func decode(_ js.Value, args []js.Value) any {
+	if len(args) != 2 || args[0].Type() != js.TypeString {
+		return reject(errors.New("decode takes encoded text and a dictionary"))
+	}
+	c, err := codecFor(args[1])
+	if err != nil {
+		return reject(err)
+	}
+
+	decoded, err := c.DecodeBytes(args[0].String())
+	if err != nil {
+		return reject(err)
+	}
+	array := js.Global().Get("Uint8Array").New(len(decoded))
+	js.CopyBytesToJS(array, decoded)
+	return resolve(array)
+}
+
+// bytesArg reads a Uint8Array, or a string as UTF-8
+func bytesArg(v js.Value) ([]byte, error) {
+	switch {
+	case v.Type() == js.TypeString:
+		return []byte(v.String()), nil
+	case v.InstanceOf(js.Global().Get("Uint8Array")):
+		data := make([]byte, v.Get("length").Int())
+		js.CopyBytesToGo(data, v)
+		return data, nil
+	}
+	return nil, errors.New("data to encode must be a Uint8Array or a string")
+}
+
+// codecFor returns a codec for the dictionary content in v, reusing the
+// last one when the content is unchanged. Messages are not logged, as
+// there is no terminal to show them on.
+func codecFor(v js.Value) (*codec.Codec, error) {
+	if v.Type() != js.TypeString {
+		return nil, errors.New("the dictionary must be a string")
+	}
+	dict := v.String()
+	if lastCodec != nil && dict == lastDict {
+		return lastCodec, nil
+	}
+
+	c := codec.NewCodec(codec.WithLogger(nil))
+	if dict != "" {
+		if err := c.LoadDictionaryFromReader(strings.NewReader(dict)); err != nil {
+			return nil, err
+		}
+	}
+	lastDict, lastCodec = dict, c
+	return c, nil
+}
+
+// resolve returns a Promise fulfilled with v
+func resolve(v any) js.Value {
+	return js.Global().Get("Promise").Call("resolve", v)
+}
+
+// reject returns a Promise rejected with an Error describing err
+func reject(err error) js.Value {
+	return js.Global().Get("Promise").Call("reject", js.Global().Get("Error").New(err.Error()))
+}